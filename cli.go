@@ -0,0 +1,235 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/google/gopacket/pcap"
+)
+
+// command 一个子命令 run 的参数不包括子命令的名字
+type command struct {
+	name string
+	args string
+	help string
+	run  func(cmd *command, args []string) error
+}
+
+var commands = []*command{
+	{name: "capture", help: "capture and decode traffic on network interfaces", run: runCapture},
+	{name: "read", args: "capture.pcap", help: "decode a pcap or pcapng file", run: runRead},
+	{name: "list-ifaces", help: "list network interfaces", run: listIfaces},
+	{name: "list-protocols", help: "list supported protocols", run: listProtocols},
+	{name: "validate-config", args: "config.json", help: "check a config file without capturing", run: validate},
+}
+
+func findCommand(name string) *command {
+	for _, cmd := range commands {
+		if cmd.name == name {
+			return cmd
+		}
+	}
+	return nil
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: l7dump <command> [flags]")
+	fmt.Fprintln(os.Stderr, "\ncommands:")
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "  %-16s %s\n", cmd.name, cmd.help)
+	}
+	fmt.Fprintln(os.Stderr, "\nl7dump config.json [capture.pcap] is the same as capture -c config.json or read -c config.json capture.pcap")
+	fmt.Fprintln(os.Stderr, "run l7dump <command> -h for the flags of a command")
+}
+
+// parse 解析参数 参数不满足要求时输出用法并退出
+func (cmd *command) parse(fs *flag.FlagSet, args []string, positional int) []string {
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: l7dump %s [flags] %s\n%s\n", cmd.name, cmd.args, cmd.help)
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != positional {
+		fs.Usage()
+		os.Exit(2)
+	}
+	return fs.Args()
+}
+
+// options capture 和 read 共用的参数
+type options struct {
+	config   string
+	iface    string
+	protos   protocolFlags
+	format   string
+	output   string
+	bpf      string
+	snaplen  int
+	promisc  bool
+	duration time.Duration
+	count    int64
+}
+
+// protocolFlags 可以重复的 -p 参数 例如 -p mysql:3306 -p redis:6379-6380
+type protocolFlags []string
+
+func (p *protocolFlags) String() string {
+	return strings.Join(*p, " ")
+}
+
+func (p *protocolFlags) Set(v string) error {
+	*p = append(*p, v)
+	return nil
+}
+
+func (o *options) register(fs *flag.FlagSet, live bool) {
+	fs.StringVar(&o.config, "c", "", "config file, can't be used with -p")
+	fs.Var(&o.protos, "p", "protocol and ports to decode without a config file, e.g. mysql:3306 or redis:6379-6380,7000, "+
+		"protocol alone detects it from data, can be repeated")
+	fs.StringVar(&o.format, "format", "jsonl", "output format of -p: jsonl, text")
+	fs.StringVar(&o.output, "o", "-", "output file of -p, - for stdout")
+	fs.StringVar(&o.bpf, "f", "", "extra bpf filter of -p")
+	fs.DurationVar(&o.duration, "duration", 0, "stop after this long, 0 for no limit")
+	fs.Int64Var(&o.count, "count", 0, "stop after this many tcp packets on each interface, 0 for no limit")
+	o.snaplen, o.promisc = 1600, true
+	if !live {
+		// 离线模式只能按一个网卡的配置解码
+		fs.StringVar(&o.iface, "i", "", "interface of -c to decode the file with, required when -c has several")
+		return
+	}
+	fs.StringVar(&o.iface, "i", "", "interface to capture, required by -p, selects one interface of -c")
+	fs.IntVar(&o.snaplen, "snaplen", 1600, "bytes to capture of each packet")
+	fs.BoolVar(&o.promisc, "promisc", true, "put the interface into promiscuous mode")
+}
+
+// load 读取配置文件 或者根据 -p 生成只有一个网卡的配置
+func (o *options) load(fs *flag.FlagSet, iface string) (map[string]IfaceCfg, error) {
+	if o.config == "" {
+		if len(o.protos) == 0 {
+			return nil, errors.New("either -c or -p is required")
+		}
+		cfg := IfaceCfg{Bpf: o.bpf, Sink: &SinkConfig{Format: o.format, Path: o.output}}
+		for _, p := range o.protos {
+			protocol, ports, _ := strings.Cut(p, ":")
+			cfg.Trackers = append(cfg.Trackers, TrackerConfig{Protocol: protocol, Ports: ports})
+		}
+		config := map[string]IfaceCfg{iface: cfg}
+		if err := validateConfig(config); err != nil {
+			return nil, err
+		}
+		return config, nil
+	}
+
+	var err error
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "p", "format", "o", "f":
+			err = fmt.Errorf("-%s can't be used with -c", f.Name)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	config, err := loadConfig(o.config)
+	if err != nil || o.iface == "" {
+		return config, err
+	}
+	cfg, ok := config[o.iface]
+	if !ok {
+		return nil, fmt.Errorf("interface %s is not in %s", o.iface, o.config)
+	}
+	return map[string]IfaceCfg{o.iface: cfg}, nil
+}
+
+// runCapture l7dump capture -i eth0 -p mysql:3306
+func runCapture(cmd *command, args []string) error {
+	o := &options{}
+	fs := flag.NewFlagSet(cmd.name, flag.ExitOnError)
+	o.register(fs, true)
+	cmd.parse(fs, args, 0)
+	if o.config == "" && o.iface == "" {
+		return errors.New("-i is required by -p")
+	}
+	config, err := o.load(fs, o.iface)
+	if err != nil {
+		return err
+	}
+	return run(config, "", o)
+}
+
+// runRead l7dump read -p http capture.pcap
+func runRead(cmd *command, args []string) error {
+	o := &options{}
+	fs := flag.NewFlagSet(cmd.name, flag.ExitOnError)
+	o.register(fs, false)
+	file := cmd.parse(fs, args, 1)[0]
+	iface := o.iface
+	if iface == "" {
+		iface = filepath.Base(file)
+	}
+	config, err := o.load(fs, iface)
+	if err != nil {
+		return err
+	}
+	return run(config, file, o)
+}
+
+func listIfaces(cmd *command, args []string) error {
+	cmd.parse(flag.NewFlagSet(cmd.name, flag.ExitOnError), args, 0)
+	devs, err := pcap.FindAllDevs()
+	if err != nil {
+		return err
+	}
+	for _, dev := range devs {
+		addrs := make([]string, len(dev.Addresses))
+		for i, addr := range dev.Addresses {
+			ones, _ := net.IPMask(addr.Netmask).Size()
+			addrs[i] = fmt.Sprintf("%s/%d", addr.IP, ones)
+		}
+		fmt.Printf("%s\t%s\t%s\n", dev.Name, strings.Join(addrs, ","), dev.Description)
+	}
+	return nil
+}
+
+func listProtocols(cmd *command, args []string) error {
+	cmd.parse(flag.NewFlagSet(cmd.name, flag.ExitOnError), args, 0)
+	for _, protocol := range protocols {
+		fmt.Println(protocol)
+	}
+	return nil
+}
+
+func validate(cmd *command, args []string) error {
+	path := cmd.parse(flag.NewFlagSet(cmd.name, flag.ExitOnError), args, 1)[0]
+	config, err := loadConfig(path)
+	if err != nil {
+		return err
+	}
+	for _, iface := range ifaces(config) {
+		fmt.Printf("%s: %d trackers\n", iface, len(config[iface].Trackers))
+	}
+	return nil
+}
+
+// legacy 之前的用法 l7dump config.json [capture.pcap]
+func legacy(args []string) error {
+	if len(args) > 2 || strings.HasPrefix(args[0], "-") {
+		usage()
+		os.Exit(2)
+	}
+	config, err := loadConfig(args[0])
+	if err != nil {
+		return err
+	}
+	o := &options{snaplen: 1600, promisc: true}
+	if len(args) == 2 {
+		return run(config, args[1], o)
+	}
+	return run(config, "", o)
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Salpadding/l7dump/core"
+	"github.com/Salpadding/l7dump/http"
+	"github.com/Salpadding/l7dump/kafka"
+	"github.com/Salpadding/l7dump/mongo"
+	"github.com/Salpadding/l7dump/mysql"
+	"github.com/Salpadding/l7dump/postgres"
+	"github.com/Salpadding/l7dump/redis"
+	"github.com/Salpadding/l7dump/session"
+	"github.com/Salpadding/l7dump/tls"
+)
+
+type IfaceCfg struct {
+	Bpf       string          `json:"bpf"`  // 额外的过滤条件 抓包的 bpf 表达式根据 trackers 生成
+	Sink      *SinkConfig     `json:"sink"` // 网卡下所有 tracker 默认的输出
+	Trackers  []TrackerConfig `json:"trackers"`
+	Lifecycle *SinkConfig     `json:"lifecycle"` // 不为空时输出 tcp 建连 拒绝 关闭的 Event
+	Limits    *LimitsConfig   `json:"limits"`
+}
+
+func (c *IfaceCfg) validate() error {
+	if err := c.Sink.validate(); err != nil {
+		return err
+	}
+	if err := c.Lifecycle.validate(); err != nil {
+		return fmt.Errorf("lifecycle: %w", err)
+	}
+	if c.Limits != nil {
+		if _, err := c.Limits.limits(); err != nil {
+			return err
+		}
+	}
+	if len(c.Trackers) == 0 {
+		return errors.New("no trackers")
+	}
+	for i := range c.Trackers {
+		if err := c.Trackers[i].validate(); err != nil {
+			return fmt.Errorf("trackers[%d] (%s): %w", i, c.Trackers[i].Protocol, err)
+		}
+	}
+	return nil
+}
+
+// loadConfig 读取配置文件 检查每个网卡的配置
+func loadConfig(path string) (map[string]IfaceCfg, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var config map[string]IfaceCfg
+	if err = json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	if err = validateConfig(config); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return config, nil
+}
+
+func validateConfig(config map[string]IfaceCfg) error {
+	if len(config) == 0 {
+		return errors.New("no interfaces")
+	}
+	for _, iface := range ifaces(config) {
+		cfg := config[iface]
+		if err := cfg.validate(); err != nil {
+			return fmt.Errorf("%s: %w", iface, err)
+		}
+	}
+	return nil
+}
+
+// ifaces 按名字排序 输出的顺序固定
+func ifaces(config map[string]IfaceCfg) []string {
+	names := make([]string, 0, len(config))
+	for iface := range config {
+		names = append(names, iface)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// LimitsConfig 内存限制 见 session.Limits
+type LimitsConfig struct {
+	MaxConns        int    `json:"max_conns"`
+	MaxPagesPerConn int    `json:"max_pages_per_conn"`
+	MaxPages        int    `json:"max_pages"`
+	IdleTimeout     string `json:"idle_timeout"` // 例如 30s, 为空时是两分钟
+}
+
+func (c *LimitsConfig) limits() (session.Limits, error) {
+	limits := session.Limits{
+		MaxConns:        c.MaxConns,
+		MaxPagesPerConn: c.MaxPagesPerConn,
+		MaxPages:        c.MaxPages,
+	}
+	if c.MaxConns < 0 || c.MaxPagesPerConn < 0 || c.MaxPages < 0 {
+		return limits, errors.New("limits must not be negative")
+	}
+	if c.IdleTimeout == "" {
+		return limits, nil
+	}
+	timeout, err := time.ParseDuration(c.IdleTimeout)
+	if err != nil {
+		return limits, fmt.Errorf("invalid idle_timeout %q: %v", c.IdleTimeout, err)
+	}
+	limits.IdleTimeout = timeout
+	return limits, nil
+}
+
+type TrackerConfig struct {
+	Port     int          `json:"port"`     // port 和 ports 都为空时根据数据识别协议 会抓取所有的 tcp 流量
+	Ports    string       `json:"ports"`    // 端口范围 例如 3306-3310,3320
+	Hosts    []string     `json:"hosts"`    // 服务端的 ip 或者网段 例如 10.0.3.0/24, 为空时不限制
+	Clients  []string     `json:"clients"`  // 客户端的 ip 或者网段 为空时不限制
+	Bpf      string       `json:"bpf"`      // 这个 tracker 额外的过滤条件
+	Protocol string       `json:"protocol"` // 协议 mysql, http, redis, postgres, kafka, mongodb, tls
+	Program  string       `json:"program"`  // lua 脚本的路径
+	Sink     *SinkConfig  `json:"sink"`     // 覆盖网卡的输出配置
+	Filter   *http.Filter `json:"filter"`   // 只记录满足条件的 http 请求
+}
+
+// newTracker 创建协议对应的 tracker, 调用之前需要 validate
+func (c *TrackerConfig) newTracker(sink core.Sink) core.ProtocolTracker {
+	switch c.Protocol {
+	case "mysql":
+		return &mysql.Tracker{Sink: sink}
+	case "http":
+		h := &http.Tracker{Sink: sink}
+		if c.Filter != nil {
+			h.PreReq = c.Filter.MatchRequest
+			h.PostReq = c.Filter.MatchResponse
+		}
+		return h
+	case "redis":
+		return &redis.Tracker{Sink: sink}
+	case "postgres":
+		return &postgres.Tracker{Sink: sink}
+	case "kafka":
+		return &kafka.Tracker{Sink: sink}
+	case "mongodb":
+		return &mongo.Tracker{Sink: sink}
+	case "tls":
+		return &tls.Tracker{Sink: sink}
+	}
+	return nil
+}
+
+// protocols 支持的协议 和 newTracker 一致
+var protocols = []string{"http", "kafka", "mongodb", "mysql", "postgres", "redis", "tls"}
+
+// validate 检查配置 不会打开文件
+func (c *TrackerConfig) validate() error {
+	tracker := c.newTracker(nil)
+	if tracker == nil {
+		return fmt.Errorf("unknown protocol %q, supported protocols are %s", c.Protocol, strings.Join(protocols, ", "))
+	}
+	if c.Filter != nil {
+		if c.Protocol != "http" {
+			return fmt.Errorf("filter is not supported by protocol %s", c.Protocol)
+		}
+		if err := c.Filter.Compile(); err != nil {
+			return fmt.Errorf("invalid filter: %w", err)
+		}
+	}
+	if err := c.Sink.validate(); err != nil {
+		return err
+	}
+	if c.probe() {
+		if len(c.Hosts) > 0 || len(c.Clients) > 0 || c.Bpf != "" {
+			return errors.New("hosts, clients and bpf require port or ports")
+		}
+		if _, ok := tracker.(core.Prober); !ok {
+			return fmt.Errorf("protocol %s can't be detected from data, port or ports is required", c.Protocol)
+		}
+		return nil
+	}
+	if c.Port < 0 || c.Port > 65535 {
+		return fmt.Errorf("invalid port %d", c.Port)
+	}
+	_, err := c.match()
+	return err
+}
+
+// probe 没有配置端口时根据数据识别协议
+func (c *TrackerConfig) probe() bool {
+	return c.Port == 0 && c.Ports == ""
+}
+
+func (c *TrackerConfig) match() (m session.Match, err error) {
+	m.BPF = c.Bpf
+	if c.Port != 0 {
+		m.Ports = append(m.Ports, session.PortRange{From: c.Port, To: c.Port})
+	}
+	ports, err := parsePorts(c.Ports)
+	if err != nil {
+		return m, err
+	}
+	m.Ports = append(m.Ports, ports...)
+	if m.Hosts, err = parseNets(c.Hosts); err != nil {
+		return m, err
+	}
+	m.Clients, err = parseNets(c.Clients)
+	return m, err
+}
+
+// parsePorts 逗号分隔的端口或者端口范围
+func parsePorts(s string) (ports []session.PortRange, err error) {
+	if s == "" {
+		return nil, nil
+	}
+	for _, part := range strings.Split(s, ",") {
+		from, to, found := strings.Cut(strings.TrimSpace(part), "-")
+		r := session.PortRange{}
+		if r.From, err = strconv.Atoi(from); err == nil {
+			r.To = r.From
+			if found {
+				r.To, err = strconv.Atoi(to)
+			}
+		}
+		if err != nil || r.From <= 0 || r.To > 65535 || r.From > r.To {
+			return nil, fmt.Errorf("invalid port range %q", part)
+		}
+		ports = append(ports, r)
+	}
+	return ports, nil
+}
+
+// parseNets ip 或者网段 ip 作为只有一个地址的网段
+func parseNets(list []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, s := range list {
+		if strings.Contains(s, "/") {
+			_, n, err := net.ParseCIDR(s)
+			if err != nil {
+				return nil, fmt.Errorf("invalid network %q", s)
+			}
+			nets = append(nets, n)
+			continue
+		}
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid ip %q", s)
+		}
+		bits := 8 * net.IPv6len
+		if v4 := ip.To4(); v4 != nil {
+			ip, bits = v4, 8*net.IPv4len
+		}
+		nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+	}
+	return nets, nil
+}
+
+// SinkConfig 输出配置 默认以 json lines 格式输出到标准输出
+type SinkConfig struct {
+	Format string `json:"format"` // jsonl, text
+	Path   string `json:"path"`   // 为空或者 - 表示标准输出
+}
+
+// validate 为空时使用默认配置
+func (c *SinkConfig) validate() error {
+	if c == nil {
+		return nil
+	}
+	switch c.Format {
+	case "", "jsonl", "text":
+		return nil
+	}
+	return fmt.Errorf("unknown sink format %q, supported formats are jsonl, text", c.Format)
+}
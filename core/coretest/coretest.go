@@ -0,0 +1,124 @@
+// Package coretest 测试 tracker 用的内存 sink 和连接回放
+package coretest
+
+import (
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/Salpadding/l7dump/core"
+	"github.com/google/gopacket/tcpassembly"
+)
+
+// Sink 把 Event 保存在内存里
+type Sink struct {
+	mtx    sync.Mutex
+	events []*core.Event
+}
+
+func (s *Sink) Write(ev *core.Event) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.events = append(s.events, ev)
+	return nil
+}
+
+func (s *Sink) Close() error {
+	return nil
+}
+
+// Events 返回已经输出的 Event
+func (s *Sink) Events() []*core.Event {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.events
+}
+
+// Meta 10.0.0.1:50000 连接到 10.0.0.2 的 port
+func Meta(port int) *core.ConnMeta {
+	return &core.ConnMeta{
+		ClientIP:   net.IP{10, 0, 0, 1},
+		ServerIP:   net.IP{10, 0, 0, 2},
+		ClientPort: 50000,
+		ServerPort: port,
+	}
+}
+
+// Conn 回放一个连接两个方向的数据 和 session 一样调用 tracker 的解码器和回调
+// 解码器读完一段数据之后 Send 才返回 所以两个方向的解码顺序是确定的
+type Conn struct {
+	Req, Resp *core.Stream
+
+	wg   sync.WaitGroup
+	mtx  sync.Mutex
+	errs []error
+	ts   time.Time
+	skip [2]int
+}
+
+// Start 创建连接并开始解码 数据包的时间从 1700000000 开始 每段数据加 1ms
+func Start(tracker core.ProtocolTracker, meta *core.ConnMeta) *Conn {
+	c := &Conn{
+		Req:  core.NewStream(),
+		Resp: core.NewStream(),
+		ts:   time.Unix(1700000000, 0),
+	}
+	conn := tracker.NewConnect(meta)
+	c.wg.Add(2)
+	go c.run(tracker.RequestDecoder(c.Req, conn), conn.OnRequest)
+	go c.run(tracker.ResponseDecoder(c.Resp, conn), conn.OnResponse)
+	return c
+}
+
+func (c *Conn) run(decoder func() (interface{}, error), handler func(interface{}) error) {
+	defer c.wg.Done()
+	for {
+		val, err := decoder()
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			c.mtx.Lock()
+			c.errs = append(c.errs, err)
+			c.mtx.Unlock()
+			continue
+		}
+		handler(val)
+	}
+}
+
+func side(fromClient bool) int {
+	if fromClient {
+		return 0
+	}
+	return 1
+}
+
+// Skip 这个方向的下一段数据之前丢了 n 个字节 -1 表示不知道丢了多少
+func (c *Conn) Skip(fromClient bool, n int) {
+	c.skip[side(fromClient)] = n
+}
+
+// Send 交给一个方向的流 data 为 nil 时相当于 Skip(fromClient, -1)
+func (c *Conn) Send(fromClient bool, data []byte) {
+	if data == nil {
+		c.Skip(fromClient, -1)
+		return
+	}
+	stream := c.Resp
+	if fromClient {
+		stream = c.Req
+	}
+	c.ts = c.ts.Add(time.Millisecond)
+	stream.Reassembled([]tcpassembly.Reassembly{{Bytes: data, Seen: c.ts, Skip: c.skip[side(fromClient)]}})
+	c.skip[side(fromClient)] = 0
+}
+
+// Close 关闭两个方向的流 等解码器退出 返回解码器遇到的 EOF 之外的错误
+func (c *Conn) Close() []error {
+	c.Req.ReassemblyComplete()
+	c.Resp.ReassemblyComplete()
+	c.wg.Wait()
+	return c.errs
+}
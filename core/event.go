@@ -0,0 +1,70 @@
+package core
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Event 一次完整的请求/响应交互
+// 由 ProtocolConnTracker 在收到响应后产生
+type Event struct {
+	Meta     *ConnMeta `json:"conn"`
+	Protocol string    `json:"protocol"`
+	// Op 请求的简要描述 例如 http 的 "GET /index" mysql 的 "COM_QUERY"
+	Op string `json:"op"`
+
+	ReqTime  time.Time     `json:"req_time"`
+	RespTime time.Time     `json:"resp_time"`
+	Latency  time.Duration `json:"latency"`
+	// TTFB 请求发送完到收到响应第一个字节的时间 不是所有协议都会记录
+	TTFB     time.Duration `json:"ttfb,omitempty"`
+	ReqSize  int           `json:"req_size"`
+	RespSize int           `json:"resp_size"`
+
+	// Status 响应状态 例如 http 的 "200 OK" mysql 的 "OK" "ERR"
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+	// Incomplete 请求或者响应有数据丢失 解码的结果可能不完整
+	Incomplete bool `json:"incomplete,omitempty"`
+
+	// Request Response 协议相关的解码结果
+	Request  interface{} `json:"request,omitempty"`
+	Response interface{} `json:"response,omitempty"`
+	// Extra 脚本附加的字段
+	Extra map[string]interface{} `json:"extra,omitempty"`
+}
+
+func NewEvent(meta *ConnMeta, protocol string) *Event {
+	return &Event{
+		Meta:     meta,
+		Protocol: protocol,
+	}
+}
+
+// Done 记录响应时间并计算延迟
+func (e *Event) Done(respTime time.Time) {
+	e.RespTime = respTime
+	if !e.ReqTime.IsZero() && !respTime.IsZero() {
+		e.Latency = respTime.Sub(e.ReqTime)
+	}
+}
+
+func (e *Event) String() string {
+	var sb strings.Builder
+	if e.Meta != nil {
+		sb.WriteString(e.Meta.String())
+		if e.Meta.RoleGuessed {
+			sb.WriteString(" (role guessed)")
+		}
+		sb.WriteByte(' ')
+	}
+	fmt.Fprintf(&sb, "%s %s %s %v", e.Protocol, e.Op, e.Status, e.Latency)
+	if e.Error != "" {
+		fmt.Fprintf(&sb, " error=%q", e.Error)
+	}
+	if e.Incomplete {
+		sb.WriteString(" (incomplete)")
+	}
+	return sb.String()
+}
@@ -0,0 +1,32 @@
+package core
+
+import "time"
+
+// ConnEvent tcp 连接生命周期中的一个事件
+type ConnEvent struct {
+	Meta *ConnMeta
+	// Time 触发事件的数据包的抓包时间 超时的时候是最后一个数据包的时间
+	Time time.Time
+	// FromClient FIN 或者 RST 是客户端发送的
+	FromClient bool
+	// Established 是否完成了握手 RST 时为 false 表示连接被拒绝
+	Established bool
+	// Syn 客户端发送 SYN 的时间 只看到 SYN-ACK 时为零值
+	Syn time.Time
+	// RTT 从 SYN 到客户端回复 ACK 的时间 没有看到 SYN 时为 0
+	RTT time.Duration
+	// First 这一方先发送 FIN, 只对 OnFin 有意义
+	First bool
+}
+
+// ConnLifecycle 关心 tcp 连接生命周期的 tracker 可以实现这个接口
+// 对应 README 中的 半连接 已连接 断开
+// 在抓包的协程中调用 不能阻塞
+type ConnLifecycle interface {
+	OnSyn(*ConnEvent)
+	OnEstablished(*ConnEvent)
+	OnFin(*ConnEvent)
+	OnReset(*ConnEvent)
+	// OnTimeout 超时之前没有完成握手 例如服务端没有响应 SYN
+	OnTimeout(*ConnEvent)
+}
@@ -0,0 +1,91 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+var (
+	_ Sink = (*JSONLinesSink)(nil)
+	_ Sink = (*TextSink)(nil)
+)
+
+// Sink 接收 tracker 解码出的 Event
+// Write 会被多个连接的协程同时调用 实现需要保证并发安全
+type Sink interface {
+	Write(*Event) error
+	Close() error
+}
+
+// DefaultSink 没有给 tracker 配置 sink 时使用 输出到标准输出
+var DefaultSink Sink = NewJSONLinesSink(os.Stdout)
+
+// Emit 把 Event 交给 sink, sink 为 nil 时使用 DefaultSink
+func Emit(sink Sink, ev *Event) {
+	if sink == nil {
+		sink = DefaultSink
+	}
+	if err := sink.Write(ev); err != nil {
+		fmt.Fprintf(os.Stderr, "write event failed %v\n", err)
+	}
+}
+
+// JSONLinesSink 每个 Event 输出为一行 json
+// 方便用 jq 或者日志采集工具处理
+type JSONLinesSink struct {
+	mtx sync.Mutex
+	w   io.Writer
+	enc *json.Encoder
+}
+
+func NewJSONLinesSink(w io.Writer) *JSONLinesSink {
+	return &JSONLinesSink{
+		w:   w,
+		enc: json.NewEncoder(w),
+	}
+}
+
+func (s *JSONLinesSink) Write(ev *Event) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.enc.Encode(ev)
+}
+
+// Close 关闭底层的文件 标准输出不会被关闭
+func (s *JSONLinesSink) Close() error {
+	return closeWriter(s.w)
+}
+
+// TextSink 每个 Event 输出为一行便于阅读的文本
+type TextSink struct {
+	mtx sync.Mutex
+	w   io.Writer
+}
+
+func NewTextSink(w io.Writer) *TextSink {
+	return &TextSink{w: w}
+}
+
+func (s *TextSink) Write(ev *Event) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	_, err := fmt.Fprintln(s.w, ev.String())
+	return err
+}
+
+func (s *TextSink) Close() error {
+	return closeWriter(s.w)
+}
+
+func closeWriter(w io.Writer) error {
+	if w == os.Stdout || w == os.Stderr {
+		return nil
+	}
+	if c, ok := w.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
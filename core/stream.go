@@ -0,0 +1,142 @@
+package core
+
+import (
+	"bufio"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket/tcpassembly"
+	"github.com/google/gopacket/tcpassembly/tcpreader"
+)
+
+// ErrDataLost 丢包或者抓包开始时连接已经建立 读到这个错误之后的数据不是连续的
+// 每个空洞只返回一次 之后可以继续读取 解码器需要用 Resync 找到下一个消息的开头
+var ErrDataLost = tcpreader.DataLost
+
+// Stream 在 tcpreader.ReaderStream 的基础上
+// 记录数据包被抓到的时间 以及已经读取的字节数
+type Stream struct {
+	tcpreader.ReaderStream
+
+	mtx    sync.Mutex
+	seen   time.Time
+	reason CloseReason
+	lost   int
+	count  int
+	gaps   int
+}
+
+func NewStream() *Stream {
+	s := &Stream{
+		ReaderStream: tcpreader.NewReaderStream(),
+	}
+	s.LossErrors = true
+	return s
+}
+
+// Reassembled 实现 tcpassembly.Stream
+// ReaderStream 在上一批数据读完之前不会返回 所以这里记录的时间就是正在读取的数据的时间
+func (s *Stream) Reassembled(reassembly []tcpassembly.Reassembly) {
+	if len(reassembly) > 0 {
+		s.mtx.Lock()
+		s.seen = reassembly[len(reassembly)-1].Seen
+		for _, r := range reassembly {
+			// 为 -1 时不知道丢了多少
+			if r.Skip > 0 {
+				s.lost += r.Skip
+			}
+		}
+		s.mtx.Unlock()
+	}
+	s.ReaderStream.Reassembled(reassembly)
+}
+
+// ReassemblyComplete tcpassembly 在收到 FIN 或者 RST 时调用
+func (s *Stream) ReassemblyComplete() {
+	s.Close(CloseFin)
+}
+
+// Close 结束流 读到 EOF 之后可以通过 Reason 获取原因
+func (s *Stream) Close(reason CloseReason) {
+	s.mtx.Lock()
+	s.reason = reason
+	s.mtx.Unlock()
+	s.ReaderStream.ReassemblyComplete()
+}
+
+// Reason 流结束的原因
+func (s *Stream) Reason() CloseReason {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.reason
+}
+
+func (s *Stream) Read(p []byte) (n int, err error) {
+	n, err = s.ReaderStream.Read(p)
+	s.count += n
+	if err == ErrDataLost {
+		s.gaps++
+	}
+	return
+}
+
+// Lost 丢失的字节数 不包括长度未知的空洞
+func (s *Stream) Lost() int {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.lost
+}
+
+// Gaps 已经读到的空洞的个数 只能在读取的协程里调用
+func (s *Stream) Gaps() int {
+	return s.gaps
+}
+
+// Seen 最近一次读到的数据的抓包时间
+func (s *Stream) Seen() time.Time {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.seen
+}
+
+// Count 已经从流里读出的字节数 只能在读取的协程里调用
+// 使用 bufio 时需要减去 Buffered() 才是真正被解码的字节数
+func (s *Stream) Count() int {
+	return s.count
+}
+
+// Resync 丢弃数据 直到 match 认为是一个消息的开头
+// match 的参数是从候选位置开始已经缓存的数据 返回 ProbeMore 时等待更多的数据
+// 候选位置之后的数据填满了缓冲区还不能确定时 认为不匹配
+func Resync(r *bufio.Reader, match func([]byte) ProbeResult) (skipped int, err error) {
+	need := 1
+	for {
+		if _, err = r.Peek(need); err != nil {
+			// 又遇到了一个空洞 之前缓存的数据还在
+			if err == ErrDataLost {
+				need = 1
+				continue
+			}
+			n, _ := r.Discard(r.Buffered())
+			return skipped + n, err
+		}
+		buf, _ := r.Peek(r.Buffered())
+		i := 0
+	scan:
+		for ; i < len(buf); i++ {
+			switch match(buf[i:]) {
+			case ProbeMatch:
+				r.Discard(i)
+				return skipped + i, nil
+			case ProbeMore:
+				break scan
+			}
+		}
+		if i == 0 && len(buf) == r.Size() {
+			i = 1
+		}
+		r.Discard(i)
+		skipped += i
+		need = r.Buffered() + 1
+	}
+}
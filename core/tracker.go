@@ -3,15 +3,15 @@ package core
 import (
 	"fmt"
 	"net"
-
-	"github.com/google/gopacket/tcpassembly/tcpreader"
 )
 
 type ConnMeta struct {
-	ClientIP   net.IP
-	ServerIP   net.IP
-	ClientPort int
-	ServerPort int
+	ClientIP   net.IP `json:"client_ip"`
+	ServerIP   net.IP `json:"server_ip"`
+	ClientPort int    `json:"client_port"`
+	ServerPort int    `json:"server_port"`
+	// RoleGuessed 没有看到握手 客户端和服务端是根据端口猜的
+	RoleGuessed bool `json:"role_guessed,omitempty"`
 }
 
 type ProtocolConnTracker interface {
@@ -24,14 +24,63 @@ type ProtocolConnTracker interface {
 // 通常在服务端运行 以便于追踪所有客户端请求
 // 主要作用是管理连接池 解码
 type ProtocolTracker interface {
-	RequestDecoder(stream *tcpreader.ReaderStream, conn ProtocolConnTracker) func() (interface{}, error)
-	ResponseDecoder(stream *tcpreader.ReaderStream, conn ProtocolConnTracker) func() (interface{}, error)
+	RequestDecoder(stream *Stream, conn ProtocolConnTracker) func() (interface{}, error)
+	ResponseDecoder(stream *Stream, conn ProtocolConnTracker) func() (interface{}, error)
 
 	NewConnect(*ConnMeta) ProtocolConnTracker
 
-	OnClose(ProtocolConnTracker)
+	// OnClose 每个方向的流结束时调用一次
+	OnClose(ProtocolConnTracker, CloseReason)
 }
 
+// CloseReason 流结束的原因
+type CloseReason string
+
+const (
+	// CloseFin 收到了 FIN 或者 RST
+	CloseFin CloseReason = "fin"
+	// CloseIdle 超过 IdleTimeout 没有数据
+	CloseIdle CloseReason = "idle"
+	// CloseConnLimit 连接数达到上限 淘汰最久没有数据的连接
+	CloseConnLimit CloseReason = "conn_limit"
+	// CloseEnd 抓包结束
+	CloseEnd CloseReason = "end"
+)
+
 func (c *ConnMeta) String() string {
 	return fmt.Sprintf("%s:%d %s:%d", c.ClientIP, c.ClientPort, c.ServerIP, c.ServerPort)
 }
+
+// ProbeResult 协议识别的结果
+type ProbeResult int
+
+const (
+	// ProbeMore 数据不够 需要等待更多的数据
+	ProbeMore ProbeResult = iota
+	ProbeMatch
+	ProbeMismatch
+)
+
+// Prober 可以根据连接开头的数据识别协议的 tracker
+// req resp 是两个方向目前收到的数据 其中一个可能为空
+type Prober interface {
+	Probe(req, resp []byte) ProbeResult
+}
+
+// ProbePrefix data 以任意一个前缀开头时匹配
+// data 还不够长 可能是某个前缀的开头时需要更多的数据
+func ProbePrefix(data []byte, prefixes ...string) ProbeResult {
+	result := ProbeMismatch
+	for _, prefix := range prefixes {
+		if len(data) >= len(prefix) {
+			if string(data[:len(prefix)]) == prefix {
+				return ProbeMatch
+			}
+			continue
+		}
+		if string(data) == prefix[:len(data)] {
+			result = ProbeMore
+		}
+	}
+	return result
+}
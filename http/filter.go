@@ -0,0 +1,131 @@
+package http
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Filter 决定哪些请求会被记录 在 config.json 中配置
+// 所有条件都满足才会记录 没有配置的条件不做限制
+type Filter struct {
+	// Methods 请求方法 不区分大小写
+	Methods []string `json:"methods"`
+	// Hosts 请求的 Host 不包括端口, *.example.com 匹配所有子域名
+	Hosts []string `json:"hosts"`
+	// PathPrefix 路径前缀
+	PathPrefix string `json:"path_prefix"`
+	// PathRegex 匹配路径的正则表达式
+	PathRegex string `json:"path_regex"`
+	// Headers 请求头需要包含的值 值为空时只要求请求头存在
+	Headers map[string]string `json:"headers"`
+	// Status 响应状态码 例如 404, 5xx
+	Status []string `json:"status"`
+
+	pathRegex *regexp.Regexp
+}
+
+// Compile 检查配置 使用之前必须调用
+func (f *Filter) Compile() (err error) {
+	if f.PathRegex != "" {
+		if f.pathRegex, err = regexp.Compile(f.PathRegex); err != nil {
+			return fmt.Errorf("invalid path_regex %q: %v", f.PathRegex, err)
+		}
+	}
+	for _, status := range f.Status {
+		if !validStatus(status) {
+			return fmt.Errorf("invalid status %q", status)
+		}
+	}
+	return nil
+}
+
+// validStatus 三位数的状态码 或者 1xx 到 5xx
+func validStatus(status string) bool {
+	if len(status) != 3 || status[0] < '1' || status[0] > '5' {
+		return false
+	}
+	if strings.EqualFold(status[1:], "xx") {
+		return true
+	}
+	_, err := strconv.Atoi(status)
+	return err == nil
+}
+
+// MatchRequest 可以作为 Tracker.PreReq
+func (f *Filter) MatchRequest(r *http.Request) bool {
+	if len(f.Methods) > 0 && !f.matchMethod(r.Method) {
+		return false
+	}
+	if len(f.Hosts) > 0 && !f.matchHost(r.Host) {
+		return false
+	}
+	if !strings.HasPrefix(r.URL.Path, f.PathPrefix) {
+		return false
+	}
+	if f.pathRegex != nil && !f.pathRegex.MatchString(r.URL.Path) {
+		return false
+	}
+	for name, value := range f.Headers {
+		values := r.Header.Values(name)
+		if len(values) == 0 {
+			return false
+		}
+		if value != "" && !contains(values, value) {
+			return false
+		}
+	}
+	return true
+}
+
+// MatchResponse 可以作为 Tracker.PostReq
+func (f *Filter) MatchResponse(req *http.Request, resp *http.Response) bool {
+	if len(f.Status) == 0 {
+		return true
+	}
+	code := strconv.Itoa(resp.StatusCode)
+	for _, status := range f.Status {
+		if status == code || (status[0] == code[0] && strings.EqualFold(status[1:], "xx")) {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *Filter) matchMethod(method string) bool {
+	for _, m := range f.Methods {
+		if strings.EqualFold(m, method) {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *Filter) matchHost(host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	// 域名不区分大小写
+	host = strings.ToLower(host)
+	for _, h := range f.Hosts {
+		if strings.HasPrefix(h, "*.") && strings.HasSuffix(host, strings.ToLower(h[1:])) {
+			return true
+		}
+		if strings.EqualFold(h, host) {
+			return true
+		}
+	}
+	return false
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
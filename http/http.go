@@ -2,10 +2,13 @@ package http
 
 import (
 	"bufio"
+	"io"
+	"log"
 	"net/http"
+	"sync"
+	"time"
 
 	"github.com/Salpadding/l7dump/core"
-	"github.com/google/gopacket/tcpassembly/tcpreader"
 )
 
 var (
@@ -15,10 +18,12 @@ var (
 
 type Tracker struct {
 
-	// PreReq 决定这个http请求是否会被追踪
+	// PreReq 决定这个http请求是否会被追踪 为空时追踪所有请求
 	PreReq func(*http.Request) bool
-	// 被追踪的请求会被调用 PostReq
-	PostReq func(req *http.Request, resp *http.Response)
+	// 被追踪的请求收到响应后会被调用 PostReq, 返回 false 时不记录
+	PostReq func(req *http.Request, resp *http.Response) bool
+	// Sink 接收被追踪的请求产生的 Event, 为空时输出到标准输出
+	Sink core.Sink
 }
 
 func (h *Tracker) NewConnect(meta *core.ConnMeta) core.ProtocolConnTracker {
@@ -28,38 +33,242 @@ func (h *Tracker) NewConnect(meta *core.ConnMeta) core.ProtocolConnTracker {
 	}
 }
 
-func (h *Tracker) OnClose(conn core.ProtocolConnTracker) {
+func (h *Tracker) OnClose(conn core.ProtocolConnTracker, reason core.CloseReason) {
 }
 
-func (h *Tracker) RequestDecoder(stream *tcpreader.ReaderStream, conn core.ProtocolConnTracker) func() (interface{}, error) {
+var methods = []string{"GET ", "POST ", "PUT ", "DELETE ", "HEAD ", "OPTIONS ", "PATCH ", "CONNECT ", "TRACE "}
+
+// Probe 请求以方法开头 或者响应以 HTTP/1. 开头
+func (h *Tracker) Probe(req, resp []byte) core.ProbeResult {
+	if len(req) > 0 {
+		return matchRequest(req)
+	}
+	return matchResponse(resp)
+}
+
+func matchRequest(data []byte) core.ProbeResult {
+	return core.ProbePrefix(data, methods...)
+}
+
+func matchResponse(data []byte) core.ProbeResult {
+	return core.ProbePrefix(data, "HTTP/1.")
+}
+
+// drain 读完 body, 丢包时返回 core.ErrDataLost
+// 出错时不能 Close, 否则会按照原来的长度继续读取空洞之后的数据
+func drain(body io.ReadCloser) error {
+	if _, err := io.Copy(io.Discard, body); err != nil {
+		return err
+	}
+	return body.Close()
+}
+
+func (h *Tracker) RequestDecoder(stream *core.Stream, conn core.ProtocolConnTracker) func() (interface{}, error) {
 	buf := bufio.NewReader(stream)
+	c := conn.(*ConnTracker)
+	c.reqStream = stream
 	return func() (interface{}, error) {
+		// 丢包之后从下一个请求行开始解码
+		if c.reqGap {
+			skipped, err := core.Resync(buf, matchRequest)
+			if err != nil {
+				return nil, err
+			}
+			c.reqGap = false
+			log.Printf("http %s: request resynced, skipped %d bytes", c.ConnMeta, skipped)
+		}
+		// 等到请求的第一个字节 记录抓包时间
+		if _, err := buf.Peek(1); err != nil {
+			if err == core.ErrDataLost {
+				c.reqGap = true
+				return nil, nil
+			}
+			return nil, err
+		}
+		reqTime := stream.Seen()
+		start := stream.Count() - buf.Buffered()
+		// textproto 会把空洞之前的半行当成完整的一行 只能通过空洞的个数判断
+		gaps := stream.Gaps()
 		req, err := http.ReadRequest(buf)
-		(conn.(*ConnTracker)).LastReq = req
+		if err != nil {
+			if err == io.EOF {
+				return nil, err
+			}
+			c.reqGap = true
+			// 请求已经发出 响应还会到达 用一个不完整的请求占位
+			if stream.Gaps() > gaps {
+				c.push(&exchange{
+					record:     h.PreReq == nil,
+					reqTime:    reqTime,
+					incomplete: true,
+				})
+				return nil, nil
+			}
+			return nil, err
+		}
+		x := &exchange{
+			req:     req,
+			record:  h.PreReq == nil || h.PreReq(req),
+			reqTime: reqTime,
+			reqHdr:  stream.Count() - buf.Buffered() - start,
+			reqBody: &countReader{ReadCloser: req.Body},
+		}
+		req.Body = x.reqBody
+		c.req = x
+		c.push(x)
 		return req, err
 	}
 }
 
-func (h *Tracker) ResponseDecoder(stream *tcpreader.ReaderStream, conn core.ProtocolConnTracker) func() (interface{}, error) {
+func (h *Tracker) ResponseDecoder(stream *core.Stream, conn core.ProtocolConnTracker) func() (interface{}, error) {
 	buf := bufio.NewReader(stream)
+	c := conn.(*ConnTracker)
+	c.respStream = stream
 	return func() (val interface{}, err error) {
-		defer func() {
+		if c.respGap {
+			skipped, err := core.Resync(buf, matchResponse)
 			if err != nil {
+				return nil, err
+			}
+			c.respGap = false
+			log.Printf("http %s: response resynced, skipped %d bytes", c.ConnMeta, skipped)
+		}
+		// 响应的数据到达时 对应的请求一定已经被解码
+		if _, err = buf.Peek(1); err != nil {
+			if err == core.ErrDataLost {
+				c.respGap = true
+				return nil, nil
 			}
-		}()
-		req := (conn.(*ConnTracker)).LastReq
-		conn.(*ConnTracker).LastResp, err = http.ReadResponse(buf, req)
-		return conn.(*ConnTracker).LastResp, err
+			return nil, err
+		}
+		firstByte := stream.Seen()
+		start := stream.Count() - buf.Buffered()
+
+		// HEAD 请求的响应没有 body, 解析响应需要对应的请求
+		x := c.front()
+		var req *http.Request
+		if x != nil {
+			req = x.req
+		}
+		gaps := stream.Gaps()
+		resp, err := http.ReadResponse(buf, req)
+		if err != nil {
+			if err == io.EOF {
+				return nil, err
+			}
+			c.respGap = true
+			// 响应的头部丢失了一部分
+			if x != nil && stream.Gaps() > gaps {
+				c.pop()
+				c.emitLost(x)
+				return nil, nil
+			}
+			return nil, err
+		}
+
+		c.resp = nil
+		if x != nil {
+			if x.firstByte.IsZero() {
+				x.firstByte = firstByte
+			}
+			// 1xx 不是最终的响应 请求还在等待
+			if resp.StatusCode < 200 && resp.StatusCode != http.StatusSwitchingProtocols {
+				return resp, nil
+			}
+			c.pop()
+			c.resp = x
+		}
+		c.respHdr = stream.Count() - buf.Buffered() - start
+		c.respBody = &countReader{ReadCloser: resp.Body}
+		resp.Body = c.respBody
+		return resp, err
 	}
 }
 
+// countReader 统计 body 的长度
+type countReader struct {
+	io.ReadCloser
+	n int
+}
+
+func (c *countReader) Read(p []byte) (n int, err error) {
+	n, err = c.ReadCloser.Read(p)
+	c.n += n
+	return
+}
+
+// exchange 一次请求和响应
+type exchange struct {
+	req    *http.Request
+	record bool
+	// reqTime 请求第一个字节的抓包时间
+	reqTime time.Time
+	reqHdr  int
+	reqBody *countReader
+	// reqEnd reqSize 请求的 body 读完之后填写 由 ConnTracker.mtx 保护
+	reqEnd  time.Time
+	reqSize int
+	// firstByte 响应第一个字节的抓包时间 包括 1xx 响应
+	firstByte time.Time
+	// incomplete 请求有数据丢失 没有看到请求行时 req 为空
+	incomplete bool
+}
+
+func (x *exchange) op() string {
+	if x.req == nil {
+		return "unknown"
+	}
+	return x.req.Method + " " + x.req.URL.String()
+}
+
 type ConnTracker struct {
 	Tracker  *Tracker
 	ConnMeta *core.ConnMeta
-	LastReq  *http.Request
-	LastResp *http.Response
 
-	Record bool
+	reqStream  *core.Stream
+	respStream *core.Stream
+
+	// inflight 已经发出还没有收到响应的请求 按发送的顺序排列
+	// 客户端可以不等响应就发送下一个请求 (pipelining)
+	mtx      sync.Mutex
+	inflight []*exchange
+
+	// req 请求的协程正在处理的请求
+	req *exchange
+	// resp 响应的协程正在处理的请求 没有看到请求时为空
+	resp *exchange
+	// 头部长度 body 长度在读完之后才能确定
+	respHdr  int
+	respBody *countReader
+
+	// reqGap respGap 丢包之后需要重新同步 分别只在请求和响应的协程中使用
+	reqGap  bool
+	respGap bool
+}
+
+func (h *ConnTracker) push(x *exchange) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	h.inflight = append(h.inflight, x)
+}
+
+// front 最早发出的还没有收到响应的请求
+func (h *ConnTracker) front() *exchange {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	if len(h.inflight) == 0 {
+		return nil
+	}
+	return h.inflight[0]
+}
+
+func (h *ConnTracker) pop() {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	if len(h.inflight) > 0 {
+		h.inflight[0] = nil
+		h.inflight = h.inflight[1:]
+	}
 }
 
 func (h *ConnTracker) OnRequest(req interface{}) error {
@@ -68,13 +277,17 @@ func (h *ConnTracker) OnRequest(req interface{}) error {
 	}
 	r := req.(*http.Request)
 
-	h.Record = h.Tracker.PreReq(r)
-	if !h.Record {
-		tcpreader.DiscardBytesToEOF(r.Body)
-		r.Body.Close()
-		return nil
+	// body 必须读完 否则下一个请求会从 body 中间开始解码
+	err := drain(r.Body)
+	if err != nil {
+		h.reqGap = true
 	}
 
+	h.mtx.Lock()
+	h.req.reqEnd = h.reqStream.Seen()
+	h.req.reqSize = h.req.reqHdr + h.req.reqBody.n
+	h.req.incomplete = err != nil
+	h.mtx.Unlock()
 	return nil
 }
 
@@ -84,14 +297,107 @@ func (h *ConnTracker) OnResponse(resp interface{}) error {
 	}
 	r := resp.(*http.Response)
 
-	if !h.Record {
-		tcpreader.DiscardBytesToEOF(r.Body)
-		r.Body.Close()
+	x := h.resp
+	if x == nil || !x.record {
+		if drain(r.Body) != nil {
+			h.respGap = true
+		}
+		return nil
+	}
+	h.resp = nil
+	// 没有看到请求行时不能过滤
+	record := h.Tracker.PostReq == nil || x.req == nil || h.Tracker.PostReq(x.req, r)
+	err := drain(r.Body)
+	if err != nil {
+		h.respGap = true
+	}
+	if !record {
 		return nil
 	}
-	h.Tracker.PostReq(h.LastReq, h.LastResp)
+
+	h.mtx.Lock()
+	sent, reqSize, incomplete := x.reqEnd, x.reqSize, x.incomplete
+	h.mtx.Unlock()
+	if reqSize == 0 {
+		reqSize = x.reqHdr
+	}
+	// 服务端在请求发送完之前就开始响应
+	if sent.IsZero() || sent.After(x.firstByte) {
+		sent = x.reqTime
+	}
+
+	ev := core.NewEvent(h.ConnMeta, "http")
+	ev.Op = x.op()
+	ev.ReqTime = x.reqTime
+	ev.Done(h.respStream.Seen())
+	ev.TTFB = x.firstByte.Sub(sent)
+	ev.ReqSize = reqSize
+	ev.RespSize = h.respHdr + h.respBody.n
+	ev.Status = r.Status
+	ev.Incomplete = incomplete || err != nil
+	if err != nil {
+		ev.Error = err.Error()
+	}
+	if x.req != nil {
+		ev.Request = newRequest(x.req)
+	}
+	ev.Response = newResponse(r)
+	core.Emit(h.Tracker.Sink, ev)
 	return nil
 }
 
+// emitLost 响应的头部有数据丢失 只输出请求
+func (h *ConnTracker) emitLost(x *exchange) {
+	if !x.record {
+		return
+	}
+	ev := core.NewEvent(h.ConnMeta, "http")
+	ev.Op = x.op()
+	ev.ReqTime = x.reqTime
+	ev.Done(h.respStream.Seen())
+	ev.Error = core.ErrDataLost.Error()
+	ev.Incomplete = true
+	if x.req != nil {
+		ev.Request = newRequest(x.req)
+	}
+	core.Emit(h.Tracker.Sink, ev)
+}
+
 func (h *ConnTracker) OnError(err error) {
 }
+
+// Request http 请求中需要记录的部分
+type Request struct {
+	Method string      `json:"method"`
+	Host   string      `json:"host"`
+	URL    string      `json:"url"`
+	Proto  string      `json:"proto"`
+	Header http.Header `json:"header"`
+}
+
+// Response http 响应中需要记录的部分
+type Response struct {
+	StatusCode    int         `json:"status_code"`
+	Proto         string      `json:"proto"`
+	Header        http.Header `json:"header"`
+	ContentLength int64       `json:"content_length"`
+}
+
+func newRequest(r *http.Request) *Request {
+	return &Request{
+		Method: r.Method,
+		Host:   r.Host,
+		URL:    r.URL.String(),
+		Proto:  r.Proto,
+		Header: r.Header,
+	}
+}
+
+func newResponse(r *http.Response) *Response {
+	return &Response{
+		StatusCode:    r.StatusCode,
+		Proto:         r.Proto,
+		Header:        r.Header,
+		ContentLength: r.ContentLength,
+	}
+}
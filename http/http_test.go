@@ -0,0 +1,130 @@
+package http
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/Salpadding/l7dump/core/coretest"
+)
+
+func TestPipelining(t *testing.T) {
+	sink := &coretest.Sink{}
+	conn := coretest.Start(&Tracker{Sink: sink}, coretest.Meta(80))
+	send := func(fromClient bool, data string) {
+		conn.Send(fromClient, []byte(data))
+	}
+
+	// 三个请求在一个包里 HEAD 的响应没有 body
+	send(true, "GET /a HTTP/1.1\r\nHost: x\r\n\r\n"+
+		"HEAD /b HTTP/1.1\r\nHost: x\r\n\r\n"+
+		"POST /c HTTP/1.1\r\nHost: x\r\nContent-Length: 4\r\nExpect: 100-continue\r\n\r\n")
+	send(false, "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok")
+	send(false, "HTTP/1.1 200 OK\r\nContent-Length: 100\r\n\r\n")
+	send(false, "HTTP/1.1 100 Continue\r\n\r\n")
+	send(true, "body")
+	send(false, "HTTP/1.1 201 Created\r\nContent-Length: 0\r\n\r\n")
+	conn.Close()
+
+	if len(sink.Events()) != 3 {
+		t.Fatalf("expect 3 events, got %d", len(sink.Events()))
+	}
+	for i, op := range []string{"GET /a", "HEAD /b", "POST /c"} {
+		if sink.Events()[i].Op != op {
+			t.Fatalf("unexpected event %d %s", i, sink.Events()[i])
+		}
+	}
+
+	post := sink.Events()[2]
+	if post.Status != "201 Created" || post.TTFB != 3*time.Millisecond || post.Latency != 5*time.Millisecond {
+		t.Fatalf("unexpected post event %s ttfb=%v", post, post.TTFB)
+	}
+}
+
+func TestFilter(t *testing.T) {
+	f := &Filter{
+		Methods:    []string{"get"},
+		Hosts:      []string{"*.example.com"},
+		PathPrefix: "/api/",
+		PathRegex:  `^/api/v\d+/`,
+		Headers:    map[string]string{"X-Env": "prod"},
+		Status:     []string{"5xx", "404"},
+	}
+	if err := f.Compile(); err != nil {
+		t.Fatal(err)
+	}
+
+	newReq := func(method, host, path string, header http.Header) *http.Request {
+		return &http.Request{Method: method, Host: host, URL: &url.URL{Path: path}, Header: header}
+	}
+	prod := http.Header{"X-Env": {"prod"}}
+	for _, c := range []struct {
+		req   *http.Request
+		match bool
+	}{
+		{newReq("GET", "api.example.com:8080", "/api/v1/users", prod), true},
+		{newReq("GET", "API.Example.COM", "/api/v1/users", prod), true},
+		{newReq("POST", "api.example.com", "/api/v1/users", prod), false},
+		{newReq("GET", "example.org", "/api/v1/users", prod), false},
+		{newReq("GET", "api.example.com", "/api/users", prod), false},
+		{newReq("GET", "api.example.com", "/api/v1/users", http.Header{"X-Env": {"dev"}}), false},
+	} {
+		if f.MatchRequest(c.req) != c.match {
+			t.Fatalf("unexpected match result of %s %s%s", c.req.Method, c.req.Host, c.req.URL.Path)
+		}
+	}
+
+	for code, match := range map[int]bool{503: true, 404: true, 200: false, 400: false} {
+		if f.MatchResponse(nil, &http.Response{StatusCode: code}) != match {
+			t.Fatalf("unexpected match result of status %d", code)
+		}
+	}
+
+	if !(&Filter{Hosts: []string{"*.Example.COM"}}).matchHost("api.example.com") {
+		t.Fatal("expect wildcard host to ignore case")
+	}
+
+	if err := (&Filter{Status: []string{"6xx"}}).Compile(); err == nil {
+		t.Fatal("expect invalid status error")
+	}
+}
+
+func TestGap(t *testing.T) {
+	sink := &coretest.Sink{}
+	conn := coretest.Start(&Tracker{Sink: sink}, coretest.Meta(80))
+	send := func(fromClient bool, skip int, data string) {
+		conn.Skip(fromClient, skip)
+		conn.Send(fromClient, []byte(data))
+	}
+
+	// 第一个响应的 body 丢了 5 个字节 剩下的部分需要跳过
+	send(true, 0, "GET /a HTTP/1.1\r\nHost: x\r\n\r\nGET /b HTTP/1.1\r\nHost: x\r\n\r\n")
+	send(false, 0, "HTTP/1.1 200 OK\r\nContent-Length: 10\r\n\r\nabc")
+	send(false, 5, "ijHTTP/1.1 404 Not Found\r\nContent-Length: 0\r\n\r\n")
+	// 请求头丢了一部分 响应和占位的请求配对
+	send(true, 0, "GET /c HTTP/1.1\r\nHo")
+	send(true, 3, "x\r\n\r\nGET /d HTTP/1.1\r\nHost: x\r\n\r\n")
+	send(false, 0, "HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\nHTTP/1.1 204 No Content\r\n\r\n")
+	conn.Close()
+
+	if len(sink.Events()) != 4 {
+		t.Fatalf("expect 4 events, got %v", sink.Events())
+	}
+	a, b, c, d := sink.Events()[0], sink.Events()[1], sink.Events()[2], sink.Events()[3]
+	if a.Op != "GET /a" || !a.Incomplete || a.Error == "" {
+		t.Errorf("unexpected event %v", a)
+	}
+	if b.Op != "GET /b" || b.Status != "404 Not Found" || b.Incomplete {
+		t.Errorf("unexpected event %v", b)
+	}
+	if c.Op != "unknown" || c.Status != "200 OK" || !c.Incomplete {
+		t.Errorf("unexpected event %v", c)
+	}
+	if d.Op != "GET /d" || d.Status != "204 No Content" || d.Incomplete {
+		t.Errorf("unexpected event %v", d)
+	}
+	if conn.Resp.Lost() != 5 || conn.Resp.Gaps() != 1 || conn.Req.Lost() != 3 {
+		t.Errorf("unexpected lost bytes %d %d, gaps %d", conn.Resp.Lost(), conn.Req.Lost(), conn.Resp.Gaps())
+	}
+}
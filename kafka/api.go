@@ -0,0 +1,231 @@
+package kafka
+
+import "encoding/binary"
+
+// Partition 一个 topic 分区上的数据
+type Partition struct {
+	Topic     string `json:"topic"`
+	Partition int32  `json:"partition"`
+	// Records Bytes produce 发送或者 fetch 收到的记录数和字节数
+	Records int `json:"records,omitempty"`
+	Bytes   int `json:"bytes,omitempty"`
+	// Offset produce 返回的 base offset, fetch 请求的 offset
+	Offset        int64  `json:"offset,omitempty"`
+	HighWatermark int64  `json:"high_watermark,omitempty"`
+	ErrorCode     int16  `json:"error_code,omitempty"`
+	Error         string `json:"error,omitempty"`
+}
+
+func (p *Partition) setError(code int16) {
+	p.ErrorCode = code
+	if code != 0 {
+		p.Error = errorName(code)
+	}
+}
+
+// countRecords 统计 record batch 中的记录数 不需要解压
+// magic 2 的 batch 头部有记录数 更早的 message set 每个消息一条记录
+// fetch 返回的最后一个 batch 可能不完整
+func countRecords(data []byte) (n int) {
+	for len(data) >= 17 {
+		size := int(binary.BigEndian.Uint32(data[8:12])) + 12
+		magic := data[16]
+		if size < 17 || size > len(data) {
+			return
+		}
+		if magic >= 2 {
+			if size < 61 {
+				return
+			}
+			n += int(binary.BigEndian.Uint32(data[57:61]))
+		} else {
+			n++
+		}
+		data = data[size:]
+	}
+	return
+}
+
+// topicName 新版本使用 topic id 代替 topic 名字
+func (b *buffer) topicName(useID bool) string {
+	if useID {
+		return b.uuid()
+	}
+	return b.string()
+}
+
+// ProduceRequest https://kafka.apache.org/protocol.html#The_Messages_Produce
+type ProduceRequest struct {
+	TransactionalID string       `json:"transactional_id,omitempty"`
+	Acks            int16        `json:"acks"`
+	Partitions      []*Partition `json:"partitions"`
+}
+
+func decodeProduceRequest(b *buffer, version int16) *ProduceRequest {
+	req := &ProduceRequest{}
+	if version >= 3 {
+		req.TransactionalID = b.string()
+	}
+	req.Acks = b.int16()
+	b.int32()
+	for i, n := 0, b.array(); i < n && b.err == nil; i++ {
+		topic := b.topicName(version >= 13)
+		for j, m := 0, b.array(); j < m && b.err == nil; j++ {
+			p := &Partition{Topic: topic, Partition: b.int32()}
+			records := b.bytes()
+			p.Bytes = len(records)
+			p.Records = countRecords(records)
+			b.tags()
+			req.Partitions = append(req.Partitions, p)
+		}
+		b.tags()
+	}
+	b.tags()
+	return req
+}
+
+func decodeProduceResponse(b *buffer, version int16) (partitions []*Partition) {
+	for i, n := 0, b.array(); i < n && b.err == nil; i++ {
+		topic := b.topicName(version >= 13)
+		for j, m := 0, b.array(); j < m && b.err == nil; j++ {
+			p := &Partition{Topic: topic, Partition: b.int32()}
+			p.setError(b.int16())
+			p.Offset = b.int64()
+			if version >= 2 {
+				b.int64()
+			}
+			if version >= 5 {
+				b.int64()
+			}
+			if version >= 8 {
+				for k, l := 0, b.array(); k < l && b.err == nil; k++ {
+					b.int32()
+					b.string()
+					b.tags()
+				}
+				b.string()
+			}
+			b.tags()
+			partitions = append(partitions, p)
+		}
+		b.tags()
+	}
+	return
+}
+
+// FetchRequest https://kafka.apache.org/protocol.html#The_Messages_Fetch
+type FetchRequest struct {
+	MaxWait    int32        `json:"max_wait_ms"`
+	MinBytes   int32        `json:"min_bytes"`
+	MaxBytes   int32        `json:"max_bytes,omitempty"`
+	Partitions []*Partition `json:"partitions"`
+}
+
+func decodeFetchRequest(b *buffer, version int16) *FetchRequest {
+	req := &FetchRequest{}
+	if version < 15 {
+		b.int32()
+	}
+	req.MaxWait = b.int32()
+	req.MinBytes = b.int32()
+	if version >= 3 {
+		req.MaxBytes = b.int32()
+	}
+	if version >= 4 {
+		b.int8()
+	}
+	if version >= 7 {
+		b.int32()
+		b.int32()
+	}
+	for i, n := 0, b.array(); i < n && b.err == nil; i++ {
+		topic := b.topicName(version >= 13)
+		for j, m := 0, b.array(); j < m && b.err == nil; j++ {
+			p := &Partition{Topic: topic, Partition: b.int32()}
+			if version >= 9 {
+				b.int32()
+			}
+			p.Offset = b.int64()
+			if version >= 12 {
+				b.int32()
+			}
+			if version >= 5 {
+				b.int64()
+			}
+			b.int32()
+			b.tags()
+			req.Partitions = append(req.Partitions, p)
+		}
+		b.tags()
+	}
+	return req
+}
+
+// decodeFetchResponse 返回顶层的错误码和每个分区的数据
+func decodeFetchResponse(b *buffer, version int16) (code int16, partitions []*Partition) {
+	if version >= 1 {
+		b.int32()
+	}
+	if version >= 7 {
+		code = b.int16()
+		b.int32()
+	}
+	for i, n := 0, b.array(); i < n && b.err == nil; i++ {
+		topic := b.topicName(version >= 13)
+		for j, m := 0, b.array(); j < m && b.err == nil; j++ {
+			p := &Partition{Topic: topic, Partition: b.int32()}
+			p.setError(b.int16())
+			p.HighWatermark = b.int64()
+			if version >= 4 {
+				b.int64()
+			}
+			if version >= 5 {
+				b.int64()
+			}
+			if version >= 4 {
+				for k, l := 0, b.array(); k < l && b.err == nil; k++ {
+					b.int64()
+					b.int64()
+					b.tags()
+				}
+			}
+			if version >= 11 {
+				b.int32()
+			}
+			records := b.bytes()
+			p.Bytes = len(records)
+			p.Records = countRecords(records)
+			b.tags()
+			partitions = append(partitions, p)
+		}
+		b.tags()
+	}
+	return
+}
+
+// topLevelError 响应开头的错误码 没有顶层错误码的 api 返回 false
+// 有些版本在错误码之前有 throttle_time_ms
+func topLevelError(b *buffer, key, version int16) (code int16, ok bool) {
+	var throttle bool
+	switch key {
+	case apiVersions, apiSaslHandshake, apiSaslAuth:
+	case apiFindCoordinator:
+		if version >= 4 {
+			return
+		}
+		throttle = version >= 1
+	case apiJoinGroup:
+		throttle = version >= 2
+	case apiHeartbeat, apiLeaveGroup, apiSyncGroup, apiListGroups:
+		throttle = version >= 1
+	case apiInitProducerID, apiAddOffsetsToTxn, apiEndTxn:
+		throttle = true
+	default:
+		return
+	}
+	if throttle {
+		b.int32()
+	}
+	code = b.int16()
+	return code, b.err == nil
+}
@@ -0,0 +1,383 @@
+package kafka
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/Salpadding/l7dump/core"
+)
+
+var (
+	_ core.ProtocolTracker     = (*Tracker)(nil)
+	_ core.ProtocolConnTracker = (*ConnTracker)(nil)
+)
+
+const (
+	// maxMessage 超过这个长度的消息只解析头部
+	maxMessage = 64 << 20
+	// maxHeader 只解析头部时读取的长度
+	maxHeader = 4096
+)
+
+// Request 请求头 和 Produce Fetch 的内容
+type Request struct {
+	APIKey        int16           `json:"api_key"`
+	APIVersion    int16           `json:"api_version"`
+	CorrelationID int32           `json:"correlation_id"`
+	ClientID      string          `json:"client_id,omitempty"`
+	Produce       *ProduceRequest `json:"produce,omitempty"`
+	Fetch         *FetchRequest   `json:"fetch,omitempty"`
+}
+
+// Response 顶层的错误码 和 Produce Fetch 每个分区的结果
+type Response struct {
+	ErrorCode  int16        `json:"error_code"`
+	Error      string       `json:"error,omitempty"`
+	Partitions []*Partition `json:"partitions,omitempty"`
+}
+
+// frame 4 字节长度开头的消息
+// 过长的消息 body 只有开头的一部分
+type frame struct {
+	body []byte
+	size int
+}
+
+// readFrame 出错时 body 是已经读到的部分
+func readFrame(r *bufio.Reader) (f frame, err error) {
+	var hdr [4]byte
+	if _, err = io.ReadFull(r, hdr[:]); err != nil {
+		return
+	}
+	n := int(int32(binary.BigEndian.Uint32(hdr[:])))
+	if n < 0 {
+		return f, ErrMalformMsg
+	}
+	f.size = n + 4
+	keep := n
+	if n > maxMessage {
+		keep = maxHeader
+	}
+	f.body = make([]byte, keep)
+	var read int
+	if read, err = io.ReadFull(r, f.body); err != nil {
+		f.body = f.body[:read]
+		return
+	}
+	_, err = r.Discard(n - keep)
+	return
+}
+
+type ConnTracker struct {
+	meta       *core.ConnMeta
+	tracker    *Tracker
+	reqStream  *core.Stream
+	respStream *core.Stream
+	reqBuf     *bufio.Reader
+	respBuf    *bufio.Reader
+
+	// pending 响应只有 correlation id, 需要通过请求找到 api key 和版本
+	mtx     sync.Mutex
+	pending map[int32]*core.Event
+
+	// reqGap respGap 丢包之后需要重新同步 分别只在请求和响应的协程中使用
+	reqGap  bool
+	respGap bool
+}
+
+func (c *ConnTracker) push(id int32, ev *core.Event) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.pending[id] = ev
+}
+
+func (c *ConnTracker) has(id int32) bool {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	_, ok := c.pending[id]
+	return ok
+}
+
+func (c *ConnTracker) pop(id int32) *core.Event {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	ev := c.pending[id]
+	delete(c.pending, id)
+	return ev
+}
+
+// decodeReq 解码请求头 Produce 和 Fetch 解码到分区
+func (c *ConnTracker) decodeReq() (interface{}, error) {
+	if c.reqGap {
+		skipped, err := core.Resync(c.reqBuf, matchRequest)
+		if err != nil {
+			return nil, err
+		}
+		c.reqGap = false
+		log.Printf("kafka %s: request resynced, skipped %d bytes", c.meta, skipped)
+	}
+	if _, err := c.reqBuf.Peek(1); err != nil {
+		if err == core.ErrDataLost {
+			c.reqGap = true
+			return nil, nil
+		}
+		return nil, err
+	}
+	reqTime := c.reqStream.Seen()
+	gaps := c.reqStream.Gaps()
+	f, err := readFrame(c.reqBuf)
+	if err != nil {
+		if c.reqStream.Gaps() == gaps {
+			return nil, err
+		}
+		c.reqGap = true
+		c.lostReq(f, reqTime)
+		return nil, nil
+	}
+
+	b := &buffer{b: f.body}
+	req := &Request{
+		APIKey:        b.int16(),
+		APIVersion:    b.int16(),
+		CorrelationID: b.int32(),
+		ClientID:      b.legacyString(),
+	}
+	if b.err != nil {
+		return nil, b.err
+	}
+	b.flexible = isFlexible(req.APIKey, req.APIVersion)
+	b.tags()
+
+	ev := core.NewEvent(c.meta, "kafka")
+	ev.Op = apiName(req.APIKey)
+	ev.ReqTime = reqTime
+	ev.ReqSize = f.size
+	ev.Request = req
+
+	switch req.APIKey {
+	case apiProduce:
+		req.Produce = decodeProduceRequest(b, req.APIVersion)
+	case apiFetch:
+		req.Fetch = decodeFetchRequest(b, req.APIVersion)
+	}
+	if b.err != nil {
+		ev.Error = b.err.Error()
+	}
+
+	// acks 为 0 时服务端不会响应
+	if req.Produce != nil && req.Produce.Acks == 0 && b.err == nil {
+		ev.Status = "NO_ACK"
+		core.Emit(c.tracker.Sink, ev)
+		return req, nil
+	}
+	c.push(req.CorrelationID, ev)
+	return req, nil
+}
+
+// lostReq 请求有数据丢失 读到了请求头时等待响应
+func (c *ConnTracker) lostReq(f frame, reqTime time.Time) {
+	b := &buffer{b: f.body}
+	req := &Request{
+		APIKey:        b.int16(),
+		APIVersion:    b.int16(),
+		CorrelationID: b.int32(),
+	}
+	if b.err != nil {
+		return
+	}
+	ev := core.NewEvent(c.meta, "kafka")
+	ev.Op = apiName(req.APIKey)
+	ev.ReqTime = reqTime
+	ev.ReqSize = f.size
+	ev.Request = req
+	ev.Incomplete = true
+	c.push(req.CorrelationID, ev)
+}
+
+// decodeResp 根据 correlation id 找到对应的请求
+func (c *ConnTracker) decodeResp() (interface{}, error) {
+	if c.respGap {
+		skipped, err := core.Resync(c.respBuf, c.matchResponse)
+		if err != nil {
+			return nil, err
+		}
+		c.respGap = false
+		log.Printf("kafka %s: response resynced, skipped %d bytes", c.meta, skipped)
+	}
+	if _, err := c.respBuf.Peek(1); err != nil {
+		if err == core.ErrDataLost {
+			c.respGap = true
+			return nil, nil
+		}
+		return nil, err
+	}
+	gaps := c.respStream.Gaps()
+	f, err := readFrame(c.respBuf)
+	if err != nil {
+		if c.respStream.Gaps() == gaps {
+			return nil, err
+		}
+		c.respGap = true
+		c.lostResp(f)
+		return nil, nil
+	}
+	b := &buffer{b: f.body}
+	id := b.int32()
+	if b.err != nil {
+		return nil, b.err
+	}
+
+	ev := c.pop(id)
+	if ev == nil {
+		// 没有看到请求 例如抓包开始时已经发出的请求
+		ev = core.NewEvent(c.meta, "kafka")
+		ev.Op = "unknown"
+		ev.Done(c.respStream.Seen())
+		ev.RespSize = f.size
+		ev.Error = "unmatched correlation id"
+		core.Emit(c.tracker.Sink, ev)
+		return nil, nil
+	}
+	req := ev.Request.(*Request)
+	resp := &Response{}
+
+	b.flexible = isFlexible(req.APIKey, req.APIVersion)
+	// ApiVersions 的响应头总是 v0, 不支持的版本也能解析
+	if req.APIKey != apiVersions {
+		b.tags()
+	}
+	switch req.APIKey {
+	case apiProduce:
+		resp.Partitions = decodeProduceResponse(b, req.APIVersion)
+	case apiFetch:
+		resp.ErrorCode, resp.Partitions = decodeFetchResponse(b, req.APIVersion)
+	default:
+		resp.ErrorCode, _ = topLevelError(b, req.APIKey, req.APIVersion)
+	}
+	if b.err != nil && ev.Error == "" {
+		ev.Error = b.err.Error()
+	}
+
+	// 没有顶层错误码时使用第一个出错的分区
+	code := resp.ErrorCode
+	for _, p := range resp.Partitions {
+		if code != 0 {
+			break
+		}
+		code = p.ErrorCode
+	}
+	if resp.ErrorCode != 0 {
+		resp.Error = errorName(resp.ErrorCode)
+	}
+
+	ev.Done(c.respStream.Seen())
+	ev.RespSize = f.size
+	ev.Status = errorName(code)
+	ev.Response = resp
+	core.Emit(c.tracker.Sink, ev)
+	return resp, nil
+}
+
+// lostResp 响应有数据丢失 读到了 correlation id 时输出请求
+func (c *ConnTracker) lostResp(f frame) {
+	b := &buffer{b: f.body}
+	id := b.int32()
+	if b.err != nil {
+		return
+	}
+	ev := c.pop(id)
+	if ev == nil {
+		return
+	}
+	ev.Done(c.respStream.Seen())
+	ev.RespSize = f.size
+	ev.Error = core.ErrDataLost.Error()
+	ev.Incomplete = true
+	core.Emit(c.tracker.Sink, ev)
+}
+
+// matchResponse 响应的 correlation id 对应一个已经发出的请求
+func (c *ConnTracker) matchResponse(data []byte) core.ProbeResult {
+	if len(data) < 8 {
+		return core.ProbeMore
+	}
+	size := int(int32(binary.BigEndian.Uint32(data)))
+	if size < 4 || size > maxMessage || !c.has(int32(binary.BigEndian.Uint32(data[4:]))) {
+		return core.ProbeMismatch
+	}
+	return core.ProbeMatch
+}
+
+func (c *ConnTracker) OnRequest(req interface{}) error {
+	return nil
+}
+
+func (c *ConnTracker) OnResponse(resp interface{}) error {
+	return nil
+}
+
+func (c *ConnTracker) OnError(err error) {
+	log.Printf("kafka %s: %v", c.meta, err)
+}
+
+// Tracker kafka 协议
+// 客户端使用 ssl 或者 SaslHandshake v0 之后的 sasl 数据无法解码
+type Tracker struct {
+	// Sink 接收每个请求和响应组成的 Event, 为空时输出到标准输出
+	Sink core.Sink
+}
+
+func (t *Tracker) RequestDecoder(stream *core.Stream, conn core.ProtocolConnTracker) func() (interface{}, error) {
+	c := conn.(*ConnTracker)
+	c.reqStream = stream
+	c.reqBuf = bufio.NewReader(stream)
+	return c.decodeReq
+}
+
+func (t *Tracker) ResponseDecoder(stream *core.Stream, conn core.ProtocolConnTracker) func() (interface{}, error) {
+	c := conn.(*ConnTracker)
+	c.respStream = stream
+	c.respBuf = bufio.NewReader(stream)
+	return c.decodeResp
+}
+
+func (t *Tracker) NewConnect(meta *core.ConnMeta) core.ProtocolConnTracker {
+	log.Printf("new kafka connect to %s", meta.String())
+	return &ConnTracker{
+		meta:    meta,
+		tracker: t,
+		pending: make(map[int32]*core.Event),
+	}
+}
+
+func (t *Tracker) OnClose(conn core.ProtocolConnTracker, reason core.CloseReason) {
+}
+
+// Probe 请求头中的长度 api key 和版本号都是合理的
+func (t *Tracker) Probe(req, resp []byte) core.ProbeResult {
+	if len(req) == 0 && len(resp) > 0 {
+		return core.ProbeMismatch
+	}
+	return matchRequest(req)
+}
+
+func matchRequest(data []byte) core.ProbeResult {
+	if len(data) < 14 {
+		return core.ProbeMore
+	}
+	size := int(int32(binary.BigEndian.Uint32(data)))
+	key := int16(binary.BigEndian.Uint16(data[4:]))
+	version := int16(binary.BigEndian.Uint16(data[6:]))
+	clientID := int(int16(binary.BigEndian.Uint16(data[12:])))
+	if _, ok := apiNames[key]; !ok || size < 10 || size > maxMessage {
+		return core.ProbeMismatch
+	}
+	if version < 0 || version > 20 || clientID < -1 || clientID > size-10 {
+		return core.ProbeMismatch
+	}
+	return core.ProbeMatch
+}
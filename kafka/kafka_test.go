@@ -0,0 +1,248 @@
+package kafka
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/Salpadding/l7dump/core"
+	"github.com/Salpadding/l7dump/core/coretest"
+)
+
+// chunk 一个方向上的一段数据
+// chunk data 为 nil 表示这个方向丢了数据
+type chunk struct {
+	fromClient bool
+	data       []byte
+}
+
+func replay(t *testing.T, chunks []chunk) []*core.Event {
+	sink := &coretest.Sink{}
+	conn := coretest.Start(&Tracker{Sink: sink}, coretest.Meta(9092))
+	for _, c := range chunks {
+		conn.Send(c.fromClient, c.data)
+	}
+	for _, err := range conn.Close() {
+		t.Error(err)
+	}
+	return sink.Events()
+}
+
+// encoder 构造测试用的消息 flexible 时使用 compact 类型
+type encoder struct {
+	bytes.Buffer
+	flexible bool
+}
+
+func (e *encoder) i8(v int) *encoder  { e.WriteByte(byte(v)); return e }
+func (e *encoder) i16(v int) *encoder { binary.Write(e, binary.BigEndian, int16(v)); return e }
+func (e *encoder) i32(v int) *encoder { binary.Write(e, binary.BigEndian, int32(v)); return e }
+func (e *encoder) i64(v int) *encoder { binary.Write(e, binary.BigEndian, int64(v)); return e }
+
+func (e *encoder) uvarint(v int) *encoder {
+	var buf [binary.MaxVarintLen64]byte
+	e.Write(buf[:binary.PutUvarint(buf[:], uint64(v))])
+	return e
+}
+
+func (e *encoder) length(n int, int16Len bool) *encoder {
+	switch {
+	case e.flexible:
+		return e.uvarint(n + 1)
+	case int16Len:
+		return e.i16(n)
+	}
+	return e.i32(n)
+}
+
+func (e *encoder) str(s string) *encoder {
+	e.length(len(s), true)
+	e.WriteString(s)
+	return e
+}
+
+func (e *encoder) bytes(b []byte) *encoder {
+	e.length(len(b), false)
+	e.Write(b)
+	return e
+}
+
+func (e *encoder) array(n int) *encoder { return e.length(n, false) }
+
+func (e *encoder) tags() *encoder {
+	if e.flexible {
+		e.uvarint(0)
+	}
+	return e
+}
+
+// frame 加上长度前缀
+func (e *encoder) frame() []byte {
+	out := make([]byte, 4, 4+e.Len())
+	binary.BigEndian.PutUint32(out, uint32(e.Len()))
+	return append(out, e.Bytes()...)
+}
+
+// request 请求头 client_id 总是 int16 长度
+func request(key, version, id int, flexible bool) *encoder {
+	e := &encoder{}
+	e.i16(key).i16(version).i32(id).i16(len("app"))
+	e.WriteString("app")
+	e.flexible = flexible
+	return e.tags()
+}
+
+// recordBatch magic 2 的 batch 只填写长度 magic 和记录数
+func recordBatch(records int) []byte {
+	b := make([]byte, 61+10*records)
+	binary.BigEndian.PutUint32(b[8:], uint32(len(b)-12))
+	b[16] = 2
+	binary.BigEndian.PutUint32(b[57:], uint32(records))
+	return b
+}
+
+func TestKafka(t *testing.T) {
+	records := append(recordBatch(3), recordBatch(2)...)
+
+	produce := request(0, 3, 1, false)
+	produce.str("").i16(-1).i32(30000)
+	produce.array(1).str("orders").array(1).i32(2).bytes(records)
+
+	produceResp := &encoder{}
+	produceResp.i32(1)
+	produceResp.array(1).str("orders").array(1).i32(2).i16(0).i64(42).i64(-1)
+	produceResp.i32(0)
+
+	// acks 为 0 没有响应
+	noAck := request(0, 3, 2, false)
+	noAck.str("").i16(0).i32(30000)
+	noAck.array(1).str("logs").array(1).i32(0).bytes(recordBatch(1))
+
+	fetch := request(1, 12, 3, true)
+	fetch.i32(-1).i32(500).i32(1).i32(1 << 20).i8(0).i32(0).i32(-1)
+	fetch.array(1).str("orders").array(1).i32(2).i32(-1).i64(40).i32(-1).i64(0).i32(1 << 20).tags().tags()
+	fetch.array(0).str("").tags()
+
+	// 最后一个 batch 不完整
+	fetched := append(recordBatch(4), recordBatch(5)[:30]...)
+	fetchResp := &encoder{}
+	fetchResp.i32(3)
+	fetchResp.flexible = true
+	fetchResp.tags().i32(0).i16(0).i32(7)
+	fetchResp.array(1).str("orders").array(1).i32(2).i16(0).i64(45).i64(45).i64(0).array(0).i32(-1).bytes(fetched).tags().tags()
+	fetchResp.tags()
+
+	// ApiVersions 的响应头没有 tagged fields
+	versions := request(18, 3, 4, true)
+	versions.str("kafka-go").str("1.0").tags()
+	versionsResp := &encoder{}
+	versionsResp.i32(4).i16(35)
+
+	heartbeat := request(12, 4, 5, true)
+	heartbeat.str("group").i32(1).str("member").str("").tags()
+	heartbeatResp := &encoder{}
+	heartbeatResp.i32(5)
+	heartbeatResp.flexible = true
+	heartbeatResp.tags().i32(0).i16(27).tags()
+
+	events := replay(t, []chunk{
+		{true, produce.frame()},
+		{false, produceResp.frame()},
+		{true, noAck.frame()},
+		{true, fetch.frame()},
+		{true, versions.frame()},
+		{true, heartbeat.frame()},
+		// 响应的顺序可以和请求不同
+		{false, heartbeatResp.frame()},
+		{false, versionsResp.frame()},
+		{false, fetchResp.frame()},
+	})
+	if len(events) != 5 {
+		t.Fatalf("expect 5 events, got %d", len(events))
+	}
+
+	ev := events[0]
+	if ev.Op != "Produce" || ev.Status != "NONE" || ev.Error != "" || ev.Latency != time.Millisecond {
+		t.Errorf("unexpected produce event %v", ev)
+	}
+	req := ev.Request.(*Request)
+	if req.ClientID != "app" || req.CorrelationID != 1 || req.Produce.Acks != -1 {
+		t.Errorf("unexpected produce request %+v", req)
+	}
+	if p := req.Produce.Partitions[0]; p.Topic != "orders" || p.Partition != 2 || p.Records != 5 || p.Bytes != len(records) {
+		t.Errorf("unexpected produce partition %+v", p)
+	}
+	if p := ev.Response.(*Response).Partitions[0]; p.Offset != 42 || p.ErrorCode != 0 {
+		t.Errorf("unexpected produce result %+v", p)
+	}
+
+	ev = events[1]
+	if ev.Op != "Produce" || ev.Status != "NO_ACK" || ev.Response != nil {
+		t.Errorf("unexpected no ack event %v", ev)
+	}
+
+	ev = events[2]
+	if ev.Op != "Heartbeat" || ev.Status != "REBALANCE_IN_PROGRESS" || ev.Error != "" {
+		t.Errorf("unexpected heartbeat event %v", ev)
+	}
+
+	ev = events[3]
+	if ev.Op != "ApiVersions" || ev.Status != "UNSUPPORTED_VERSION" || ev.Error != "" {
+		t.Errorf("unexpected api versions event %v", ev)
+	}
+
+	ev = events[4]
+	if ev.Op != "Fetch" || ev.Status != "NONE" || ev.Error != "" {
+		t.Errorf("unexpected fetch event %v", ev)
+	}
+	if p := ev.Request.(*Request).Fetch.Partitions[0]; p.Topic != "orders" || p.Offset != 40 {
+		t.Errorf("unexpected fetch partition %+v", p)
+	}
+	if p := ev.Response.(*Response).Partitions[0]; p.Records != 4 || p.Bytes != len(fetched) || p.HighWatermark != 45 {
+		t.Errorf("unexpected fetch result %+v", p)
+	}
+}
+
+func TestDataLost(t *testing.T) {
+	heartbeat := func(id int) []byte {
+		e := request(12, 4, id, true)
+		e.str("group").i32(1).str("member").str("").tags()
+		return e.frame()
+	}
+	heartbeatResp := func(id int) []byte {
+		e := &encoder{}
+		e.i32(id)
+		e.flexible = true
+		e.tags().i32(0).i16(0).tags()
+		return e.frame()
+	}
+	first, second, third := heartbeat(1), heartbeat(2), heartbeat(3)
+	lost := heartbeatResp(2)
+
+	events := replay(t, []chunk{
+		// 请求的后半部分丢了
+		{true, first[:20]},
+		{true, nil},
+		{true, second},
+		{false, heartbeatResp(1)},
+		// 响应的后半部分丢了
+		{false, lost[:10]},
+		{false, nil},
+		{true, third},
+		{false, append(lost[12:], heartbeatResp(3)...)},
+	})
+
+	if len(events) != 3 {
+		t.Fatalf("expect 3 events, got %v", events)
+	}
+	if ev := events[0]; ev.Op != "Heartbeat" || !ev.Incomplete || ev.Status != "NONE" {
+		t.Fatalf("unexpected event %v", ev)
+	}
+	if ev := events[1]; ev.Op != "Heartbeat" || !ev.Incomplete || ev.Error != core.ErrDataLost.Error() {
+		t.Fatalf("unexpected event %v", ev)
+	}
+	if ev := events[2]; ev.Op != "Heartbeat" || ev.Incomplete || ev.Request.(*Request).CorrelationID != 3 {
+		t.Fatalf("unexpected event %v", ev)
+	}
+}
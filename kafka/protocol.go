@@ -0,0 +1,227 @@
+package kafka
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"strconv"
+)
+
+// https://kafka.apache.org/protocol.html#protocol_api_keys
+const (
+	apiProduce         = 0
+	apiFetch           = 1
+	apiFindCoordinator = 10
+	apiJoinGroup       = 11
+	apiHeartbeat       = 12
+	apiLeaveGroup      = 13
+	apiSyncGroup       = 14
+	apiListGroups      = 16
+	apiSaslHandshake   = 17
+	apiVersions        = 18
+	apiInitProducerID  = 22
+	apiAddOffsetsToTxn = 25
+	apiEndTxn          = 26
+	apiSaslAuth        = 36
+)
+
+var apiNames = map[int16]string{
+	0: "Produce", 1: "Fetch", 2: "ListOffsets", 3: "Metadata", 4: "LeaderAndIsr",
+	5: "StopReplica", 6: "UpdateMetadata", 7: "ControlledShutdown", 8: "OffsetCommit",
+	9: "OffsetFetch", 10: "FindCoordinator", 11: "JoinGroup", 12: "Heartbeat",
+	13: "LeaveGroup", 14: "SyncGroup", 15: "DescribeGroups", 16: "ListGroups",
+	17: "SaslHandshake", 18: "ApiVersions", 19: "CreateTopics", 20: "DeleteTopics",
+	21: "DeleteRecords", 22: "InitProducerId", 23: "OffsetForLeaderEpoch",
+	24: "AddPartitionsToTxn", 25: "AddOffsetsToTxn", 26: "EndTxn", 27: "WriteTxnMarkers",
+	28: "TxnOffsetCommit", 29: "DescribeAcls", 30: "CreateAcls", 31: "DeleteAcls",
+	32: "DescribeConfigs", 33: "AlterConfigs", 34: "AlterReplicaLogDirs",
+	35: "DescribeLogDirs", 36: "SaslAuthenticate", 37: "CreatePartitions",
+	38: "CreateDelegationToken", 39: "RenewDelegationToken", 40: "ExpireDelegationToken",
+	41: "DescribeDelegationToken", 42: "DeleteGroups", 43: "ElectLeaders",
+	44: "IncrementalAlterConfigs", 45: "AlterPartitionReassignments",
+	46: "ListPartitionReassignments", 47: "OffsetDelete", 48: "DescribeClientQuotas",
+	49: "AlterClientQuotas", 50: "DescribeUserScramCredentials",
+	51: "AlterUserScramCredentials", 55: "DescribeQuorum", 57: "UpdateFeatures",
+	60: "DescribeCluster", 61: "DescribeProducers", 64: "UnregisterBroker",
+	65: "DescribeTransactions", 66: "ListTransactions", 68: "ConsumerGroupHeartbeat",
+	69: "ConsumerGroupDescribe", 71: "GetTelemetrySubscriptions", 72: "PushTelemetry",
+	74: "ListClientMetricsResources", 75: "DescribeTopicPartitions",
+}
+
+func apiName(key int16) string {
+	if name, ok := apiNames[key]; ok {
+		return name
+	}
+	return "Api" + strconv.Itoa(int(key))
+}
+
+// flexibleVersions 从这个版本开始使用 compact 类型和 tagged fields
+// 没有列出的 api 按照最新的客户端都使用 flexible 版本处理
+var flexibleVersions = map[int16]int16{
+	0: 9, 1: 12, 2: 6, 3: 9, 4: 4, 5: 2, 6: 6, 7: 3, 8: 8, 9: 6, 10: 3, 11: 6,
+	12: 4, 13: 4, 14: 4, 15: 5, 16: 3, 17: -1, 18: 3, 19: 5, 20: 4, 21: 2, 22: 2,
+	23: 4, 24: 3, 25: 3, 26: 3, 27: 1, 28: 3, 29: 2, 30: 2, 31: 2, 32: 4, 33: 2,
+	34: 2, 35: 2, 36: 2, 37: 2, 38: 2, 39: 2, 40: 2, 41: 2, 42: 2, 43: 2,
+}
+
+func isFlexible(key, version int16) bool {
+	v, ok := flexibleVersions[key]
+	if !ok {
+		return true
+	}
+	return v >= 0 && version >= v
+}
+
+var errorNames = map[int16]string{
+	-1: "UNKNOWN_SERVER_ERROR", 0: "NONE", 1: "OFFSET_OUT_OF_RANGE", 2: "CORRUPT_MESSAGE",
+	3: "UNKNOWN_TOPIC_OR_PARTITION", 4: "INVALID_FETCH_SIZE", 5: "LEADER_NOT_AVAILABLE",
+	6: "NOT_LEADER_OR_FOLLOWER", 7: "REQUEST_TIMED_OUT", 8: "BROKER_NOT_AVAILABLE",
+	9: "REPLICA_NOT_AVAILABLE", 10: "MESSAGE_TOO_LARGE", 13: "NETWORK_EXCEPTION",
+	14: "COORDINATOR_LOAD_IN_PROGRESS", 15: "COORDINATOR_NOT_AVAILABLE", 16: "NOT_COORDINATOR",
+	17: "INVALID_TOPIC_EXCEPTION", 18: "RECORD_LIST_TOO_LARGE", 19: "NOT_ENOUGH_REPLICAS",
+	20: "NOT_ENOUGH_REPLICAS_AFTER_APPEND", 21: "INVALID_REQUIRED_ACKS", 22: "ILLEGAL_GENERATION",
+	25: "UNKNOWN_MEMBER_ID", 26: "INVALID_SESSION_TIMEOUT", 27: "REBALANCE_IN_PROGRESS",
+	29: "TOPIC_AUTHORIZATION_FAILED", 30: "GROUP_AUTHORIZATION_FAILED",
+	31: "CLUSTER_AUTHORIZATION_FAILED", 32: "INVALID_TIMESTAMP", 33: "UNSUPPORTED_SASL_MECHANISM",
+	34: "ILLEGAL_SASL_STATE", 35: "UNSUPPORTED_VERSION", 36: "TOPIC_ALREADY_EXISTS",
+	37: "INVALID_PARTITIONS", 38: "INVALID_REPLICATION_FACTOR", 41: "NOT_CONTROLLER",
+	42: "INVALID_REQUEST", 45: "OUT_OF_ORDER_SEQUENCE_NUMBER", 46: "DUPLICATE_SEQUENCE_NUMBER",
+	47: "INVALID_PRODUCER_EPOCH", 48: "INVALID_TXN_STATE", 49: "INVALID_PRODUCER_ID_MAPPING",
+	51: "CONCURRENT_TRANSACTIONS", 53: "TRANSACTIONAL_ID_AUTHORIZATION_FAILED",
+	58: "SASL_AUTHENTICATION_FAILED", 59: "UNKNOWN_PRODUCER_ID", 69: "GROUP_ID_NOT_FOUND",
+	70: "FETCH_SESSION_ID_NOT_FOUND", 71: "INVALID_FETCH_SESSION_EPOCH", 74: "FENCED_LEADER_EPOCH",
+	75: "UNKNOWN_LEADER_EPOCH", 76: "UNSUPPORTED_COMPRESSION_TYPE", 79: "MEMBER_ID_REQUIRED",
+	82: "FENCED_INSTANCE_ID", 87: "INVALID_RECORD", 89: "THROTTLING_QUOTA_EXCEEDED",
+	90: "PRODUCER_FENCED", 100: "UNKNOWN_TOPIC_ID",
+}
+
+func errorName(code int16) string {
+	if name, ok := errorNames[code]; ok {
+		return name
+	}
+	return "ERROR_" + strconv.Itoa(int(code))
+}
+
+var ErrMalformMsg = errors.New("malformed kafka message")
+
+// buffer 按照 kafka 的类型解析消息
+// 出错之后所有的读取都返回零值
+type buffer struct {
+	b        []byte
+	flexible bool
+	err      error
+}
+
+func (b *buffer) next(n int) []byte {
+	if b.err != nil || n < 0 || len(b.b) < n {
+		b.err = ErrMalformMsg
+		return nil
+	}
+	data := b.b[:n]
+	b.b = b.b[n:]
+	return data
+}
+
+func (b *buffer) int8() int8 {
+	if data := b.next(1); data != nil {
+		return int8(data[0])
+	}
+	return 0
+}
+
+func (b *buffer) int16() int16 {
+	if data := b.next(2); data != nil {
+		return int16(binary.BigEndian.Uint16(data))
+	}
+	return 0
+}
+
+func (b *buffer) int32() int32 {
+	if data := b.next(4); data != nil {
+		return int32(binary.BigEndian.Uint32(data))
+	}
+	return 0
+}
+
+func (b *buffer) int64() int64 {
+	if data := b.next(8); data != nil {
+		return int64(binary.BigEndian.Uint64(data))
+	}
+	return 0
+}
+
+func (b *buffer) uvarint() int {
+	if b.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(b.b)
+	if n <= 0 {
+		b.err = ErrMalformMsg
+		return 0
+	}
+	b.b = b.b[n:]
+	return int(v)
+}
+
+// length 字符串 数组 bytes 的长度 -1 表示 null
+// compact 类型的长度是 uvarint(n+1)
+func (b *buffer) length(int16Len bool) int {
+	if b.flexible {
+		return b.uvarint() - 1
+	}
+	if int16Len {
+		return int(b.int16())
+	}
+	return int(b.int32())
+}
+
+func (b *buffer) string() string {
+	n := b.length(true)
+	if n < 0 {
+		return ""
+	}
+	return string(b.next(n))
+}
+
+// legacyString 请求头中的 client_id 总是使用 int16 长度
+func (b *buffer) legacyString() string {
+	n := int(b.int16())
+	if n < 0 {
+		return ""
+	}
+	return string(b.next(n))
+}
+
+func (b *buffer) bytes() []byte {
+	n := b.length(false)
+	if n < 0 {
+		return nil
+	}
+	return b.next(n)
+}
+
+func (b *buffer) array() int {
+	n := b.length(false)
+	// 防止错误的长度导致过多的循环
+	if n > len(b.b) {
+		b.err = ErrMalformMsg
+		return 0
+	}
+	return n
+}
+
+func (b *buffer) uuid() string {
+	return hex.EncodeToString(b.next(16))
+}
+
+// tags 跳过 tagged fields
+func (b *buffer) tags() {
+	if !b.flexible {
+		return
+	}
+	n := b.uvarint()
+	for i := 0; i < n && b.err == nil; i++ {
+		b.uvarint()
+		b.next(b.uvarint())
+	}
+}
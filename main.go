@@ -2,67 +2,254 @@ package main
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"log"
 	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 
-	"github.com/Salpadding/l7dump/http"
-	"github.com/Salpadding/l7dump/mysql"
+	"github.com/Salpadding/l7dump/core"
+	"github.com/Salpadding/l7dump/script"
 	"github.com/Salpadding/l7dump/session"
 )
 
-// 示例程序
-// 打印所有 url 中包含 /kapis/resources.kubesphere.io/v1alpha2/componenthealth 的请求
-const matchUrl = "/kapis/resources.kubesphere.io/v1alpha2/components"
+// sinks 相同路径的输出共用同一个 sink
+type sinks map[string]core.Sink
 
-type IfaceCfg struct {
-	Bpf      string          `json:"bpf"`
-	Trackers []TrackerConfig `json:"trackers"`
+func (s sinks) open(cfg *SinkConfig) (core.Sink, error) {
+	if cfg == nil {
+		cfg = &SinkConfig{}
+	}
+	key := cfg.Format + ":" + cfg.Path
+	if sink, ok := s[key]; ok {
+		return sink, nil
+	}
+
+	var w io.Writer = os.Stdout
+	if cfg.Path != "" && cfg.Path != "-" {
+		f, err := os.OpenFile(cfg.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, err
+		}
+		w = f
+	}
+
+	var sink core.Sink
+	switch cfg.Format {
+	case "", "jsonl":
+		sink = core.NewJSONLinesSink(w)
+	case "text":
+		sink = core.NewTextSink(w)
+	default:
+		return nil, fmt.Errorf("unknown sink format %s", cfg.Format)
+	}
+	s[key] = sink
+	return sink, nil
 }
 
-type TrackerConfig struct {
-	Port     int    `json:"port"`
-	Protocol string `json:"protocol"` // 协议 mysql, http
-	Program  string `json:"program"`  // lua 脚本 尚未支持
+func (s sinks) Close() {
+	for _, sink := range s {
+		sink.Close()
+	}
 }
 
-// l7dump en0 80 /order
-func main() {
-	if len(os.Args) != 2 {
-		panic("usage: l7dump [config.json]")
+// counter 统计写到输出的 Event
+type counter struct {
+	core.Sink
+	n *int64
+}
+
+func (c *counter) Write(ev *core.Event) error {
+	atomic.AddInt64(c.n, 1)
+	return c.Sink.Write(ev)
+}
+
+// capture 一个网卡的抓包 退出时输出统计
+type capture struct {
+	iface     string
+	mgr       *session.ProtocolSessionMgr
+	programs  []*script.Script
+	exchanges int64
+}
+
+func (c *capture) summary() string {
+	stats := c.mgr.Stats()
+	return fmt.Sprintf("%s: %d packets, %d connections, %d exchanges, %d dropped, %d evicted, %d gaps (%d bytes lost), %d panics",
+		c.iface, stats.Packets, stats.Conns, atomic.LoadInt64(&c.exchanges), stats.Drops,
+		stats.IdleEvicted+stats.LimitEvicted, stats.Gaps, stats.LostBytes, stats.Panics)
+}
+
+// setup 根据配置添加 tracker, 这时还没有开始抓包
+func (c *capture) setup(cfg *IfaceCfg, opened sinks) (err error) {
+	c.mgr.BPF = cfg.Bpf
+	if cfg.Limits != nil {
+		if c.mgr.Limits, err = cfg.Limits.limits(); err != nil {
+			return err
+		}
+	}
+	if cfg.Lifecycle != nil {
+		sink, err := opened.open(cfg.Lifecycle)
+		if err != nil {
+			return fmt.Errorf("lifecycle: %w", err)
+		}
+		c.mgr.AddLifecycle(&session.ConnEvents{Sink: sink})
+	}
+	for i := range cfg.Trackers {
+		if err = c.addTracker(&cfg.Trackers[i], cfg.Sink, opened); err != nil {
+			return fmt.Errorf("trackers[%d] (%s): %w", i, cfg.Trackers[i].Protocol, err)
+		}
+	}
+	return nil
+}
+
+// addTracker defaultSink 是网卡的输出配置
+func (c *capture) addTracker(cfg *TrackerConfig, defaultSink *SinkConfig, opened sinks) error {
+	sinkCfg := cfg.Sink
+	if sinkCfg == nil {
+		sinkCfg = defaultSink
+	}
+	sink, err := opened.open(sinkCfg)
+	if err != nil {
+		return err
 	}
 
-	bg := context.Background()
-	var config map[string]IfaceCfg
-	jsonData, err := os.ReadFile(os.Args[1])
+	// 脚本处理之后再输出和计数 被脚本丢弃的不算
+	sink = &counter{Sink: sink, n: &c.exchanges}
+	var program *script.Script
+	if cfg.Program != "" {
+		if program, err = script.Load(cfg.Program, sink); err != nil {
+			return err
+		}
+		c.programs = append(c.programs, program)
+		sink = program
+	}
 
+	tracker := cfg.newTracker(sink)
+	if tracker == nil {
+		return fmt.Errorf("unknown protocol %q", cfg.Protocol)
+	}
+	if program != nil {
+		tracker = program.Wrap(tracker)
+	}
+	// 没有端口时根据连接开头的数据识别协议
+	if cfg.probe() {
+		return c.mgr.AddProbe(tracker)
+	}
+	match, err := cfg.match()
 	if err != nil {
-		panic(err)
+		return err
+	}
+	c.mgr.AddMatch(match, tracker)
+	return nil
+}
+
+func (c *capture) close() {
+	for _, program := range c.programs {
+		program.Close()
 	}
+}
+
+// handleSignals 第一次收到信号时取消 ctx, 等所有的流解码完再退出
+// 第二次收到信号时直接退出
+func handleSignals(cancel context.CancelFunc) {
+	sig := make(chan os.Signal, 2)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	received := <-sig
+	log.Printf("received %s, flushing connections, send again to exit immediately", received)
+	cancel()
+	received = <-sig
+	log.Printf("received %s again, exit", received)
+	os.Exit(1)
+}
 
-	if err = json.Unmarshal(jsonData, &config); err != nil {
-		panic(err)
+// run 按检查过的配置抓包
+// file 不为空时以离线模式运行 读完文件后返回
+func run(config map[string]IfaceCfg, file string, o *options) (err error) {
+	// 每个网卡都读一遍文件会重复输出同样的连接
+	if file != "" && len(config) > 1 {
+		return fmt.Errorf("the config has interfaces %s, choose one with read -i", strings.Join(ifaces(config), ", "))
 	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// 信号取消外层的 ctx, 超时只取消内层的
+	if o.duration > 0 {
+		var stop context.CancelFunc
+		ctx, stop = context.WithTimeout(ctx, o.duration)
+		defer stop()
+	}
+	go handleSignals(cancel)
 
-	// mgr 和 iface 1:1
-	for iface := range config {
-		mgr := session.NewMgr(bg)
+	opened := make(sinks)
+	defer opened.Close()
 
+	// mgr 和 iface 1:1
+	var captures []*capture
+	defer func() {
+		for _, c := range captures {
+			c.close()
+		}
+	}()
+	for _, iface := range ifaces(config) {
 		cfg := config[iface]
+		c := &capture{iface: iface, mgr: session.NewMgr(ctx)}
+		c.mgr.Snaplen = o.snaplen
+		c.mgr.Promisc = o.promisc
+		c.mgr.MaxPackets = o.count
+		captures = append(captures, c)
+		if err = c.setup(&cfg, opened); err != nil {
+			return fmt.Errorf("%s: %w", iface, err)
+		}
+	}
 
-		for i := range cfg.Trackers {
-			switch cfg.Trackers[i].Protocol {
-			case "mysql":
-				mgr.AddTracker(cfg.Trackers[i].Port, &mysql.Tracker{})
-			case "http":
-				// TODO: 完善 http tracker
-				mgr.AddTracker(cfg.Trackers[i].Port, &http.Tracker{})
-			default:
-				panic(fmt.Sprintf("unknown protocol %s", cfg.Trackers[i].Protocol))
-			}
+	errs := make([]error, len(captures))
+	if file != "" {
+		c := captures[0]
+		if err = c.mgr.ReadFile(file); err != nil {
+			errs[0] = fmt.Errorf("%s: read %s: %w", c.iface, file, err)
+		}
+	} else {
+		var wg sync.WaitGroup
+		for i, c := range captures {
+			wg.Add(1)
+			go func(i int, c *capture) {
+				defer wg.Done()
+				if err := c.mgr.Listen(c.iface); err != nil {
+					errs[i] = fmt.Errorf("listen at %s: %w", c.iface, err)
+					log.Print(errs[i])
+				}
+			}(i, c)
 		}
-		go mgr.Listen(cfg.Bpf, iface)
+		// Listen 在 ctx 取消之后等到所有的 OnClose 都被调用才返回
+		wg.Wait()
 	}
 
-	<-bg.Done()
+	for _, c := range captures {
+		fmt.Fprintln(os.Stderr, c.summary())
+		for conn, n := range c.mgr.Panics() {
+			fmt.Fprintf(os.Stderr, "  %s panicked %d times\n", conn, n)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+	var err error
+	if cmd := findCommand(os.Args[1]); cmd != nil {
+		err = cmd.run(cmd, os.Args[2:])
+	} else {
+		err = legacy(os.Args[1:])
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "l7dump:", err)
+		os.Exit(1)
+	}
 }
@@ -2,6 +2,9 @@ package main
 
 import (
 	"context"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/Salpadding/l7dump/mysql"
@@ -13,5 +16,49 @@ func TestMysql(t *testing.T) {
 	mgr := session.NewMgr(context.Background())
 	tracker := &mysql.Tracker{}
 	mgr.AddTracker(3307, tracker)
-	mgr.Listen("tcp and port 3307", "en7")
+	mgr.Listen("en7")
+}
+
+func TestConfig(t *testing.T) {
+	cases := []struct {
+		config string
+		err    string
+	}{
+		{`{"en7": {"trackers": [{"port": 3307, "protocol": "mysql"}]}}`, ""},
+		{`{"en7": {"trackers": [{"ports": "3306-3310,3320", "hosts": ["10.0.3.0/24"], "protocol": "mysql"}]}}`, ""},
+		{`{"en7": {"trackers": [{"port": 3307, "protocol": "mysqll"}]}}`, `en7: trackers[0] (mysqll): unknown protocol "mysqll"`},
+		{`{"en7": {"trackers": [{"ports": "3310-3306", "protocol": "mysql"}]}}`, `invalid port range "3310-3306"`},
+		{`{"en7": {"trackers": [{"port": 80, "hosts": ["10.0.0.300"], "protocol": "http"}]}}`, `invalid ip "10.0.0.300"`},
+		{`{"en7": {"trackers": [{"hosts": ["10.0.0.1"], "protocol": "http"}]}}`, "require port or ports"},
+		{`{"en7": {"trackers": [{"port": 6379, "protocol": "redis", "filter": {}}]}}`, "filter is not supported"},
+		{`{"en7": {"sink": {"format": "xml"}, "trackers": [{"port": 6379, "protocol": "redis"}]}}`, `unknown sink format "xml"`},
+		{`{"en7": {"limits": {"idle_timeout": "1x"}, "trackers": [{"port": 6379, "protocol": "redis"}]}}`, "invalid idle_timeout"},
+		{`{"en7": {}}`, "en7: no trackers"},
+	}
+	for _, c := range cases {
+		path := filepath.Join(t.TempDir(), "config.json")
+		if err := os.WriteFile(path, []byte(c.config), 0644); err != nil {
+			t.Fatal(err)
+		}
+		_, err := loadConfig(path)
+		if c.err == "" && err != nil {
+			t.Errorf("%s: unexpected error %v", c.config, err)
+		}
+		if c.err != "" && (err == nil || !strings.Contains(err.Error(), c.err)) {
+			t.Errorf("%s: expect error %q, got %v", c.config, c.err, err)
+		}
+	}
+}
+
+// 离线模式每个网卡都读一遍文件会重复输出 必须用 -i 选一个网卡
+func TestReadSeveralIfaces(t *testing.T) {
+	tracker := TrackerConfig{Protocol: "redis", Port: 6379}
+	config := map[string]IfaceCfg{
+		"eth0": {Trackers: []TrackerConfig{tracker}},
+		"eth1": {Trackers: []TrackerConfig{tracker}},
+	}
+	err := run(config, filepath.Join(t.TempDir(), "capture.pcap"), &options{})
+	if err == nil || !strings.Contains(err.Error(), "eth0, eth1") {
+		t.Fatalf("expect an error asking for -i, got %v", err)
+	}
 }
@@ -0,0 +1,370 @@
+package mongo
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"strings"
+	"time"
+)
+
+// https://bsonspec.org/spec.html
+const (
+	bsonDouble     = 0x01
+	bsonString     = 0x02
+	bsonDocument   = 0x03
+	bsonArray      = 0x04
+	bsonBinary     = 0x05
+	bsonUndefined  = 0x06
+	bsonObjectID   = 0x07
+	bsonBool       = 0x08
+	bsonDateTime   = 0x09
+	bsonNull       = 0x0a
+	bsonRegex      = 0x0b
+	bsonDBPointer  = 0x0c
+	bsonJavaScript = 0x0d
+	bsonSymbol     = 0x0e
+	bsonCodeScope  = 0x0f
+	bsonInt32      = 0x10
+	bsonTimestamp  = 0x11
+	bsonInt64      = 0x12
+	bsonDecimal    = 0x13
+	bsonMinKey     = 0xff
+	bsonMaxKey     = 0x7f
+)
+
+const (
+	// maxDepth 嵌套过深的文档不再解析
+	maxDepth = 64
+	// maxString 字符串只保留开头的一部分
+	maxString = 256
+)
+
+var ErrMalformBSON = errors.New("malformed bson")
+
+// D 保持字段顺序的文档 命令的名字是第一个字段
+type D []E
+
+// E 文档中的一个字段
+type E struct {
+	Key   string
+	Value interface{}
+}
+
+// A bson 数组
+type A []interface{}
+
+// Get 返回字段的值 不存在时返回 nil
+func (d D) Get(key string) interface{} {
+	for _, e := range d {
+		if e.Key == key {
+			return e.Value
+		}
+	}
+	return nil
+}
+
+func (d D) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, e := range d {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		key, _ := json.Marshal(e.Key)
+		buf.Write(key)
+		buf.WriteByte(':')
+		val, err := json.Marshal(e.Value)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(val)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// Ext 没有对应 json 类型的值 按照 extended json 的格式输出
+type Ext struct {
+	Type  string
+	Value interface{}
+}
+
+func (e *Ext) MarshalJSON() ([]byte, error) {
+	return json.Marshal(e.Value)
+}
+
+// typeName 值的 bson 类型 和 mongo shell 的 $type 一致
+func typeName(v interface{}) string {
+	switch v := v.(type) {
+	case float64:
+		return "double"
+	case string:
+		return "string"
+	case D:
+		return "object"
+	case A:
+		return "array"
+	case bool:
+		return "bool"
+	case nil:
+		return "null"
+	case int32:
+		return "int"
+	case int64:
+		return "long"
+	case *Ext:
+		return v.Type
+	}
+	return "unknown"
+}
+
+// Shape 把值替换成类型 只保留查询的结构
+// 数组只保留第一个元素的结构
+func Shape(v interface{}) interface{} {
+	switch v := v.(type) {
+	case D:
+		shape := make(D, len(v))
+		for i, e := range v {
+			shape[i] = E{Key: e.Key, Value: Shape(e.Value)}
+		}
+		return shape
+	case A:
+		if len(v) == 0 {
+			return A{}
+		}
+		return A{Shape(v[0])}
+	}
+	return typeName(v)
+}
+
+// decoder 解析 bson 数据不足时记录错误
+type decoder struct {
+	b   []byte
+	err error
+}
+
+func (d *decoder) next(n int) []byte {
+	if d.err != nil || n < 0 || len(d.b) < n {
+		d.err = ErrMalformBSON
+		return nil
+	}
+	data := d.b[:n]
+	d.b = d.b[n:]
+	return data
+}
+
+func (d *decoder) byte() byte {
+	if data := d.next(1); data != nil {
+		return data[0]
+	}
+	return 0
+}
+
+func (d *decoder) int32() int32 {
+	if data := d.next(4); data != nil {
+		return int32(binary.LittleEndian.Uint32(data))
+	}
+	return 0
+}
+
+func (d *decoder) int64() int64 {
+	if data := d.next(8); data != nil {
+		return int64(binary.LittleEndian.Uint64(data))
+	}
+	return 0
+}
+
+func (d *decoder) cstring() string {
+	if d.err != nil {
+		return ""
+	}
+	i := bytes.IndexByte(d.b, 0)
+	if i < 0 {
+		d.err = ErrMalformBSON
+		return ""
+	}
+	s := string(d.b[:i])
+	d.b = d.b[i+1:]
+	return s
+}
+
+// string 长度包括结尾的 0
+func (d *decoder) string() string {
+	n := int(d.int32())
+	data := d.next(n)
+	if len(data) == 0 {
+		if d.err == nil {
+			d.err = ErrMalformBSON
+		}
+		return ""
+	}
+	return truncate(string(data[:n-1]))
+}
+
+func truncate(s string) string {
+	if len(s) > maxString {
+		return s[:maxString] + "..."
+	}
+	return s
+}
+
+// document 解析一个文档 返回的 D 不引用原始数据
+func (d *decoder) document(depth int) D {
+	if depth > maxDepth {
+		d.err = ErrMalformBSON
+		return nil
+	}
+	n := int(d.int32())
+	body := d.next(n - 4)
+	if d.err != nil {
+		return nil
+	}
+	inner := &decoder{b: body}
+	doc := D{}
+	for inner.err == nil {
+		typ := inner.byte()
+		if typ == 0 {
+			break
+		}
+		key := inner.cstring()
+		doc = append(doc, E{Key: key, Value: inner.value(typ, depth)})
+	}
+	d.err = inner.err
+	return doc
+}
+
+func (d *decoder) value(typ byte, depth int) interface{} {
+	switch typ {
+	case bsonDouble:
+		f := math.Float64frombits(uint64(d.int64()))
+		// json 不能表示 NaN 和 Infinity
+		switch {
+		case math.IsNaN(f):
+			return &Ext{Type: "double", Value: map[string]string{"$numberDouble": "NaN"}}
+		case math.IsInf(f, 1):
+			return &Ext{Type: "double", Value: map[string]string{"$numberDouble": "Infinity"}}
+		case math.IsInf(f, -1):
+			return &Ext{Type: "double", Value: map[string]string{"$numberDouble": "-Infinity"}}
+		}
+		return f
+	case bsonString:
+		return d.string()
+	case bsonDocument:
+		return d.document(depth + 1)
+	case bsonArray:
+		doc := d.document(depth + 1)
+		arr := make(A, len(doc))
+		for i, e := range doc {
+			arr[i] = e.Value
+		}
+		return arr
+	case bsonBinary:
+		n := int(d.int32())
+		sub := d.byte()
+		data := d.next(n)
+		// 只有 uuid 这种短的数据输出内容
+		val := map[string]interface{}{"subType": fmt.Sprintf("%02x", sub), "size": n}
+		if n <= 16 {
+			val["base64"] = base64.StdEncoding.EncodeToString(data)
+		}
+		return &Ext{Type: "binData", Value: map[string]interface{}{"$binary": val}}
+	case bsonUndefined:
+		return &Ext{Type: "undefined", Value: map[string]bool{"$undefined": true}}
+	case bsonObjectID:
+		return &Ext{Type: "objectId", Value: map[string]string{"$oid": hex.EncodeToString(d.next(12))}}
+	case bsonBool:
+		return d.byte() != 0
+	case bsonDateTime:
+		ms := d.int64()
+		date := time.Unix(ms/1000, ms%1000*int64(time.Millisecond)).UTC().Format(time.RFC3339Nano)
+		return &Ext{Type: "date", Value: map[string]string{"$date": date}}
+	case bsonNull:
+		return nil
+	case bsonRegex:
+		re := map[string]string{"pattern": d.cstring(), "options": d.cstring()}
+		return &Ext{Type: "regex", Value: map[string]interface{}{"$regularExpression": re}}
+	case bsonDBPointer:
+		ref := d.string()
+		id := hex.EncodeToString(d.next(12))
+		return &Ext{Type: "dbPointer", Value: map[string]interface{}{"$dbPointer": map[string]string{"$ref": ref, "$id": id}}}
+	case bsonJavaScript:
+		return &Ext{Type: "javascript", Value: map[string]string{"$code": d.string()}}
+	case bsonSymbol:
+		return &Ext{Type: "symbol", Value: map[string]string{"$symbol": d.string()}}
+	case bsonCodeScope:
+		d.int32()
+		code := d.string()
+		scope := d.document(depth + 1)
+		return &Ext{Type: "javascriptWithScope", Value: map[string]interface{}{"$code": code, "$scope": scope}}
+	case bsonInt32:
+		return d.int32()
+	case bsonTimestamp:
+		inc, t := uint32(d.int32()), uint32(d.int32())
+		return &Ext{Type: "timestamp", Value: map[string]interface{}{"$timestamp": map[string]uint32{"t": t, "i": inc}}}
+	case bsonInt64:
+		return d.int64()
+	case bsonDecimal:
+		lo, hi := uint64(d.int64()), uint64(d.int64())
+		return &Ext{Type: "decimal", Value: map[string]string{"$numberDecimal": decimal128(hi, lo)}}
+	case bsonMinKey:
+		return &Ext{Type: "minKey", Value: map[string]int{"$minKey": 1}}
+	case bsonMaxKey:
+		return &Ext{Type: "maxKey", Value: map[string]int{"$maxKey": 1}}
+	}
+	d.err = fmt.Errorf("%w: unknown type 0x%02x", ErrMalformBSON, typ)
+	return nil
+}
+
+// decimal128 IEEE 754-2008 decimal128 转换成字符串
+func decimal128(hi, lo uint64) string {
+	sign := ""
+	if hi>>63 == 1 {
+		sign = "-"
+	}
+	switch (hi >> 58) & 0x1f {
+	case 0x1e:
+		return sign + "Infinity"
+	case 0x1f:
+		return "NaN"
+	}
+
+	var exp int
+	var coef big.Int
+	if (hi>>61)&3 == 3 {
+		// 这种编码的系数超过 10^34 按照 0 处理
+		exp = int((hi>>47)&0x3fff) - 6176
+	} else {
+		exp = int((hi>>49)&0x3fff) - 6176
+		coef.SetUint64(hi & 0x1ffffffffffff)
+		coef.Lsh(&coef, 64)
+		coef.Or(&coef, new(big.Int).SetUint64(lo))
+	}
+
+	digits := coef.String()
+	switch {
+	case exp == 0:
+		return sign + digits
+	case exp > 0:
+		return sign + digits + "E+" + fmt.Sprint(exp)
+	case -exp < len(digits):
+		point := len(digits) + exp
+		return sign + digits[:point] + "." + digits[point:]
+	case -exp-len(digits) < 6:
+		return sign + "0." + strings.Repeat("0", -exp-len(digits)) + digits
+	}
+	return sign + digits + "E" + fmt.Sprint(exp)
+}
+
+// parseDocument 解析一个完整的文档
+func parseDocument(b []byte) (D, error) {
+	d := &decoder{b: b}
+	doc := d.document(0)
+	return doc, d.err
+}
@@ -0,0 +1,514 @@
+package mongo
+
+import (
+	"bufio"
+	"encoding/binary"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Salpadding/l7dump/core"
+)
+
+var (
+	_ core.ProtocolTracker     = (*Tracker)(nil)
+	_ core.ProtocolConnTracker = (*ConnTracker)(nil)
+)
+
+// Request 客户端发送的命令
+type Request struct {
+	OpCode     string `json:"op_code"`
+	Command    string `json:"command"`
+	Database   string `json:"database,omitempty"`
+	Collection string `json:"collection,omitempty"`
+	// Filter Pipeline 只保留结构 值替换成类型
+	Filter   interface{} `json:"filter,omitempty"`
+	Pipeline interface{} `json:"pipeline,omitempty"`
+	// Documents insert update delete 的文档或者语句数
+	Documents int `json:"documents,omitempty"`
+	Body      D   `json:"body,omitempty"`
+}
+
+// Response 命令的结果
+type Response struct {
+	OpCode   string `json:"op_code"`
+	OK       bool   `json:"ok"`
+	ErrMsg   string `json:"errmsg,omitempty"`
+	Code     int64  `json:"code,omitempty"`
+	CodeName string `json:"code_name,omitempty"`
+	// N 返回的文档数 或者写操作影响的文档数
+	N        int   `json:"n,omitempty"`
+	CursorID int64 `json:"cursor_id,omitempty"`
+}
+
+// toInt bson 中的数字可能是 int32 int64 或者 double
+func toInt(v interface{}) (int64, bool) {
+	switch v := v.(type) {
+	case int32:
+		return int64(v), true
+	case int64:
+		return v, true
+	case float64:
+		return int64(v), true
+	case bool:
+		if v {
+			return 1, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+func toString(v interface{}) string {
+	s, _ := v.(string)
+	return s
+}
+
+// statements update delete 的语句可能在 body 中 也可能在文档序列中
+func statements(body D, seqs map[string][]D, key string) []D {
+	if docs, ok := seqs[key]; ok {
+		return docs
+	}
+	arr, _ := body.Get(key).(A)
+	docs := make([]D, 0, len(arr))
+	for _, v := range arr {
+		if doc, ok := v.(D); ok {
+			docs = append(docs, doc)
+		}
+	}
+	return docs
+}
+
+// newCommand 从命令文档中提取命令名 集合 和查询条件
+func newCommand(req *Request, body D, seqs map[string][]D) {
+	req.Body = body
+	if len(body) == 0 {
+		return
+	}
+	req.Command = body[0].Key
+	if db := toString(body.Get("$db")); db != "" {
+		req.Database = db
+	}
+	req.Collection = toString(body[0].Value)
+
+	switch strings.ToLower(req.Command) {
+	case "getmore":
+		req.Collection = toString(body.Get("collection"))
+	case "insert":
+		req.Documents = len(statements(body, seqs, "documents"))
+	case "update", "delete":
+		stmts := statements(body, seqs, strings.ToLower(req.Command)+"s")
+		req.Documents = len(stmts)
+		if len(stmts) > 0 {
+			req.Filter = Shape(stmts[0].Get("q"))
+		}
+	case "aggregate":
+		req.Pipeline = Shape(body.Get("pipeline"))
+	}
+	if req.Filter == nil {
+		if filter := body.Get("filter"); filter != nil {
+			req.Filter = Shape(filter)
+		} else if query := body.Get("query"); query != nil {
+			req.Filter = Shape(query)
+		}
+	}
+}
+
+// newResult 解析命令的返回文档
+func newResult(resp *Response, doc D) {
+	ok, _ := toInt(doc.Get("ok"))
+	resp.OK = ok == 1
+	resp.ErrMsg = toString(doc.Get("errmsg"))
+	resp.Code, _ = toInt(doc.Get("code"))
+	resp.CodeName = toString(doc.Get("codeName"))
+
+	// 写操作的错误不会让 ok 变成 0
+	if errs, _ := doc.Get("writeErrors").(A); len(errs) > 0 {
+		if e, ok := errs[0].(D); ok {
+			resp.OK = false
+			resp.ErrMsg = toString(e.Get("errmsg"))
+			resp.Code, _ = toInt(e.Get("code"))
+		}
+	}
+	if e, ok := doc.Get("writeConcernError").(D); ok && resp.ErrMsg == "" {
+		resp.OK = false
+		resp.ErrMsg = toString(e.Get("errmsg"))
+		resp.Code, _ = toInt(e.Get("code"))
+	}
+
+	if cursor, ok := doc.Get("cursor").(D); ok {
+		resp.CursorID, _ = toInt(cursor.Get("id"))
+		batch, ok := cursor.Get("firstBatch").(A)
+		if !ok {
+			batch, _ = cursor.Get("nextBatch").(A)
+		}
+		resp.N = len(batch)
+	} else if n, ok := toInt(doc.Get("n")); ok {
+		resp.N = int(n)
+	}
+}
+
+type ConnTracker struct {
+	meta       *core.ConnMeta
+	tracker    *Tracker
+	reqStream  *core.Stream
+	respStream *core.Stream
+	reqBuf     *bufio.Reader
+	respBuf    *bufio.Reader
+
+	// pending 用 requestID 找到响应对应的请求
+	mtx     sync.Mutex
+	pending map[int32]*core.Event
+
+	// reqGap respGap 丢包之后需要重新同步 分别只在请求和响应的协程中使用
+	reqGap  bool
+	respGap bool
+}
+
+func (c *ConnTracker) push(id int32, ev *core.Event) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.pending[id] = ev
+}
+
+func (c *ConnTracker) has(id int32) bool {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	_, ok := c.pending[id]
+	return ok
+}
+
+func (c *ConnTracker) pop(id int32) *core.Event {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	ev := c.pending[id]
+	delete(c.pending, id)
+	return ev
+}
+
+// decodeReq 解码 OP_MSG OP_QUERY 和其他旧版本的消息
+func (c *ConnTracker) decodeReq() (interface{}, error) {
+	if c.reqGap {
+		skipped, err := core.Resync(c.reqBuf, matchRequest)
+		if err != nil {
+			return nil, err
+		}
+		c.reqGap = false
+		log.Printf("mongodb %s: request resynced, skipped %d bytes", c.meta, skipped)
+	}
+	if _, err := c.reqBuf.Peek(1); err != nil {
+		if err == core.ErrDataLost {
+			c.reqGap = true
+			return nil, nil
+		}
+		return nil, err
+	}
+	reqTime := c.reqStream.Seen()
+	gaps := c.reqStream.Gaps()
+	msg, err := readMessage(c.reqBuf)
+	if err != nil && c.reqStream.Gaps() > gaps {
+		c.reqGap = true
+		c.lostReq(msg, reqTime)
+		return nil, nil
+	}
+	if err != nil && err != ErrTooLarge {
+		return nil, err
+	}
+
+	ev := core.NewEvent(c.meta, "mongodb")
+	ev.ReqTime = reqTime
+	ev.ReqSize = msg.size
+	req := &Request{}
+	ev.Request = req
+	if err == nil && msg.opCode == opCompressed {
+		err = msg.decompress()
+	}
+	req.OpCode = opName(msg.opCode)
+
+	// noReply 服务端不会返回响应
+	var noReply bool
+	if err == nil {
+		switch msg.opCode {
+		case opMsg:
+			var m *opMessage
+			m, err = parseMsg(msg.body)
+			newCommand(req, m.body, m.sequences)
+			noReply = m.flags&flagMoreToCome != 0
+		case opQuery:
+			var q *opQueryMessage
+			q, err = parseQuery(msg.body)
+			c.legacyQuery(req, q)
+		case opInsert, opUpdate, opDelete, opKillCursor:
+			noReply = true
+			fallthrough
+		default:
+			req.Command = req.OpCode
+			if msg.opCode != opKillCursor {
+				d := &decoder{b: msg.body}
+				d.int32()
+				req.Collection = d.cstring()
+			}
+		}
+	}
+	if err != nil {
+		ev.Error = err.Error()
+	}
+	if req.Command == "" {
+		req.Command = req.OpCode
+	}
+	ev.Op = req.Command
+
+	if noReply {
+		ev.Status = "NO_REPLY"
+		core.Emit(c.tracker.Sink, ev)
+		return req, nil
+	}
+	c.push(msg.requestID, ev)
+	return req, nil
+}
+
+// lostReq 请求有数据丢失 读到了消息头时等待响应
+func (c *ConnTracker) lostReq(msg message, reqTime time.Time) {
+	if msg.size == 0 {
+		return
+	}
+	ev := core.NewEvent(c.meta, "mongodb")
+	ev.Op = opName(msg.opCode)
+	ev.ReqTime = reqTime
+	ev.ReqSize = msg.size
+	ev.Request = &Request{OpCode: ev.Op, Command: ev.Op}
+	ev.Incomplete = true
+	c.push(msg.requestID, ev)
+}
+
+// legacyQuery OP_QUERY 查询 db.$cmd 时是命令 否则是旧版本的查询
+func (c *ConnTracker) legacyQuery(req *Request, q *opQueryMessage) {
+	db, coll := q.collection, ""
+	if i := strings.IndexByte(q.collection, '.'); i >= 0 {
+		db, coll = q.collection[:i], q.collection[i+1:]
+	}
+	// 查询条件可能包在 $query 中
+	body := q.query
+	if inner, ok := body.Get("$query").(D); ok {
+		body = inner
+	}
+	if coll == "$cmd" {
+		newCommand(req, body, nil)
+		req.Database = db
+		return
+	}
+	req.Command = "query"
+	req.Database = db
+	req.Collection = coll
+	req.Filter = Shape(body)
+	req.Body = q.query
+}
+
+// decodeResp 通过 responseTo 找到对应的请求
+func (c *ConnTracker) decodeResp() (interface{}, error) {
+	if c.respGap {
+		skipped, err := core.Resync(c.respBuf, c.matchResponse)
+		if err != nil {
+			return nil, err
+		}
+		c.respGap = false
+		log.Printf("mongodb %s: response resynced, skipped %d bytes", c.meta, skipped)
+	}
+	if _, err := c.respBuf.Peek(1); err != nil {
+		if err == core.ErrDataLost {
+			c.respGap = true
+			return nil, nil
+		}
+		return nil, err
+	}
+	gaps := c.respStream.Gaps()
+	msg, err := readMessage(c.respBuf)
+	if err != nil && c.respStream.Gaps() > gaps {
+		c.respGap = true
+		c.lostResp(msg)
+		return nil, nil
+	}
+	if err != nil && err != ErrTooLarge {
+		return nil, err
+	}
+
+	ev := c.pop(msg.responseTo)
+	if ev == nil {
+		// 没有看到请求 例如抓包开始时已经发出的请求
+		ev = core.NewEvent(c.meta, "mongodb")
+		ev.Op = "unknown"
+	}
+	resp := &Response{}
+	if err == nil && msg.opCode == opCompressed {
+		err = msg.decompress()
+	}
+	resp.OpCode = opName(msg.opCode)
+
+	var moreToCome bool
+	if err == nil {
+		switch msg.opCode {
+		case opMsg:
+			var m *opMessage
+			m, err = parseMsg(msg.body)
+			newResult(resp, m.body)
+			moreToCome = m.flags&flagMoreToCome != 0
+		case opReply:
+			var r *opReplyMessage
+			r, err = parseReply(msg.body)
+			c.legacyReply(ev, resp, r)
+		default:
+			resp.OK = true
+		}
+	}
+
+	ev.Done(c.respStream.Seen())
+	ev.RespSize = msg.size
+	switch {
+	case err != nil:
+		ev.Status = "error"
+		ev.Error = err.Error()
+	case resp.OK:
+		ev.Status = "ok"
+	default:
+		ev.Status = resp.CodeName
+		if ev.Status == "" {
+			ev.Status = "error"
+		}
+		ev.Error = resp.ErrMsg
+	}
+	ev.Response = resp
+
+	// exhaust cursor 下一个响应的 responseTo 是这个响应的 requestID
+	if moreToCome {
+		next := *ev
+		next.Response = nil
+		next.Status = ""
+		next.Error = ""
+		c.push(msg.requestID, &next)
+	}
+	core.Emit(c.tracker.Sink, ev)
+	return resp, nil
+}
+
+// lostResp 响应有数据丢失 读到了消息头时输出请求
+func (c *ConnTracker) lostResp(msg message) {
+	if msg.size == 0 {
+		return
+	}
+	ev := c.pop(msg.responseTo)
+	if ev == nil {
+		return
+	}
+	ev.Done(c.respStream.Seen())
+	ev.RespSize = msg.size
+	ev.Status = "error"
+	ev.Error = core.ErrDataLost.Error()
+	ev.Incomplete = true
+	core.Emit(c.tracker.Sink, ev)
+}
+
+// matchResponse 响应的 responseTo 对应一个已经发出的请求
+func (c *ConnTracker) matchResponse(data []byte) core.ProbeResult {
+	if len(data) < headerSize {
+		return core.ProbeMore
+	}
+	size := int(int32(binary.LittleEndian.Uint32(data)))
+	if size <= headerSize || size > maxMessage+headerSize {
+		return core.ProbeMismatch
+	}
+	switch binary.LittleEndian.Uint32(data[12:]) {
+	case opMsg, opReply, opCompressed:
+		if c.has(int32(binary.LittleEndian.Uint32(data[8:]))) {
+			return core.ProbeMatch
+		}
+	}
+	return core.ProbeMismatch
+}
+
+// legacyReply 命令的结果是第一个文档 查询返回所有的文档
+func (c *ConnTracker) legacyReply(ev *core.Event, resp *Response, r *opReplyMessage) {
+	resp.CursorID = r.cursorID
+	req, _ := ev.Request.(*Request)
+	switch {
+	case r.flags&replyQueryFailure != 0 && len(r.docs) > 0:
+		resp.ErrMsg = toString(r.docs[0].Get("$err"))
+		resp.Code, _ = toInt(r.docs[0].Get("code"))
+	case r.flags&replyCursorNotFound != 0:
+		resp.ErrMsg = "cursor not found"
+	case req != nil && req.OpCode == opNames[opQuery] && req.Command != "query" && len(r.docs) > 0:
+		newResult(resp, r.docs[0])
+	default:
+		resp.OK = true
+		resp.N = len(r.docs)
+	}
+}
+
+func (c *ConnTracker) OnRequest(req interface{}) error {
+	return nil
+}
+
+func (c *ConnTracker) OnResponse(resp interface{}) error {
+	return nil
+}
+
+func (c *ConnTracker) OnError(err error) {
+	log.Printf("mongodb %s: %v", c.meta, err)
+}
+
+// Tracker mongodb 协议 支持 OP_MSG 和旧版本的 OP_QUERY/OP_REPLY
+// 客户端使用 tls 时无法解码 压缩只支持 zlib
+type Tracker struct {
+	// Sink 接收每个命令和响应组成的 Event, 为空时输出到标准输出
+	Sink core.Sink
+}
+
+func (t *Tracker) RequestDecoder(stream *core.Stream, conn core.ProtocolConnTracker) func() (interface{}, error) {
+	c := conn.(*ConnTracker)
+	c.reqStream = stream
+	c.reqBuf = bufio.NewReader(stream)
+	return c.decodeReq
+}
+
+func (t *Tracker) ResponseDecoder(stream *core.Stream, conn core.ProtocolConnTracker) func() (interface{}, error) {
+	c := conn.(*ConnTracker)
+	c.respStream = stream
+	c.respBuf = bufio.NewReader(stream)
+	return c.decodeResp
+}
+
+func (t *Tracker) NewConnect(meta *core.ConnMeta) core.ProtocolConnTracker {
+	log.Printf("new mongodb connect to %s", meta.String())
+	return &ConnTracker{
+		meta:    meta,
+		tracker: t,
+		pending: make(map[int32]*core.Event),
+	}
+}
+
+func (t *Tracker) OnClose(conn core.ProtocolConnTracker, reason core.CloseReason) {
+}
+
+// Probe 客户端发送的第一个消息 responseTo 为 0
+func (t *Tracker) Probe(req, resp []byte) core.ProbeResult {
+	if len(req) == 0 && len(resp) > 0 {
+		return core.ProbeMismatch
+	}
+	return matchRequest(req)
+}
+
+func matchRequest(data []byte) core.ProbeResult {
+	if len(data) < headerSize {
+		return core.ProbeMore
+	}
+	size := int(int32(binary.LittleEndian.Uint32(data)))
+	responseTo := binary.LittleEndian.Uint32(data[8:])
+	if size <= headerSize || size > maxMessage+headerSize || responseTo != 0 {
+		return core.ProbeMismatch
+	}
+	switch binary.LittleEndian.Uint32(data[12:]) {
+	case opMsg, opQuery, opCompressed:
+		return core.ProbeMatch
+	}
+	return core.ProbeMismatch
+}
@@ -0,0 +1,275 @@
+package mongo
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"encoding/json"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/Salpadding/l7dump/core"
+	"github.com/Salpadding/l7dump/core/coretest"
+)
+
+// chunk 一个方向上的一段数据 data 为 nil 表示这个方向丢了数据
+type chunk struct {
+	fromClient bool
+	data       []byte
+}
+
+func replay(t *testing.T, chunks []chunk) []*core.Event {
+	sink := &coretest.Sink{}
+	conn := coretest.Start(&Tracker{Sink: sink}, coretest.Meta(27017))
+	for _, c := range chunks {
+		conn.Send(c.fromClient, c.data)
+	}
+	for _, err := range conn.Close() {
+		t.Error(err)
+	}
+	return sink.Events()
+}
+
+func le32(v int) []byte {
+	return binary.LittleEndian.AppendUint32(nil, uint32(v))
+}
+
+// bson 按照 key value 交替的参数构造文档
+func bson(kv ...interface{}) []byte {
+	var buf bytes.Buffer
+	for i := 0; i < len(kv); i += 2 {
+		key := kv[i].(string)
+		var typ byte
+		var data []byte
+		switch v := kv[i+1].(type) {
+		case float64:
+			typ, data = bsonDouble, binary.LittleEndian.AppendUint64(nil, math.Float64bits(v))
+		case string:
+			typ, data = bsonString, append(append(le32(len(v)+1), v...), 0)
+		case int:
+			typ, data = bsonInt32, le32(v)
+		case int64:
+			typ, data = bsonInt64, binary.LittleEndian.AppendUint64(nil, uint64(v))
+		case bool:
+			typ, data = bsonBool, []byte{0}
+			if v {
+				data[0] = 1
+			}
+		case []byte:
+			typ, data = bsonDocument, v
+		case [][]byte:
+			typ = bsonArray
+			var arr []interface{}
+			for j, elem := range v {
+				arr = append(arr, string(rune('0'+j)), elem)
+			}
+			data = bson(arr...)
+		}
+		buf.WriteByte(typ)
+		buf.WriteString(key)
+		buf.WriteByte(0)
+		buf.Write(data)
+	}
+	buf.WriteByte(0)
+	return append(le32(buf.Len()+4), buf.Bytes()...)
+}
+
+func wireMessage(requestID, responseTo, opCode int, body ...[]byte) []byte {
+	data := bytes.Join(body, nil)
+	out := le32(len(data) + headerSize)
+	out = append(out, le32(requestID)...)
+	out = append(out, le32(responseTo)...)
+	out = append(out, le32(opCode)...)
+	return append(out, data...)
+}
+
+// opMsgBody flags 加上 kind 0 的 body
+func opMsgBody(flags int, doc []byte) []byte {
+	return append(append(le32(flags), 0), doc...)
+}
+
+func TestMongo(t *testing.T) {
+	find := wireMessage(1, 0, opMsg, opMsgBody(0, bson(
+		"find", "users",
+		"filter", bson("age", bson("$gt", 18), "name", "bob"),
+		"$db", "test",
+	)))
+	findReply := wireMessage(100, 1, opMsg, opMsgBody(0, bson(
+		"cursor", bson("firstBatch", [][]byte{bson("name", "bob"), bson("name", "bob")}, "id", int64(7), "ns", "test.users"),
+		"ok", 1.0,
+	)))
+
+	// insert 的文档在 kind 1 的文档序列中
+	docs := append(bson("_id", 1), bson("_id", 2)...)
+	seq := append(le32(4+len("documents")+1+len(docs)), "documents\x00"...)
+	insert := wireMessage(2, 0, opMsg, opMsgBody(0, bson("insert", "users", "$db", "test")), []byte{1}, seq, docs)
+	insertReply := wireMessage(101, 2, opMsg, opMsgBody(0, bson(
+		"n", 1,
+		"writeErrors", [][]byte{bson("index", 1, "code", 11000, "errmsg", "E11000 duplicate key error")},
+		"ok", 1.0,
+	)))
+
+	// moreToCome 的请求没有响应
+	unack := wireMessage(3, 0, opMsg, opMsgBody(flagMoreToCome, bson(
+		"delete", "users",
+		"deletes", [][]byte{bson("q", bson("name", "bob"), "limit", 0)},
+		"$db", "test",
+	)))
+
+	hello := wireMessage(4, 0, opQuery, le32(0), []byte("admin.$cmd\x00"), le32(0), le32(-1), bson("isMaster", 1))
+	helloReply := wireMessage(102, 4, opReply, le32(0), make([]byte, 8), le32(0), le32(1), bson("ismaster", true, "ok", 1.0))
+
+	// zlib 压缩的 aggregate 出错
+	aggregate := opMsgBody(0, bson(
+		"aggregate", "orders",
+		"pipeline", [][]byte{bson("$match", bson("status", "A"))},
+		"$db", "shop",
+	))
+	var zbuf bytes.Buffer
+	zw := zlib.NewWriter(&zbuf)
+	zw.Write(aggregate)
+	zw.Close()
+	compressed := wireMessage(5, 0, opCompressed, le32(opMsg), le32(len(aggregate)), []byte{compressorZlib}, zbuf.Bytes())
+	aggregateReply := wireMessage(103, 5, opMsg, opMsgBody(0, bson(
+		"ok", 0.0, "errmsg", "ns does not exist", "code", 26, "codeName", "NamespaceNotFound",
+	)))
+
+	events := replay(t, []chunk{
+		{true, find},
+		{false, findReply},
+		{true, insert},
+		{false, insertReply},
+		{true, unack},
+		{true, hello},
+		{true, compressed},
+		// 响应的顺序可以和请求不同
+		{false, aggregateReply},
+		{false, helloReply},
+	})
+	if len(events) != 5 {
+		t.Fatalf("expect 5 events, got %d", len(events))
+	}
+
+	ev := events[0]
+	req := ev.Request.(*Request)
+	resp := ev.Response.(*Response)
+	if ev.Op != "find" || ev.Status != "ok" || ev.Latency != time.Millisecond {
+		t.Errorf("unexpected find event %v", ev)
+	}
+	if req.Database != "test" || req.Collection != "users" || resp.N != 2 || resp.CursorID != 7 {
+		t.Errorf("unexpected find %+v %+v", req, resp)
+	}
+	filter, _ := json.Marshal(req.Filter)
+	if string(filter) != `{"age":{"$gt":"int"},"name":"string"}` {
+		t.Errorf("unexpected filter shape %s", filter)
+	}
+
+	ev = events[1]
+	if ev.Op != "insert" || ev.Status != "error" || ev.Error != "E11000 duplicate key error" {
+		t.Errorf("unexpected insert event %v", ev)
+	}
+	if req := ev.Request.(*Request); req.Documents != 2 {
+		t.Errorf("unexpected insert documents %d", req.Documents)
+	}
+
+	ev = events[2]
+	if ev.Op != "delete" || ev.Status != "NO_REPLY" || ev.Request.(*Request).Documents != 1 {
+		t.Errorf("unexpected delete event %v", ev)
+	}
+
+	ev = events[3]
+	req = ev.Request.(*Request)
+	if ev.Op != "aggregate" || ev.Status != "NamespaceNotFound" || ev.Error != "ns does not exist" {
+		t.Errorf("unexpected aggregate event %v", ev)
+	}
+	pipeline, _ := json.Marshal(req.Pipeline)
+	if req.OpCode != "OP_MSG" || string(pipeline) != `[{"$match":{"status":"string"}}]` {
+		t.Errorf("unexpected aggregate %+v %s", req, pipeline)
+	}
+
+	ev = events[4]
+	req = ev.Request.(*Request)
+	if ev.Op != "isMaster" || ev.Status != "ok" || req.Database != "admin" || req.OpCode != "OP_QUERY" {
+		t.Errorf("unexpected isMaster event %v %+v", ev, req)
+	}
+}
+
+func TestDataLost(t *testing.T) {
+	ping := func(id int) []byte {
+		return wireMessage(id, 0, opMsg, opMsgBody(0, bson("ping", 1, "$db", "admin")))
+	}
+	pong := func(id, responseTo int) []byte {
+		return wireMessage(id, responseTo, opMsg, opMsgBody(0, bson("ok", 1.0)))
+	}
+	first, lost := ping(1), pong(101, 2)
+
+	events := replay(t, []chunk{
+		// 请求的后半部分丢了
+		{true, first[:30]},
+		{true, nil},
+		{true, append(first[40:], ping(2)...)},
+		{false, pong(100, 1)},
+		// 响应的后半部分丢了
+		{false, lost[:20]},
+		{false, nil},
+		{true, ping(3)},
+		{false, append(lost[24:], pong(102, 3)...)},
+	})
+
+	if len(events) != 3 {
+		t.Fatalf("expect 3 events, got %v", events)
+	}
+	if ev := events[0]; ev.Op != "OP_MSG" || !ev.Incomplete || ev.Status != "ok" {
+		t.Fatalf("unexpected event %v", ev)
+	}
+	if ev := events[1]; ev.Op != "ping" || !ev.Incomplete || ev.Error != core.ErrDataLost.Error() {
+		t.Fatalf("unexpected event %v", ev)
+	}
+	if ev := events[2]; ev.Op != "ping" || ev.Incomplete || ev.Status != "ok" {
+		t.Fatalf("unexpected event %v", ev)
+	}
+}
+
+func TestBSON(t *testing.T) {
+	doc, err := parseDocument(bson("a", 1, "b", bson("c", "x"), "d", [][]byte{bson("e", true)}, "f", int64(-2)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, _ := json.Marshal(doc)
+	if string(out) != `{"a":1,"b":{"c":"x"},"d":[{"e":true}],"f":-2}` {
+		t.Errorf("unexpected json %s", out)
+	}
+
+	// 例如 {$lt: Infinity}
+	doc, err = parseDocument(bson("a", 1.5, "b", math.NaN(), "c", math.Inf(1), "d", math.Inf(-1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err = json.Marshal(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != `{"a":1.5,"b":{"$numberDouble":"NaN"},"c":{"$numberDouble":"Infinity"},"d":{"$numberDouble":"-Infinity"}}` {
+		t.Errorf("unexpected json %s", out)
+	}
+
+	for _, c := range []struct {
+		hi, lo uint64
+		expect string
+	}{
+		{0x3040000000000000, 1, "1"},
+		{0x303e000000000000, 15, "1.5"},
+		{0xb03a000000000000, 5, "-0.005"},
+		{0x3042000000000000, 3, "3E+1"},
+		{0x7800000000000000, 0, "Infinity"},
+	} {
+		if s := decimal128(c.hi, c.lo); s != c.expect {
+			t.Errorf("decimal128 %x %x expect %s got %s", c.hi, c.lo, c.expect, s)
+		}
+	}
+
+	if _, err := parseDocument(bson("a", "x")[:8]); err == nil {
+		t.Error("expect error for truncated document")
+	}
+}
@@ -0,0 +1,221 @@
+package mongo
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// https://www.mongodb.com/docs/manual/reference/mongodb-wire-protocol/
+const (
+	opReply      = 1
+	opUpdate     = 2001
+	opInsert     = 2002
+	opQuery      = 2004
+	opGetMore    = 2005
+	opDelete     = 2006
+	opKillCursor = 2007
+	opCompressed = 2012
+	opMsg        = 2013
+)
+
+var opNames = map[int32]string{
+	opReply:      "OP_REPLY",
+	opUpdate:     "OP_UPDATE",
+	opInsert:     "OP_INSERT",
+	opQuery:      "OP_QUERY",
+	opGetMore:    "OP_GET_MORE",
+	opDelete:     "OP_DELETE",
+	opKillCursor: "OP_KILL_CURSORS",
+	opCompressed: "OP_COMPRESSED",
+	opMsg:        "OP_MSG",
+}
+
+func opName(code int32) string {
+	if name, ok := opNames[code]; ok {
+		return name
+	}
+	return fmt.Sprintf("OP_%d", code)
+}
+
+// OP_MSG 的 flag
+const (
+	flagChecksumPresent = 1 << 0
+	flagMoreToCome      = 1 << 1
+)
+
+// OP_REPLY 的 flag
+const (
+	replyCursorNotFound = 1 << 0
+	replyQueryFailure   = 1 << 1
+)
+
+// 压缩算法
+const (
+	compressorNoop   = 0
+	compressorSnappy = 1
+	compressorZlib   = 2
+	compressorZstd   = 3
+)
+
+const (
+	headerSize = 16
+	// maxMessage 服务端允许的最大消息是 48MB
+	maxMessage = 48 << 20
+)
+
+var (
+	ErrMalformMsg = errors.New("malformed mongodb message")
+	ErrTooLarge   = errors.New("mongodb message too large")
+)
+
+// message 一个完整的消息
+type message struct {
+	size       int
+	requestID  int32
+	responseTo int32
+	opCode     int32
+	body       []byte
+}
+
+func readMessage(r *bufio.Reader) (msg message, err error) {
+	var hdr [headerSize]byte
+	if _, err = io.ReadFull(r, hdr[:]); err != nil {
+		return
+	}
+	msg.size = int(int32(binary.LittleEndian.Uint32(hdr[:])))
+	msg.requestID = int32(binary.LittleEndian.Uint32(hdr[4:]))
+	msg.responseTo = int32(binary.LittleEndian.Uint32(hdr[8:]))
+	msg.opCode = int32(binary.LittleEndian.Uint32(hdr[12:]))
+	if msg.size < headerSize {
+		return msg, ErrMalformMsg
+	}
+	n := msg.size - headerSize
+	if n > maxMessage {
+		_, err = r.Discard(n)
+		if err == nil {
+			err = ErrTooLarge
+		}
+		return
+	}
+	msg.body = make([]byte, n)
+	_, err = io.ReadFull(r, msg.body)
+	return
+}
+
+// decompress 解开 OP_COMPRESSED 只支持 zlib
+func (msg *message) decompress() error {
+	d := &decoder{b: msg.body}
+	op := d.int32()
+	size := int(d.int32())
+	compressor := d.byte()
+	if d.err != nil || size < 0 || size > maxMessage {
+		return ErrMalformMsg
+	}
+	var body []byte
+	switch compressor {
+	case compressorNoop:
+		body = d.b
+	case compressorZlib:
+		zr, err := zlib.NewReader(bytes.NewReader(d.b))
+		if err != nil {
+			return err
+		}
+		body = make([]byte, size)
+		if _, err = io.ReadFull(zr, body); err != nil {
+			return err
+		}
+	case compressorSnappy:
+		return errors.New("unsupported compressor snappy")
+	case compressorZstd:
+		return errors.New("unsupported compressor zstd")
+	default:
+		return fmt.Errorf("unknown compressor %d", compressor)
+	}
+	msg.opCode = op
+	msg.body = body
+	return nil
+}
+
+// opMessage OP_MSG 的内容
+// sequences 是 kind 1 的文档序列 例如 insert 的 documents
+type opMessage struct {
+	flags     uint32
+	body      D
+	sequences map[string][]D
+}
+
+func parseMsg(b []byte) (*opMessage, error) {
+	d := &decoder{b: b}
+	m := &opMessage{flags: uint32(d.int32())}
+	if m.flags&flagChecksumPresent != 0 && len(d.b) >= 4 {
+		d.b = d.b[:len(d.b)-4]
+	}
+	for d.err == nil && len(d.b) > 0 {
+		switch kind := d.byte(); kind {
+		case 0:
+			m.body = d.document(0)
+		case 1:
+			n := int(d.int32())
+			seq := &decoder{b: d.next(n - 4)}
+			if d.err != nil {
+				break
+			}
+			id := seq.cstring()
+			var docs []D
+			for seq.err == nil && len(seq.b) > 0 {
+				docs = append(docs, seq.document(0))
+			}
+			if m.sequences == nil {
+				m.sequences = make(map[string][]D)
+			}
+			m.sequences[id] = docs
+			d.err = seq.err
+		default:
+			d.err = fmt.Errorf("%w: unknown section kind %d", ErrMalformMsg, kind)
+		}
+	}
+	return m, d.err
+}
+
+// opQueryMessage 旧版本的 OP_QUERY
+type opQueryMessage struct {
+	collection string
+	skip       int32
+	limit      int32
+	query      D
+}
+
+func parseQuery(b []byte) (*opQueryMessage, error) {
+	d := &decoder{b: b}
+	d.int32()
+	q := &opQueryMessage{
+		collection: d.cstring(),
+		skip:       d.int32(),
+		limit:      d.int32(),
+	}
+	q.query = d.document(0)
+	return q, d.err
+}
+
+// opReplyMessage 旧版本的 OP_REPLY
+type opReplyMessage struct {
+	flags    int32
+	cursorID int64
+	docs     []D
+}
+
+func parseReply(b []byte) (*opReplyMessage, error) {
+	d := &decoder{b: b}
+	r := &opReplyMessage{flags: d.int32(), cursorID: d.int64()}
+	d.int32()
+	n := int(d.int32())
+	for i := 0; i < n && d.err == nil; i++ {
+		r.docs = append(r.docs, d.document(0))
+	}
+	return r, d.err
+}
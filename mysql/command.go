@@ -0,0 +1,430 @@
+package mysql
+
+import "fmt"
+
+var (
+	_ Command = (*Quit)(nil)
+	_ Command = (*InitDB)(nil)
+	_ Command = (*Query)(nil)
+	_ Command = (*FieldList)(nil)
+	_ Command = (*Statistics)(nil)
+	_ Command = (*ProcessKill)(nil)
+	_ Command = (*Ping)(nil)
+	_ Command = (*ChangeUser)(nil)
+	_ Command = (*StmtPrepare)(nil)
+	_ Command = (*StmtExecute)(nil)
+	_ Command = (*StmtSendLongData)(nil)
+	_ Command = (*StmtClose)(nil)
+	_ Command = (*StmtReset)(nil)
+	_ Command = (*SetOption)(nil)
+	_ Command = (*StmtFetch)(nil)
+	_ Command = (*UnknownCommand)(nil)
+)
+
+// Command 客户端在命令阶段发送的请求
+// 第一个字节 (命令类型) 已经被读取 decode 只解析剩下的部分
+// https://dev.mysql.com/doc/dev/mysql-server/latest/page_protocol_command_phase.html
+type Command interface {
+	Type() string
+	decode(p *Parser, c *ConnTracker) error
+}
+
+// newCommand 根据命令类型创建对应的请求
+func newCommand(cmd byte) Command {
+	switch cmd {
+	case comQuit:
+		return &Quit{}
+	case comInitDB:
+		return &InitDB{}
+	case comQuery:
+		return &Query{}
+	case comFieldList:
+		return &FieldList{}
+	case comStatistics:
+		return &Statistics{}
+	case comProcessKill:
+		return &ProcessKill{}
+	case comPing:
+		return &Ping{}
+	case comChangeUser:
+		return &ChangeUser{}
+	case comStmtPrepare:
+		return &StmtPrepare{}
+	case comStmtExecute:
+		return &StmtExecute{}
+	case comStmtSendLongData:
+		return &StmtSendLongData{}
+	case comStmtClose:
+		return &StmtClose{}
+	case comStmtReset:
+		return &StmtReset{}
+	case comSetOption:
+		return &SetOption{}
+	case comStmtFetch:
+		return &StmtFetch{}
+	}
+	return &UnknownCommand{Cmd: cmd}
+}
+
+// hasResponse 服务端不会响应 COM_QUIT COM_STMT_CLOSE COM_STMT_SEND_LONG_DATA
+func hasResponse(cmd Command) bool {
+	switch cmd.(type) {
+	case *Quit, *StmtClose, *StmtSendLongData:
+		return false
+	}
+	return true
+}
+
+// Quit COM_QUIT
+type Quit struct{}
+
+func (q *Quit) Type() string {
+	return "COM_QUIT"
+}
+
+func (q *Quit) decode(p *Parser, c *ConnTracker) error {
+	return nil
+}
+
+// InitDB COM_INIT_DB 切换默认数据库
+type InitDB struct {
+	Schema string `json:"schema"`
+}
+
+func (i *InitDB) Type() string {
+	return "COM_INIT_DB"
+}
+
+func (i *InitDB) decode(p *Parser, c *ConnTracker) (err error) {
+	i.Schema, err = p.Rest()
+	return
+}
+
+// Query COM_QUERY 纯文本的 sql 语句
+// https://dev.mysql.com/doc/dev/mysql-server/latest/page_protocol_com_query.html
+type Query struct {
+	SQL string `json:"sql"`
+	// Attributes 开启 CLIENT_QUERY_ATTRIBUTES 之后客户端附带的属性
+	Attributes map[string]interface{} `json:"attributes,omitempty"`
+}
+
+func (q *Query) Type() string {
+	return "COM_QUERY"
+}
+
+func (q *Query) decode(p *Parser, c *ConnTracker) (err error) {
+	if c.clientCaps()&clientQueryAttributes != 0 {
+		if q.Attributes, err = p.queryAttributes(); err != nil {
+			return
+		}
+	}
+	q.SQL, err = p.Rest()
+	return
+}
+
+// queryAttributes sql 语句之前的 parameter_count parameter_set_count 和属性
+func (p *Parser) queryAttributes() (attrs map[string]interface{}, err error) {
+	var n uint64
+	if n, _, err = p.LenEncInt(); err != nil {
+		return
+	}
+	// parameter_set_count 目前总是 1
+	if _, _, err = p.LenEncInt(); err != nil {
+		return
+	}
+	if n == 0 {
+		return
+	}
+	// 每个属性至少有 2 字节的类型
+	if n > uint64(p.remaining()) {
+		return nil, ErrMalformPkt
+	}
+
+	var nullBitmap []byte
+	if nullBitmap, err = p.Bytes((int(n) + 7) / 8); err != nil {
+		return
+	}
+	var bound int
+	if bound, err = p.Byte(); err != nil {
+		return
+	}
+	// COM_QUERY 没有上一次的类型可以沿用
+	if bound != 1 {
+		return nil, ErrMalformPkt
+	}
+	var (
+		types []paramType
+		names []string
+	)
+	if types, names, err = p.paramTypes(int(n), true); err != nil {
+		return
+	}
+
+	attrs = make(map[string]interface{}, n)
+	for i := range types {
+		if nullBitmap[i/8]&(1<<(i%8)) != 0 {
+			attrs[names[i]] = nil
+			continue
+		}
+		if attrs[names[i]], err = p.binaryValue(types[i]); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// FieldList COM_FIELD_LIST 已经废弃 老版本客户端还会使用
+type FieldList struct {
+	Table    string `json:"table"`
+	Wildcard string `json:"wildcard"`
+}
+
+func (f *FieldList) Type() string {
+	return "COM_FIELD_LIST"
+}
+
+func (f *FieldList) decode(p *Parser, c *ConnTracker) (err error) {
+	if f.Table, err = p.ReadNullStr(); err != nil {
+		return
+	}
+	f.Wildcard, err = p.Rest()
+	return
+}
+
+// Statistics COM_STATISTICS
+type Statistics struct{}
+
+func (s *Statistics) Type() string {
+	return "COM_STATISTICS"
+}
+
+func (s *Statistics) decode(p *Parser, c *ConnTracker) error {
+	return nil
+}
+
+// ProcessKill COM_PROCESS_KILL
+type ProcessKill struct {
+	ConnectionID uint32 `json:"connection_id"`
+}
+
+func (k *ProcessKill) Type() string {
+	return "COM_PROCESS_KILL"
+}
+
+func (k *ProcessKill) decode(p *Parser, c *ConnTracker) (err error) {
+	k.ConnectionID, err = p.Uint32()
+	return
+}
+
+// Ping COM_PING
+type Ping struct{}
+
+func (ping *Ping) Type() string {
+	return "COM_PING"
+}
+
+func (ping *Ping) decode(p *Parser, c *ConnTracker) error {
+	return nil
+}
+
+// ChangeUser COM_CHANGE_USER
+// https://dev.mysql.com/doc/dev/mysql-server/latest/page_protocol_com_change_user.html
+type ChangeUser struct {
+	User       string `json:"user"`
+	Database   string `json:"database"`
+	Charset    uint16 `json:"charset,omitempty"`
+	AuthPlugin string `json:"auth_plugin,omitempty"`
+}
+
+func (u *ChangeUser) Type() string {
+	return "COM_CHANGE_USER"
+}
+
+func (u *ChangeUser) decode(p *Parser, c *ConnTracker) (err error) {
+	if u.User, err = p.ReadNullStr(); err != nil {
+		return
+	}
+
+	// auth-response 不记录
+	if c.clientCaps()&clientSecureConn != 0 {
+		var n int
+		if n, err = p.Byte(); err != nil {
+			return
+		}
+		if err = p.DropN(n); err != nil {
+			return
+		}
+	} else if _, err = p.ReadNullStr(); err != nil {
+		return
+	}
+
+	if u.Database, err = p.ReadNullStr(); err != nil {
+		return
+	}
+
+	// 后面的字段是可选的
+	if u.Charset, err = p.Uint16(); err != nil {
+		return nil
+	}
+	if c.clientCaps()&clientPluginAuth != 0 {
+		u.AuthPlugin, err = p.ReadNullStr()
+	}
+	return
+}
+
+// StmtPrepare COM_STMT_PREPARE
+type StmtPrepare struct {
+	Query string `json:"query"`
+}
+
+func (s *StmtPrepare) Type() string {
+	return "COM_STMT_PREPARE"
+}
+
+func (s *StmtPrepare) decode(p *Parser, c *ConnTracker) (err error) {
+	s.Query, err = p.Rest()
+	return
+}
+
+// StmtExecute COM_STMT_EXECUTE
+// https://dev.mysql.com/doc/dev/mysql-server/latest/page_protocol_com_stmt_execute.html
+type StmtExecute struct {
+	StmtID         uint32 `json:"stmt_id"`
+	Flags          byte   `json:"flags"`
+	IterationCount uint32 `json:"iteration_count"`
+	// Query 填入参数之后的语句 没有看到 COM_STMT_PREPARE 时为空
+	Query  string        `json:"query,omitempty"`
+	Params []interface{} `json:"params,omitempty"`
+	// Attributes 开启 CLIENT_QUERY_ATTRIBUTES 之后跟在参数后面的属性
+	Attributes map[string]interface{} `json:"attributes,omitempty"`
+}
+
+func (s *StmtExecute) Type() string {
+	return "COM_STMT_EXECUTE"
+}
+
+func (s *StmtExecute) decode(p *Parser, c *ConnTracker) (err error) {
+	if s.StmtID, err = p.Uint32(); err != nil {
+		return
+	}
+	var flags int
+	if flags, err = p.Byte(); err != nil {
+		return
+	}
+	s.Flags = byte(flags)
+	if s.IterationCount, err = p.Uint32(); err != nil {
+		return
+	}
+
+	stmt := c.getStmt(s.StmtID)
+	if stmt == nil {
+		return
+	}
+	if s.Params, s.Attributes, err = c.decodeParams(stmt, s.Flags, p); err != nil {
+		s.Query = stmt.Query
+		return
+	}
+	s.Query = interpolate(stmt.Query, s.Params)
+	return
+}
+
+// StmtSendLongData COM_STMT_SEND_LONG_DATA 分块发送参数 服务端不会响应
+type StmtSendLongData struct {
+	StmtID  uint32 `json:"stmt_id"`
+	ParamID uint16 `json:"param_id"`
+	Size    int    `json:"size"`
+}
+
+func (s *StmtSendLongData) Type() string {
+	return "COM_STMT_SEND_LONG_DATA"
+}
+
+func (s *StmtSendLongData) decode(p *Parser, c *ConnTracker) (err error) {
+	if s.StmtID, err = p.Uint32(); err != nil {
+		return
+	}
+	if s.ParamID, err = p.Uint16(); err != nil {
+		return
+	}
+	var data string
+	data, err = p.Rest()
+	s.Size = len(data)
+	c.addLongData(s.StmtID, s.ParamID, s.Size)
+	return
+}
+
+// StmtClose COM_STMT_CLOSE 服务端不会响应
+type StmtClose struct {
+	StmtID uint32 `json:"stmt_id"`
+}
+
+func (s *StmtClose) Type() string {
+	return "COM_STMT_CLOSE"
+}
+
+func (s *StmtClose) decode(p *Parser, c *ConnTracker) (err error) {
+	if s.StmtID, err = p.Uint32(); err != nil {
+		return
+	}
+	c.closeStmt(s.StmtID)
+	return
+}
+
+// StmtReset COM_STMT_RESET
+type StmtReset struct {
+	StmtID uint32 `json:"stmt_id"`
+}
+
+func (s *StmtReset) Type() string {
+	return "COM_STMT_RESET"
+}
+
+func (s *StmtReset) decode(p *Parser, c *ConnTracker) (err error) {
+	s.StmtID, err = p.Uint32()
+	return
+}
+
+// SetOption COM_SET_OPTION 开启或者关闭 multi statements
+type SetOption struct {
+	Option uint16 `json:"option"`
+}
+
+func (s *SetOption) Type() string {
+	return "COM_SET_OPTION"
+}
+
+func (s *SetOption) decode(p *Parser, c *ConnTracker) (err error) {
+	s.Option, err = p.Uint16()
+	return
+}
+
+// StmtFetch COM_STMT_FETCH 从游标读取数据
+type StmtFetch struct {
+	StmtID  uint32 `json:"stmt_id"`
+	NumRows uint32 `json:"num_rows"`
+}
+
+func (s *StmtFetch) Type() string {
+	return "COM_STMT_FETCH"
+}
+
+func (s *StmtFetch) decode(p *Parser, c *ConnTracker) (err error) {
+	if s.StmtID, err = p.Uint32(); err != nil {
+		return
+	}
+	s.NumRows, err = p.Uint32()
+	return
+}
+
+// UnknownCommand 不需要解析的命令 只记录命令类型
+type UnknownCommand struct {
+	Cmd byte `json:"cmd"`
+}
+
+func (u *UnknownCommand) Type() string {
+	return fmt.Sprintf("COM_0x%02x", u.Cmd)
+}
+
+func (u *UnknownCommand) decode(p *Parser, c *ConnTracker) error {
+	return nil
+}
@@ -0,0 +1,168 @@
+package mysql
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"io"
+
+	"github.com/Salpadding/l7dump/core"
+)
+
+// compressedReader 解开压缩协议的帧 读出来的是普通的包
+// 帧头 7 个字节: 3 字节压缩后的长度, 1 字节 sequence id, 3 字节压缩前的长度
+// 压缩前的长度为 0 表示数据太短 没有压缩
+// 一个帧里可以有多个包 一个包也可以跨越多个帧
+// https://dev.mysql.com/doc/dev/mysql-server/latest/page_protocol_basic_compression_packet.html
+type compressedReader struct {
+	conn  *bufio.Reader
+	hdr   [7]byte
+	frame io.Reader // 当前帧剩下的数据
+	// lost 丢包之后帧的边界也丢失了 需要调用 sync
+	lost bool
+	// skipped 重新同步时丢弃的压缩数据 由 RawPacket.resync 取走
+	skipped int
+}
+
+func (r *compressedReader) Read(p []byte) (n int, err error) {
+	if len(p) == 0 {
+		return
+	}
+	// 空洞之后要等 RawPacket.resync 调用 sync, 不能在读包的时候重新同步
+	if r.lost {
+		return 0, core.ErrDataLost
+	}
+	defer func() {
+		if err == core.ErrDataLost {
+			r.lost = true
+			r.frame = nil
+		}
+	}()
+	for {
+		if r.frame != nil {
+			n, err = r.frame.Read(p)
+			if err == io.EOF {
+				r.frame = nil
+				err = nil
+			}
+			if err != nil {
+				// 帧已经完整读出 下一次从新的帧开始
+				r.frame = nil
+			}
+			if n > 0 || err != nil {
+				return
+			}
+			continue
+		}
+		if err = r.next(); err != nil {
+			return
+		}
+	}
+}
+
+// next 读取下一个帧
+func (r *compressedReader) next() (err error) {
+	if _, err = io.ReadFull(r.conn, r.hdr[:]); err != nil {
+		return
+	}
+	size := int(r.hdr[0]) | int(r.hdr[1])<<8 | int(r.hdr[2])<<16
+	raw := int(r.hdr[4]) | int(r.hdr[5])<<8 | int(r.hdr[6])<<16
+
+	if raw == 0 {
+		r.frame = io.LimitReader(r.conn, int64(size))
+		return
+	}
+
+	// 先读出整个帧 解压失败时不会影响下一个帧的边界
+	buf := make([]byte, size)
+	var n int
+	if n, err = io.ReadFull(r.conn, buf); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		// 帧的中间有空洞 和没有压缩时一样 先读出空洞之前的数据
+		if err == core.ErrDataLost && n > 0 {
+			r.frame = io.MultiReader(partial(buf[:n]), lostReader{})
+			err = nil
+		}
+		return
+	}
+	zr, err := zlib.NewReader(bytes.NewReader(buf))
+	if err != nil {
+		return
+	}
+	r.frame = io.LimitReader(zr, int64(raw))
+	return
+}
+
+// partial 解压帧开头的一部分 能解出多少算多少
+func partial(data []byte) io.Reader {
+	zr, err := zlib.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return bytes.NewReader(nil)
+	}
+	out, _ := io.ReadAll(zr)
+	return bytes.NewReader(out)
+}
+
+// lostReader 帧里空洞的位置
+type lostReader struct{}
+
+func (lostReader) Read([]byte) (int, error) {
+	return 0, core.ErrDataLost
+}
+
+// sync 丢包之后丢弃数据直到找到一个看起来合理的帧头
+// 帧里的第一个包可能是上一个包的后续部分 由 RawPacket.resync 继续同步
+func (r *compressedReader) sync() (err error) {
+	if !r.lost {
+		return nil
+	}
+	defer func() {
+		if err == nil {
+			r.lost = false
+		}
+	}()
+	for {
+		var buf []byte
+		if buf, err = r.conn.Peek(len(r.hdr) + 4); err != nil {
+			// 又遇到了一个空洞
+			if err == core.ErrDataLost {
+				continue
+			}
+			// 剩下的数据不足一个帧
+			n, _ := r.conn.Discard(len(buf))
+			r.skipped += n
+			return
+		}
+		if plausibleFrame(buf) {
+			return nil
+		}
+		r.conn.Discard(1)
+		r.skipped++
+	}
+}
+
+// plausibleFrame 帧头和帧的开头
+// 压缩的帧以 zlib 头开始 没有压缩的帧通常正好是一个包
+func plausibleFrame(buf []byte) bool {
+	size := int(buf[0]) | int(buf[1])<<8 | int(buf[2])<<16
+	raw := int(buf[4]) | int(buf[5])<<8 | int(buf[6])<<16
+	if size == 0 {
+		return false
+	}
+	if raw == 0 {
+		inner := int(buf[7]) | int(buf[8])<<8 | int(buf[9])<<16
+		return inner+4 == size
+	}
+	// CMF 为 0x78 表示 deflate 和 32K 的窗口 CMF*256+FLG 是 31 的倍数
+	return buf[7] == 0x78 && (int(buf[7])<<8|int(buf[8]))%31 == 0
+}
+
+// compress 之后的数据都使用压缩协议
+// 调用之前当前的包必须已经读完
+func (packet *RawPacket) compress() {
+	packet.compressed = true
+	packet.frames = &compressedReader{conn: packet.conn}
+	packet.conn = bufio.NewReader(packet.frames)
+}
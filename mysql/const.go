@@ -60,6 +60,10 @@ const (
 	clientCanHandleExpiredPasswords
 	clientSessionTrack
 	clientDeprecateEOF
+	clientOptionalResultsetMetadata
+	clientZstdCompressionAlgorithm
+	// clientQueryAttributes CLIENT_QUERY_ATTRIBUTES COM_QUERY 和 COM_STMT_EXECUTE 可以带上属性
+	clientQueryAttributes
 )
 
 const (
@@ -93,6 +97,16 @@ const (
 	comStmtFetch
 )
 
+// COM_STMT_EXECUTE 的 flags
+// https://dev.mysql.com/doc/dev/mysql-server/latest/mysql__com_8h.html
+const (
+	cursorTypeReadOnly byte = 1 << iota
+	cursorTypeForUpdate
+	cursorTypeScrollable
+	// parameterCountAvailable PARAMETER_COUNT_AVAILABLE 参数前面有 parameter_count
+	parameterCountAvailable
+)
+
 // https://dev.mysql.com/doc/internals/en/com-query-response.html#packet-Protocol::ColumnType
 type fieldType byte
 
@@ -2,15 +2,14 @@ package mysql
 
 import (
 	"bufio"
+	"bytes"
 	"encoding/binary"
-	"encoding/json"
-	"fmt"
-	"os"
+	"log"
+	"sync"
 
 	"io"
 
 	"github.com/Salpadding/l7dump/core"
-	"github.com/google/gopacket/tcpassembly/tcpreader"
 )
 
 var (
@@ -27,47 +26,113 @@ type ProtoPacket interface {
 }
 
 type RawPacket struct {
-	conn    io.Reader
+	conn    *bufio.Reader
 	size    int
 	hdr     [4]byte
 	seqId   int
-	reading bool // reading = true 表示还没有读取结束
+	started bool // started = true 表示已经读取了包头
+	reading bool // reading = true 表示还有后续的包 (长度为 0xffffff)
+	read    int  // 当前包已经读取的字节数
+	total   int  // 当前包的长度
+	// expect 下一个包的 sequence id, 小于 0 表示不检查
+	// 同一个包的后续部分总是检查 sequence id 是否连续
+	expect int
+	// compressed 使用压缩协议 conn 读出的是解压之后的数据
+	compressed bool
+	frames     *compressedReader
+	// lost 包里有空洞 读下一个包之前需要重新同步
+	lost bool
 }
 
-// Close 重置状态
+// Close 丢弃当前包剩下的数据并重置状态
 func (packet *RawPacket) Close() {
+	if packet.started {
+		if _, err := io.Copy(io.Discard, packet); err == core.ErrDataLost {
+			packet.lost = true
+		}
+	}
+	packet.reset()
+}
+
+// reset 重置状态 不读取剩下的数据
+func (packet *RawPacket) reset() {
+	packet.started = false
 	packet.size = 0
-	packet.reading = true
+	packet.read = 0
+	packet.total = 0
+	packet.reading = false
+}
+
+// length 当前包的长度 超过 16MB 的包是所有部分的长度之和
+func (packet *RawPacket) length() int {
+	return packet.total
+}
+
+// remaining 当前包最多还剩多少字节 还有后续的包时只知道总长度的上限
+func (packet *RawPacket) remaining() int {
+	if !packet.started || packet.reading {
+		return defaultMaxAllowedPacket - packet.read
+	}
+	return packet.size
+}
+
+// readHeader 读取 4 字节的包头
+// 先 Peek 检查 sequence id, 不匹配时不消费数据 便于重新同步
+func (packet *RawPacket) readHeader() (err error) {
+	var hdr []byte
+	if hdr, err = packet.conn.Peek(4); err != nil {
+		// 流结束时剩下的数据不足一个包头 丢弃之后下一次读到 EOF
+		if err == io.EOF && len(hdr) > 0 {
+			packet.conn.Discard(len(hdr))
+			err = io.ErrUnexpectedEOF
+		}
+		return
+	}
+
+	seq := int(hdr[3])
+	switch {
+	case packet.compressed:
+		// 压缩协议由帧保证顺序 不同的服务端填写包的 sequence id 的方式不一样
+	case packet.started && seq != (packet.seqId+1)&0xff:
+		return ErrPktSync
+	case !packet.started && packet.expect >= 0 && seq != packet.expect:
+		return ErrPktSync
+	}
+
+	copy(packet.hdr[:], hdr)
+	packet.conn.Discard(4)
+
+	packet.seqId = seq
+	packet.hdr[3] = 0
+	packet.size = int(binary.LittleEndian.Uint32(packet.hdr[:]))
+	packet.total += packet.size
+	packet.started = true
+
+	if packet.total > defaultMaxAllowedPacket {
+		return ErrPktTooLarge
+	}
+
+	// 表示还有剩余
+	packet.reading = packet.size == maxPacketSize
+	return
 }
 
 // Packets documentation:
 // http://dev.mysql.com/doc/internals/en/client-server-protocol.html
 // 3 + 1 + n
 func (packet *RawPacket) Read(p []byte) (n int, err error) {
-	if packet.size == 0 {
-		if !packet.reading {
-			return 0, io.EOF
-		}
-
-		// 跳过头部
-		n, err = io.ReadAtLeast(packet.conn, packet.hdr[:], 4)
-		if err != nil {
+	if !packet.started {
+		if err = packet.readHeader(); err != nil {
 			return
 		}
+	}
 
-		packet.seqId = int(packet.hdr[3])
-		packet.hdr[3] = 0
-		packet.size = int(binary.LittleEndian.Uint32(packet.hdr[:]))
-
-		if packet.size == 0 {
+	for packet.size == 0 {
+		if !packet.reading {
 			return 0, io.EOF
 		}
-
-		// 表示还有剩余
-		if packet.size == 0xffffff {
-			packet.reading = true
-		} else {
-			packet.reading = false
+		if err = packet.readHeader(); err != nil {
+			return
 		}
 	}
 
@@ -80,120 +145,554 @@ func (packet *RawPacket) Read(p []byte) (n int, err error) {
 
 	n, err = packet.conn.Read(p[:minLen])
 	packet.size -= n
+	packet.read += n
 
 	return
 }
 
+// resync 丢弃数据直到找到一个看起来合理的包头
+// plausible 的参数是包头和包的第一个字节
+func (packet *RawPacket) resync(plausible func(size, seq int, first byte) bool) (skipped int, err error) {
+	packet.reset()
+	packet.lost = false
+	// 压缩协议先在帧上重新同步 丢弃的帧数据也算进来
+	if packet.frames != nil {
+		defer func() {
+			skipped += packet.frames.skipped
+			packet.frames.skipped = 0
+		}()
+	}
+
+	for {
+		if packet.frames != nil {
+			if err = packet.frames.sync(); err != nil {
+				n, _ := packet.conn.Discard(packet.conn.Buffered())
+				skipped += n
+				return
+			}
+		}
+		var buf []byte
+		if buf, err = packet.conn.Peek(5); err != nil {
+			// 又遇到了一个空洞
+			if err == core.ErrDataLost {
+				continue
+			}
+			// 剩下的数据不足一个包
+			n, _ := packet.conn.Discard(len(buf))
+			skipped += n
+			return
+		}
+		size := int(buf[0]) | int(buf[1])<<8 | int(buf[2])<<16
+		if plausible(size, int(buf[3]), buf[4]) {
+			return
+		}
+		packet.conn.Discard(1)
+		skipped++
+	}
+}
+
+// plausibleCommand 客户端在命令阶段发送的包 sequence id 为 0
+func plausibleCommand(size, seq int, first byte) bool {
+	return seq == 0 && size > 0 && size < maxPacketSize && first >= comQuit && first <= comStmtFetch
+}
+
+// plausibleResult 服务端的第一个响应包 sequence id 为 1
+func plausibleResult(size, seq int, first byte) bool {
+	if seq != 1 || size == 0 {
+		return false
+	}
+	switch first {
+	case iOK:
+		return size >= 7
+	case iERR:
+		return size >= 3
+	case iLocalInFile:
+		return true
+	}
+	// 结果集的列数
+	return size == 1 && first < 0xfb
+}
+
+// 连接所处的阶段 决定了客户端发送的包如何解析
+const (
+	phaseCommand = iota
+	// phaseAuth 握手或者 COM_CHANGE_USER 之后 直到服务端返回 OK/ERR
+	phaseAuth
+	// phaseInfile LOAD DATA LOCAL INFILE 客户端在发送文件内容
+	phaseInfile
+	// phaseOpaque 之后的数据都无法解码 例如 ssl 或者 zstd 压缩
+	phaseOpaque
+)
+
 type ConnTracker struct {
 	meta       *core.ConnMeta
+	tracker    *Tracker
 	respPacket RawPacket
+	respStream *core.Stream
 
 	reqPacket RawPacket
+	reqStream *core.Stream
 
+	// ServerHandshake ClientHandShake 分别由两个解码协程写入 clientCaps 在两边都会读取
+	// 解析完成之后持有 mtx 赋值 之后不再修改
 	ServerHandshake *ServerHandShake
 
 	ClientHandShake *ClientHandShake
+
+	// pending 已经发出还没有收到响应的命令
+	mtx        sync.Mutex
+	pending    *core.Event
+	pendingSeq int
+	phase      int
+	// stmts 连接上的预处理语句
+	stmts map[uint32]*Stmt
+}
+
+// setPending 记录请求 以及请求最后一个包的 sequence id
+func (c *ConnTracker) setPending(ev *core.Event) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.pending = ev
+	c.pendingSeq = c.reqPacket.seqId
+}
+
+// restorePending 响应的包头对不上时 放回请求 等重新同步之后再配对
+func (c *ConnTracker) restorePending(ev *core.Event, seq int) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.pending == nil {
+		c.pending, c.pendingSeq = ev, seq
+	}
+}
+
+func (c *ConnTracker) popPending() (*core.Event, int) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	ev := c.pending
+	c.pending = nil
+	return ev, c.pendingSeq
+}
+
+func (c *ConnTracker) setPhase(phase int) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.phase = phase
+}
+
+func (c *ConnTracker) getPhase() int {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.phase
 }
 
 // DecodeReq
 func (c *ConnTracker) DecodeReq() (val interface{}, err error) {
 	defer c.reqPacket.Close()
-	// 跳过握手阶段
+
+	if c.reqPacket.lost {
+		if err = c.resyncReq(core.ErrDataLost); err != nil {
+			return
+		}
+	}
+	// 等数据到达之后才能确定连接所处的阶段
+	// 阶段是由响应的解码协程切换的
+	// 压缩协议在 Peek 时读出整个帧 帧里的空洞也要算进来
+	gaps := c.reqStream.Gaps()
+	if _, err = c.reqPacket.conn.Peek(1); err != nil {
+		if err == core.ErrDataLost {
+			err = c.resyncReq(err)
+		}
+		return
+	}
+	phase := c.getPhase()
+
+	// 每个命令的 sequence id 都从 0 开始
+	c.reqPacket.expect = -1
+	if phase == phaseCommand && c.ClientHandShake != nil {
+		c.reqPacket.expect = 0
+		// 认证成功之后客户端发送的数据都是压缩的
+		if !c.reqPacket.compressed && c.compression() == clientCompress {
+			c.reqPacket.compress()
+		}
+	}
+
+	var cmd [1]byte
+	if _, err = c.reqPacket.Read(cmd[:]); err != nil {
+		// 空包 LOAD DATA LOCAL INFILE 的文件内容以空包结束
+		if err == io.EOF && c.reqPacket.started {
+			if phase == phaseInfile {
+				c.setPhase(phaseCommand)
+			}
+			err = nil
+		}
+		if isFramingErr(err) {
+			err = c.resyncReq(err)
+		}
+		return
+	}
+
+	// 握手响应的 sequence id 是 1, 为 0 说明抓包开始时连接已经建立
+	if c.ClientHandShake == nil && c.reqPacket.seqId == 0 {
+		log.Printf("mysql %s: handshake not captured", c.meta)
+		c.setHandShake(&ClientHandShake{}, nil)
+	}
+
+	// 握手阶段
 	if c.ClientHandShake == nil {
-		c.ClientHandShake = &ClientHandShake{
+		hs := &ClientHandShake{
 			Parser: Parser{
-				Reader: &c.reqPacket,
+				Reader: io.MultiReader(bytes.NewReader(cmd[:]), &c.reqPacket),
 			},
 		}
 
-		err = c.ClientHandShake.parse()
+		err = hs.parse()
+		c.setHandShake(hs, nil)
 
 		if err != nil {
-			fmt.Printf("parse client handshake failed %v\n", err)
-		} else {
-			fmt.Printf("client user = %s\n", c.ClientHandShake.User)
+			log.Printf("parse client handshake failed %v", err)
+			return
 		}
+
+		// SSLRequest 只有 32 个字节 之后是 tls 握手
+		if c.ClientHandShake.Capabilities&uint32(clientSSL) != 0 && c.reqPacket.length() == 32 {
+			log.Printf("mysql %s: ssl enabled, skip decoding", c.meta)
+			c.setPhase(phaseOpaque)
+			return
+		}
+
+		ev := core.NewEvent(c.meta, "mysql")
+		ev.Op = "handshake"
+		ev.ReqTime = c.reqStream.Seen()
+		ev.ReqSize = c.reqPacket.length()
+		ev.Request = c.ClientHandShake
+		c.setPending(ev)
+		c.setPhase(phaseAuth)
 		return
 	}
 
-	var cmd [1]byte
-	c.reqPacket.Read(cmd[:])
+	switch phase {
+	case phaseOpaque:
+		_, err = io.Copy(io.Discard, c.reqPacket.conn)
+		if err == nil {
+			err = io.EOF
+		}
+		return
+	case phaseAuth, phaseInfile:
+		// 认证数据和文件内容 不需要解析
+		return
+	}
+
+	ev := core.NewEvent(c.meta, "mysql")
+	ev.ReqTime = c.reqStream.Seen()
 
-	// query 纯文本
-	if cmd[0] == comQuery {
-		// 打印 sql 语句
-		io.Copy(os.Stdout, &c.reqPacket)
-		fmt.Println()
-		return nil, nil
+	parser := Parser{Reader: &c.reqPacket}
+	command := newCommand(cmd[0])
+	err = command.decode(&parser, c)
+	parser.Drop()
+
+	ev.Op = command.Type()
+	ev.ReqSize = c.reqPacket.length()
+	ev.Request = command
+	if err != nil {
+		ev.Error = err.Error()
+	}
+	// 命令的后半部分丢失 剩下的数据不能按包的长度丢弃
+	if c.reqStream.Gaps() > gaps {
+		ev.Incomplete = true
+		c.reqPacket.reset()
+		c.reqPacket.lost = true
 	}
 
-	// stmt
-	io.Copy(io.Discard, &c.reqPacket)
-	return nil, nil
+	if !hasResponse(command) {
+		ev.Done(ev.ReqTime)
+		core.Emit(c.tracker.Sink, ev)
+		return command, nil
+	}
+	if _, ok := command.(*ChangeUser); ok {
+		c.setPhase(phaseAuth)
+	}
+	c.setPending(ev)
+	return command, nil
+}
+
+// clientCaps 客户端和服务端都支持的特性
+func (c *ConnTracker) clientCaps() clientFlag {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.ClientHandShake == nil {
+		return 0
+	}
+	caps := clientFlag(c.ClientHandShake.Capabilities)
+	if c.ServerHandshake != nil {
+		caps &= clientFlag(c.ServerHandshake.Capabilities)
+	}
+	return caps
+}
+
+// setHandShake 记录解析完的握手包 为 nil 的一方不变
+func (c *ConnTracker) setHandShake(client *ClientHandShake, server *ServerHandShake) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if client != nil {
+		c.ClientHandShake = client
+	}
+	if server != nil {
+		c.ServerHandshake = server
+	}
+}
+
+// compression 握手时协商的压缩算法 没有压缩时返回 0
+func (c *ConnTracker) compression() clientFlag {
+	caps := c.clientCaps()
+	switch {
+	case caps&clientCompress != 0:
+		return clientCompress
+	case caps&clientZstdCompressionAlgorithm != 0:
+		return clientZstdCompressionAlgorithm
+	}
+	return 0
 }
 
 func (c *ConnTracker) DecodeResp() (val interface{}, err error) {
 	defer c.respPacket.Close()
+
+	if c.respPacket.lost {
+		if err = c.resyncResp(core.ErrDataLost); err != nil {
+			return
+		}
+	}
+	// 等响应的数据到达之后 才能确定对应的请求和连接所处的阶段
+	// 压缩协议在 Peek 时读出整个帧 帧里的空洞也要算进来
+	gaps := c.respStream.Gaps()
+	if _, err = c.respPacket.conn.Peek(1); err != nil {
+		if err == core.ErrDataLost {
+			err = c.resyncResp(err)
+		}
+		return
+	}
+	phase := c.getPhase()
+
+	// 响应的 sequence id 接着请求的
+	var (
+		ev  *core.Event
+		seq int
+	)
+	c.respPacket.expect = -1
+	if phase == phaseCommand && c.ServerHandshake != nil {
+		if ev, seq = c.popPending(); ev != nil {
+			c.respPacket.expect = (seq + 1) & 0xff
+		}
+	}
+
+	header, p, err := c.nextPacket()
+	if err != nil {
+		if err == io.EOF && c.respPacket.started {
+			err = nil
+		}
+		if err == ErrPktSync && ev != nil {
+			c.restorePending(ev, seq)
+			ev = nil
+		}
+		if isFramingErr(err) {
+			if ev != nil {
+				c.finish(ev, nil, err)
+				core.Emit(c.tracker.Sink, ev)
+			}
+			err = c.resyncResp(err)
+		}
+		return
+	}
+
+	// 握手包的 sequence id 是 0, 协议版本是 10
+	if c.ServerHandshake == nil && (c.respPacket.seqId != 0 || header != minProtocolVersion) {
+		log.Printf("mysql %s: server greeting not captured", c.meta)
+		c.setHandShake(nil, &ServerHandShake{})
+	}
+
 	if c.ServerHandshake == nil {
-		c.ServerHandshake = &ServerHandShake{
-			Parser: Parser{
-				Reader: &c.respPacket,
-			},
+		hs := &ServerHandShake{
+			Parser: *unread(header, p),
 		}
-		err = c.ServerHandshake.parse()
+		err = hs.parse()
+		c.setHandShake(nil, hs)
 		if err != nil {
-			fmt.Printf("parse server handshake failed %v\n", err)
-		} else {
-			js, _ := json.Marshal(c.ServerHandshake)
-			fmt.Printf("server = %s\n", string(js))
+			log.Printf("parse server handshake failed %v", err)
 		}
 		return
 	}
 
-	var cmd [1]byte
-	c.respPacket.Read(cmd[:])
+	switch phase {
+	case phaseOpaque:
+		_, err = io.Copy(io.Discard, c.respPacket.conn)
+		if err == nil {
+			err = io.EOF
+		}
+		return
+	case phaseAuth:
+		return c.decodeAuth(header, p)
+	}
+
+	var command Command
+	if ev != nil {
+		command, _ = ev.Request.(Command)
+	} else {
+		// 没有看到请求 例如抓包开始时连接已经建立
+		ev = core.NewEvent(c.meta, "mysql")
+	}
+
+	start := c.respStream.Count()
+	resp, err := c.readResponse(command, header, p)
+	// 解析时可能把空洞之后的数据当成了响应的一部分
+	if err == nil && c.respStream.Gaps() > gaps {
+		err = core.ErrDataLost
+	}
+	if isFramingErr(err) {
+		c.finish(ev, resp, err)
+		core.Emit(c.tracker.Sink, ev)
+		err = c.resyncResp(err)
+		return
+	}
+	c.respPacket.Close()
+	if prepare, ok := command.(*StmtPrepare); ok && err == nil {
+		if stmt, ok := resp.Last().(*StmtPrepareOK); ok {
+			c.addStmt(prepare.Query, stmt)
+		}
+	}
+	c.finish(ev, resp, err)
+	ev.RespSize = c.respStream.Count() - start
+	ev.Incomplete = ev.Incomplete || c.respPacket.lost
+	core.Emit(c.tracker.Sink, ev)
+	return resp, err
+}
+
+// isFramingErr 包的边界已经丢失 需要重新同步
+func isFramingErr(err error) bool {
+	return err == ErrPktSync || err == ErrPktTooLarge || err == core.ErrDataLost
+}
+
+// resyncReq 丢弃请求的数据 直到找到下一个命令
+func (c *ConnTracker) resyncReq(cause error) error {
+	skipped, err := c.reqPacket.resync(plausibleCommand)
+	log.Printf("mysql %s: request %v, skipped %d bytes", c.meta, cause, skipped)
+	return err
+}
+
+// resyncResp 丢弃响应的数据 直到找到下一个响应
+func (c *ConnTracker) resyncResp(cause error) error {
+	skipped, err := c.respPacket.resync(plausibleResult)
+	log.Printf("mysql %s: response %v, skipped %d bytes", c.meta, cause, skipped)
+	return err
+}
 
-	if cmd[0] == iOK {
+// decodeAuth 认证阶段的响应 收到 OK 或者 ERR 之后进入命令阶段
+func (c *ConnTracker) decodeAuth(header byte, p *Parser) (val interface{}, err error) {
+	result, err := c.readAuthResult(header, p)
+	if err != nil || result == nil {
+		return
+	}
+	if _, ok := result.(*AuthSwitch); ok {
+		return result, nil
+	}
 
+	// 认证成功之后开始压缩
+	c.respPacket.Close()
+	switch c.compression() {
+	case clientCompress:
+		if !c.respPacket.compressed {
+			c.respPacket.compress()
+		}
+		c.setPhase(phaseCommand)
+	case clientZstdCompressionAlgorithm:
+		log.Printf("mysql %s: zstd compression not supported, skip decoding", c.meta)
+		c.setPhase(phaseOpaque)
+	default:
+		c.setPhase(phaseCommand)
+	}
+	ev, _ := c.popPending()
+	if ev == nil {
+		return result, nil
 	}
+	if ev.Op == "handshake" {
+		ev.Response = c.ServerHandshake
+	}
+	c.finish(ev, &Response{Results: []Result{result}}, nil)
+	core.Emit(c.tracker.Sink, ev)
+	return result, nil
+}
 
-	io.Copy(io.Discard, &c.reqPacket)
-	return nil, nil
+// finish 根据响应填充 Event 的状态
+func (c *ConnTracker) finish(ev *core.Event, resp *Response, err error) {
+	ev.Done(c.respStream.Seen())
+	if resp != nil {
+		if ev.Response == nil {
+			ev.Response = resp
+		}
+		if last := resp.Last(); last != nil {
+			ev.Status = last.Type()
+			if rs, ok := last.(*ResultSet); ok && rs.End != nil {
+				last = rs.End
+			}
+			if e, ok := last.(*Err); ok {
+				ev.Status = e.Type()
+				ev.Error = e.Error()
+			}
+		}
+	}
+	if err != nil {
+		ev.Error = err.Error()
+		ev.Incomplete = err == core.ErrDataLost
+	}
 }
 
 // Tracker
 // mysql client 连接时候设置 --ssl-mode=DISABLED 关闭ssl
 type Tracker struct {
+	// Sink 接收每个命令和响应组成的 Event, 为空时输出到标准输出
+	Sink core.Sink
+	// MaxRows 每个结果集在 Event 中保留的行数
+	MaxRows int
 }
 
-func (m *Tracker) RequestDecoder(stream *tcpreader.ReaderStream, conn core.ProtocolConnTracker) func() (interface{}, error) {
+func (m *Tracker) RequestDecoder(stream *core.Stream, conn core.ProtocolConnTracker) func() (interface{}, error) {
 	c := conn.(*ConnTracker)
 	c.reqPacket.conn = bufio.NewReader(stream)
+	c.reqStream = stream
 
 	return c.DecodeReq
 }
 
-func (m *Tracker) ResponseDecoder(stream *tcpreader.ReaderStream, conn core.ProtocolConnTracker) func() (interface{}, error) {
+func (m *Tracker) ResponseDecoder(stream *core.Stream, conn core.ProtocolConnTracker) func() (interface{}, error) {
 	c := conn.(*ConnTracker)
 	c.respPacket.conn = bufio.NewReader(stream)
+	c.respStream = stream
 	return c.DecodeResp
 }
 
 func (m *Tracker) NewConnect(meta *core.ConnMeta) core.ProtocolConnTracker {
-	fmt.Printf("new mysql connect to %s\n", meta.String())
+	log.Printf("new mysql connect to %s", meta.String())
 	return &ConnTracker{
-		meta: meta,
-		reqPacket: RawPacket{
-			reading: true,
-		},
-		respPacket: RawPacket{
-			reading: true,
-		},
+		meta:    meta,
+		tracker: m,
 	}
 }
 
-func (m *Tracker) OnClose(core.ProtocolConnTracker) {
-	return
+func (m *Tracker) OnClose(conn core.ProtocolConnTracker, reason core.CloseReason) {
+	conn.(*ConnTracker).closeStmts()
+}
+
+// Probe 服务端先发送 protocol version 10 的 handshake, 后面是版本号
+func (m *Tracker) Probe(req, resp []byte) core.ProbeResult {
+	if len(resp) < 6 {
+		if len(resp) == 0 && len(req) > 0 {
+			return core.ProbeMismatch
+		}
+		return core.ProbeMore
+	}
+	n := int(resp[0]) | int(resp[1])<<8 | int(resp[2])<<16
+	if resp[3] != 0 || resp[4] != 10 || n < 32 || n > 1024 || resp[5] < '0' || resp[5] > '9' {
+		return core.ProbeMismatch
+	}
+	return core.ProbeMatch
 }
 
 func (m *ConnTracker) OnRequest(req interface{}) error {
@@ -205,5 +704,5 @@ func (m *ConnTracker) OnResponse(resp interface{}) error {
 }
 
 func (m *ConnTracker) OnError(err error) {
-	fmt.Printf("%v\n", err)
+	log.Printf("mysql %s: %v", m.meta, err)
 }
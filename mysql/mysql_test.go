@@ -0,0 +1,453 @@
+package mysql
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Salpadding/l7dump/core"
+	"github.com/Salpadding/l7dump/core/coretest"
+)
+
+// chunk 一个方向上的一段数据 data 为 nil 表示这个方向丢了数据
+type chunk struct {
+	fromClient bool
+	data       []byte
+}
+
+// replay 按顺序把数据交给两个方向的解码器 和 tcpassembly 的行为一致
+func replay(t *testing.T, tracker *Tracker, chunks []chunk) []*core.Event {
+	sink := &coretest.Sink{}
+	tracker.Sink = sink
+	conn := coretest.Start(tracker, coretest.Meta(3306))
+	for _, c := range chunks {
+		conn.Send(c.fromClient, c.data)
+	}
+	// 解码器的错误体现在 Event 里 这里不检查
+	conn.Close()
+
+	events := sink.Events()
+	if len(events) == 0 {
+		t.Fatal("no event emitted")
+	}
+	return events
+}
+
+// packet 加上 4 字节的包头
+func packet(seq byte, payload ...[]byte) []byte {
+	var body []byte
+	for _, p := range payload {
+		body = append(body, p...)
+	}
+	hdr := make([]byte, 4, 4+len(body))
+	binary.LittleEndian.PutUint32(hdr, uint32(len(body)))
+	hdr[3] = seq
+	return append(hdr, body...)
+}
+
+func lenEncStr(s string) []byte {
+	return append([]byte{byte(len(s))}, s...)
+}
+
+func le16(v uint16) []byte {
+	return binary.LittleEndian.AppendUint16(nil, v)
+}
+
+func le32(v uint32) []byte {
+	return binary.LittleEndian.AppendUint32(nil, v)
+}
+
+const testCaps = clientProtocol41 | clientSecureConn | clientPluginAuth | clientTransactions
+
+func serverGreeting(caps clientFlag) []byte {
+	return packet(0,
+		[]byte{10}, []byte("8.0.34\x00"),
+		le32(1), []byte("12345678"), []byte{0},
+		le16(uint16(caps)), []byte{33}, le16(uint16(statusInAutocommit)), le16(uint16(caps>>16)),
+		[]byte{21}, make([]byte, 10), []byte("123456789012\x00"), []byte("mysql_native_password\x00"),
+	)
+}
+
+func clientHandshake(caps clientFlag) []byte {
+	return packet(1,
+		le32(uint32(caps)), le32(1<<24), []byte{33}, make([]byte, 23),
+		[]byte("root\x00"), []byte{20}, make([]byte, 20),
+	)
+}
+
+func okPacket(seq byte, affected, status uint16) []byte {
+	return packet(seq, []byte{iOK, byte(affected), 0}, le16(status), le16(0))
+}
+
+func columnDef(seq byte, name string, ft fieldType) []byte {
+	return packet(seq,
+		lenEncStr("def"), lenEncStr("test"), lenEncStr("t"), lenEncStr("t"), lenEncStr(name), lenEncStr(name),
+		[]byte{0x0c}, le16(33), le32(11), []byte{byte(ft)}, le16(0), []byte{0}, []byte{0, 0},
+	)
+}
+
+func eofPacket(seq byte) []byte {
+	return packet(seq, []byte{iEOF}, le16(0), le16(uint16(statusInAutocommit)))
+}
+
+func TestQueryResponses(t *testing.T) {
+	events := replay(t, &Tracker{MaxRows: 10}, []chunk{
+		{false, serverGreeting(testCaps)},
+		{true, clientHandshake(testCaps)},
+		{false, okPacket(2, 0, uint16(statusInAutocommit))},
+		{true, packet(0, []byte{comQuery}, []byte("select id, name from t"))},
+		{false, append(append(append(append(append(
+			packet(1, []byte{2}),
+			columnDef(2, "id", fieldTypeLong)...),
+			columnDef(3, "name", fieldTypeVarString)...),
+			eofPacket(4)...),
+			packet(5, lenEncStr("1"), []byte{0xfb})...),
+			eofPacket(6)...)},
+		{true, packet(0, []byte{comInitDB}, []byte("missing"))},
+		{false, packet(1, []byte{iERR}, le16(1049), []byte("#42000Unknown database 'missing'"))},
+		{true, packet(0, []byte{comQuery}, []byte("update t set name = 'x'"))},
+		{false, okPacket(1, 3, uint16(statusInAutocommit))},
+		{true, packet(0, []byte{comQuit})},
+	})
+
+	if len(events) != 5 {
+		t.Fatalf("expect 5 events, got %d", len(events))
+	}
+
+	if events[0].Op != "handshake" || events[0].Status != "OK" {
+		t.Fatalf("unexpected handshake event %+v", events[0])
+	}
+
+	query := events[1]
+	if query.Op != "COM_QUERY" || query.Request.(*Query).SQL != "select id, name from t" {
+		t.Fatalf("unexpected query event %+v", query)
+	}
+	rs := query.Response.(*Response).Last().(*ResultSet)
+	if len(rs.Columns) != 2 || rs.Columns[1].Name != "name" || rs.Rows != 1 {
+		t.Fatalf("unexpected result set %+v", rs)
+	}
+	if *rs.Values[0][0] != "1" || rs.Values[0][1] != nil {
+		t.Fatalf("unexpected row values %+v", rs.Values)
+	}
+	if query.Latency != time.Millisecond {
+		t.Fatalf("unexpected latency %v", query.Latency)
+	}
+
+	initDB := events[2]
+	if initDB.Status != "ERR" || initDB.Error != "Error 1049 (42000): Unknown database 'missing'" {
+		t.Fatalf("unexpected error event %+v", initDB)
+	}
+
+	update := events[3].Response.(*Response).Last().(*OK)
+	if update.AffectedRows != 3 {
+		t.Fatalf("unexpected ok packet %+v", update)
+	}
+
+	if events[4].Op != "COM_QUIT" {
+		t.Fatalf("unexpected quit event %+v", events[4])
+	}
+}
+
+func TestQueryAttributes(t *testing.T) {
+	caps := testCaps | clientQueryAttributes
+	events := replay(t, &Tracker{}, []chunk{
+		{false, serverGreeting(caps)},
+		{true, clientHandshake(caps)},
+		{false, okPacket(2, 0, uint16(statusInAutocommit))},
+		// 两个属性 第二个为 NULL
+		{true, packet(0, []byte{comQuery}, []byte{2, 1}, []byte{0x02}, []byte{1},
+			le16(uint16(fieldTypeVarString)), lenEncStr("trace_id"), le16(uint16(fieldTypeLong)), lenEncStr("shard"),
+			lenEncStr("abc"), []byte("select 1"))},
+		{false, okPacket(1, 0, uint16(statusInAutocommit))},
+		// 没有属性
+		{true, packet(0, []byte{comQuery}, []byte{0, 1}, []byte("select 2"))},
+		{false, okPacket(1, 0, uint16(statusInAutocommit))},
+	})
+
+	if len(events) != 3 {
+		t.Fatalf("expect 3 events, got %d", len(events))
+	}
+	query := events[1].Request.(*Query)
+	if query.SQL != "select 1" || len(query.Attributes) != 2 || query.Attributes["trace_id"] != "abc" || query.Attributes["shard"] != nil {
+		t.Fatalf("unexpected query %+v", query)
+	}
+	if query := events[2].Request.(*Query); query.SQL != "select 2" || query.Attributes != nil {
+		t.Fatalf("unexpected query %+v", query)
+	}
+}
+
+func TestPreparedStatement(t *testing.T) {
+	handshake := []chunk{
+		{false, serverGreeting(testCaps)},
+		{true, clientHandshake(testCaps)},
+		{false, okPacket(2, 0, uint16(statusInAutocommit))},
+	}
+	events := replay(t, &Tracker{}, append(handshake,
+		chunk{true, packet(0, []byte{comStmtPrepare}, []byte("select * from t where id = ? and name = ? -- ?"))},
+		chunk{false, append(append(append(
+			packet(1, []byte{iOK}, le32(7), le16(0), le16(2), []byte{0}, le16(0)),
+			columnDef(2, "?", fieldTypeLongLong)...),
+			columnDef(3, "?", fieldTypeVarString)...),
+			eofPacket(4)...)},
+		chunk{true, packet(0, []byte{comStmtExecute}, le32(7), []byte{0}, le32(1),
+			[]byte{0}, []byte{1}, le16(uint16(fieldTypeLongLong)), le16(uint16(fieldTypeVarString)),
+			binary.LittleEndian.AppendUint64(nil, 42), lenEncStr("o'k"))},
+		chunk{false, okPacket(1, 0, uint16(statusInAutocommit))},
+		chunk{true, packet(0, []byte{comStmtClose}, le32(7))},
+	))
+
+	if len(events) != 4 {
+		t.Fatalf("expect 4 events, got %d", len(events))
+	}
+
+	exec := events[2].Request.(*StmtExecute)
+	if exec.Query != `select * from t where id = 42 and name = 'o\'k' -- ?` {
+		t.Fatalf("unexpected interpolated query %q", exec.Query)
+	}
+
+	if events[3].Op != "COM_STMT_CLOSE" {
+		t.Fatalf("unexpected close event %+v", events[3])
+	}
+}
+
+func TestPreparedStatementAttributes(t *testing.T) {
+	caps := testCaps | clientQueryAttributes
+	events := replay(t, &Tracker{}, []chunk{
+		{false, serverGreeting(caps)},
+		{true, clientHandshake(caps)},
+		{false, okPacket(2, 0, uint16(statusInAutocommit))},
+		{true, packet(0, []byte{comStmtPrepare}, []byte("select * from t where id = ?"))},
+		{false, append(append(
+			packet(1, []byte{iOK}, le32(3), le16(0), le16(1), []byte{0}, le16(0)),
+			columnDef(2, "?", fieldTypeLongLong)...),
+			eofPacket(3)...)},
+		// parameter_count 包括一个参数和一个属性 参数的名字为空
+		{true, packet(0, []byte{comStmtExecute}, le32(3), []byte{parameterCountAvailable}, le32(1),
+			[]byte{2}, []byte{0}, []byte{1},
+			le16(uint16(fieldTypeLongLong)), lenEncStr(""), le16(uint16(fieldTypeVarString)), lenEncStr("trace_id"),
+			binary.LittleEndian.AppendUint64(nil, 42), lenEncStr("abc"))},
+		{false, okPacket(1, 0, uint16(statusInAutocommit))},
+	})
+
+	if len(events) != 3 {
+		t.Fatalf("expect 3 events, got %d", len(events))
+	}
+	exec := events[2].Request.(*StmtExecute)
+	if exec.Query != "select * from t where id = 42" || len(exec.Params) != 1 {
+		t.Fatalf("unexpected execute %+v", exec)
+	}
+	if len(exec.Attributes) != 1 || exec.Attributes["trace_id"] != "abc" {
+		t.Fatalf("unexpected attributes %+v", exec.Attributes)
+	}
+}
+
+func TestLargePacketAndResync(t *testing.T) {
+	// 超过 16MB 的 COM_QUERY 被拆成两个包
+	query := make([]byte, maxPacketSize+10)
+	for i := range query {
+		query[i] = 'a'
+	}
+	payload := append([]byte{comQuery}, query...)
+	large := append(packet(0, payload[:maxPacketSize]), packet(1, payload[maxPacketSize:])...)
+
+	events := replay(t, &Tracker{}, []chunk{
+		{false, serverGreeting(testCaps)},
+		{true, clientHandshake(testCaps)},
+		{false, okPacket(2, 0, uint16(statusInAutocommit))},
+		{true, large},
+		{false, okPacket(2, 1, uint16(statusInAutocommit))},
+		// 丢失了包的边界 之后的数据需要重新同步
+		{true, append([]byte{0x13, 0x37, 0x00, 0x05, 0xff}, packet(0, []byte{comPing})...)},
+		{false, append([]byte{0x42, 0x42}, okPacket(1, 0, uint16(statusInAutocommit))...)},
+		{true, packet(0, []byte{comQuery}, []byte("select 1"))},
+		{false, okPacket(1, 0, uint16(statusInAutocommit))},
+	})
+
+	if len(events) != 4 {
+		t.Fatalf("expect 4 events, got %d", len(events))
+	}
+	if len(events[1].Request.(*Query).SQL) != len(query) || events[1].Status != "OK" {
+		t.Fatalf("unexpected large query event %s", events[1])
+	}
+	if events[2].Op != "COM_PING" || events[2].Status != "OK" {
+		t.Fatalf("unexpected ping event %s", events[2])
+	}
+	if events[3].Request.(*Query).SQL != "select 1" || events[3].Status != "OK" {
+		t.Fatalf("unexpected query event %s", events[3])
+	}
+}
+
+// frame 把多个包放进一个压缩协议的帧
+func frame(seq byte, zip bool, packets ...[]byte) []byte {
+	var raw []byte
+	for _, p := range packets {
+		raw = append(raw, p...)
+	}
+	hdr := make([]byte, 8)
+	if !zip {
+		binary.LittleEndian.PutUint32(hdr, uint32(len(raw)))
+		hdr[3] = seq
+		return append(hdr[:7], raw...)
+	}
+
+	var buf bytes.Buffer
+	w := zlib.NewWriter(&buf)
+	w.Write(raw)
+	w.Close()
+	binary.LittleEndian.PutUint32(hdr, uint32(buf.Len()))
+	hdr[3] = seq
+	binary.LittleEndian.PutUint32(hdr[4:], uint32(len(raw)))
+	return append(hdr[:7], buf.Bytes()...)
+}
+
+func TestCompressedProtocol(t *testing.T) {
+	caps := testCaps | clientCompress
+	events := replay(t, &Tracker{MaxRows: 10}, []chunk{
+		{false, serverGreeting(caps)},
+		{true, clientHandshake(caps)},
+		{false, okPacket(2, 0, uint16(statusInAutocommit))},
+		// 短的包不压缩
+		{true, frame(0, false, packet(0, []byte{comQuery}, []byte("select 1")))},
+		// 一个帧里有整个结果集
+		{false, frame(1, true,
+			packet(1, []byte{1}),
+			columnDef(2, "1", fieldTypeLongLong),
+			eofPacket(3),
+			packet(4, lenEncStr("1")),
+			eofPacket(5),
+		)},
+		{true, frame(0, true, packet(0, []byte{comQuery}, bytes.Repeat([]byte("x"), 100)))},
+		// 一个包跨越两个帧
+		{false, func() []byte {
+			ok := okPacket(1, 7, uint16(statusInAutocommit))
+			return append(frame(1, true, ok[:5]), frame(2, false, ok[5:])...)
+		}()},
+	})
+
+	if len(events) != 3 {
+		t.Fatalf("expect 3 events, got %d", len(events))
+	}
+	rs := events[1].Response.(*Response).Last().(*ResultSet)
+	if events[1].Request.(*Query).SQL != "select 1" || rs.Rows != 1 || *rs.Values[0][0] != "1" {
+		t.Fatalf("unexpected result set %+v", rs)
+	}
+	if len(events[2].Request.(*Query).SQL) != 100 || events[2].Response.(*Response).Last().(*OK).AffectedRows != 7 {
+		t.Fatalf("unexpected event %s", events[2])
+	}
+}
+
+func TestDataLost(t *testing.T) {
+	column := columnDef(2, "id", fieldTypeLong)
+	closeStmt := packet(0, []byte{comStmtClose}, le32(7))
+	events := replay(t, &Tracker{}, []chunk{
+		{false, serverGreeting(testCaps)},
+		{true, clientHandshake(testCaps)},
+		{false, okPacket(2, 0, uint16(statusInAutocommit))},
+		{true, packet(0, []byte{comQuery}, []byte("select id from t"))},
+		{false, append(packet(1, []byte{1}), column[:10]...)},
+		// 列定义的后半部分和第一行丢了
+		{false, nil},
+		{false, append(column[len(column)-4:], eofPacket(5)...)},
+		{true, packet(0, []byte{comPing})},
+		{false, okPacket(1, 0, uint16(statusInAutocommit))},
+		// 命令的后半部分丢了
+		{true, closeStmt[:len(closeStmt)-2]},
+		{true, nil},
+		{true, append([]byte{0, 0}, packet(0, []byte{comPing})...)},
+		{false, okPacket(1, 0, uint16(statusInAutocommit))},
+	})
+
+	if len(events) != 5 {
+		t.Fatalf("expect 5 events, got %v", events)
+	}
+	query := events[1]
+	if query.Op != "COM_QUERY" || !query.Incomplete || query.Error != core.ErrDataLost.Error() {
+		t.Fatalf("unexpected query event %s", query)
+	}
+	if ping := events[2]; ping.Op != "COM_PING" || ping.Status != "OK" || ping.Incomplete {
+		t.Fatalf("unexpected ping event %s", ping)
+	}
+	if stmt := events[3]; stmt.Op != "COM_STMT_CLOSE" || !stmt.Incomplete {
+		t.Fatalf("unexpected close event %s", stmt)
+	}
+	if ping := events[4]; ping.Op != "COM_PING" || ping.Status != "OK" {
+		t.Fatalf("unexpected ping event %s", ping)
+	}
+}
+
+func TestCompressedDataLost(t *testing.T) {
+	caps := testCaps | clientCompress
+	result := frame(1, true,
+		packet(1, []byte{1}),
+		columnDef(2, "id", fieldTypeLong),
+		eofPacket(3),
+		packet(4, lenEncStr("1")),
+		eofPacket(5),
+	)
+	ok := okPacket(1, 0, uint16(statusInAutocommit))
+	query := frame(0, true, packet(0, []byte{comQuery}, []byte("select * from t where name in ("+strings.Repeat("'a', ", 50)+"'b')")))
+	events := replay(t, &Tracker{}, []chunk{
+		{false, serverGreeting(caps)},
+		{true, clientHandshake(caps)},
+		{false, okPacket(2, 0, uint16(statusInAutocommit))},
+		{true, frame(0, true, packet(0, []byte{comQuery}, []byte("select id from t")))},
+		// 压缩帧的中间丢了 帧的边界需要重新同步
+		{false, result[:len(result)-10]},
+		{false, nil},
+		{false, result[len(result)-4:]},
+		{true, frame(0, false, packet(0, []byte{comPing}))},
+		{false, frame(1, true, ok)},
+		{true, query[:len(query)-8]},
+		{true, nil},
+		{true, query[len(query)-4:]},
+		{false, frame(1, false, ok)},
+		{true, frame(0, true, packet(0, []byte{comPing}))},
+		{false, frame(1, false, ok)},
+	})
+
+	if len(events) != 5 {
+		t.Fatalf("expect 5 events, got %v", events)
+	}
+	if ev := events[1]; ev.Op != "COM_QUERY" || !ev.Incomplete || ev.Error != core.ErrDataLost.Error() {
+		t.Fatalf("unexpected query event %s", ev)
+	}
+	if ping := events[2]; ping.Op != "COM_PING" || ping.Status != "OK" || ping.Incomplete {
+		t.Fatalf("unexpected ping event %s", ping)
+	}
+	if ev := events[3]; ev.Op != "COM_QUERY" || !ev.Incomplete || ev.Status != "OK" {
+		t.Fatalf("unexpected query event %s", ev)
+	}
+	if ping := events[4]; ping.Op != "COM_PING" || ping.Status != "OK" {
+		t.Fatalf("unexpected ping event %s", ping)
+	}
+}
+
+func TestOversizedLength(t *testing.T) {
+	// 行数据里的长度远大于包的长度
+	huge := append([]byte{0xfe}, binary.LittleEndian.AppendUint64(nil, 1<<40)...)
+	events := replay(t, &Tracker{MaxRows: 10}, []chunk{
+		{false, serverGreeting(testCaps)},
+		{true, clientHandshake(testCaps)},
+		{false, okPacket(2, 0, uint16(statusInAutocommit))},
+		{true, packet(0, []byte{comQuery}, []byte("select name from t"))},
+		{false, append(append(append(append(
+			packet(1, []byte{1}),
+			columnDef(2, "name", fieldTypeVarString)...),
+			eofPacket(3)...),
+			packet(4, huge, []byte("x"))...),
+			eofPacket(5)...)},
+		{true, packet(0, []byte{comPing})},
+		{false, okPacket(1, 0, uint16(statusInAutocommit))},
+	})
+
+	if query := events[1]; query.Op != "COM_QUERY" || query.Error != ErrMalformPkt.Error() {
+		t.Fatalf("unexpected query event %+v", query)
+	}
+	// 结果集剩下的包作为多余的响应输出 之后的命令正常解码
+	if ping := events[len(events)-1]; ping.Op != "COM_PING" || ping.Status != "OK" {
+		t.Fatalf("unexpected ping event %+v", ping)
+	}
+}
@@ -39,7 +39,7 @@ func (p *Parser) ReadNullStr() (string, error) {
 
 func (p *Parser) Byte() (val int, err error) {
 	var buf [1]byte
-	_, err = p.Reader.Read(buf[:])
+	_, err = io.ReadFull(p.Reader, buf[:])
 	if err != nil {
 		return
 	}
@@ -57,15 +57,100 @@ func (p *Parser) Drop() (err error) {
 	return
 }
 
+// Bytes 读取 n 个字节
+// n 通常来自流量 超过包里剩下的长度时返回 ErrMalformPkt, 不按照 n 分配内存
+func (p *Parser) Bytes(n int) (val []byte, err error) {
+	if n < 0 || n > p.remaining() {
+		return nil, ErrMalformPkt
+	}
+	val = make([]byte, n)
+	_, err = io.ReadFull(p.Reader, val)
+	return
+}
+
+// remaining 包里最多还剩多少字节 不知道时返回包长度的上限
+func (p *Parser) remaining() int {
+	if r, ok := p.Reader.(interface{ remaining() int }); ok {
+		return r.remaining()
+	}
+	return defaultMaxAllowedPacket
+}
+
+// Rest 读取包里剩下的所有数据
+func (p *Parser) Rest() (string, error) {
+	data, err := io.ReadAll(p.Reader)
+	return string(data), err
+}
+
+func (p *Parser) Uint16() (val uint16, err error) {
+	var buf [2]byte
+	if _, err = io.ReadFull(p.Reader, buf[:]); err != nil {
+		return
+	}
+	return binary.LittleEndian.Uint16(buf[:]), nil
+}
+
 func (p *Parser) Uint32() (val uint32, err error) {
 	var buf [4]byte
-	_, err = p.Read(buf[:])
-	if err != nil {
+	if _, err = io.ReadFull(p.Reader, buf[:]); err != nil {
 		return
 	}
 	return binary.LittleEndian.Uint32(buf[:]), nil
 }
 
+func (p *Parser) Uint64() (val uint64, err error) {
+	var buf [8]byte
+	if _, err = io.ReadFull(p.Reader, buf[:]); err != nil {
+		return
+	}
+	return binary.LittleEndian.Uint64(buf[:]), nil
+}
+
+// LenEncInt length encoded integer
+// https://dev.mysql.com/doc/dev/mysql-server/latest/page_protocol_basic_dt_integers.html
+// null 表示读到了 0xfb, 只会出现在结果集的行数据里
+func (p *Parser) LenEncInt() (val uint64, null bool, err error) {
+	var first int
+	if first, err = p.Byte(); err != nil {
+		return
+	}
+
+	switch first {
+	case 0xfb:
+		return 0, true, nil
+	case 0xfc:
+		var v uint16
+		v, err = p.Uint16()
+		return uint64(v), false, err
+	case 0xfd:
+		var buf [4]byte
+		if _, err = io.ReadFull(p.Reader, buf[:3]); err != nil {
+			return
+		}
+		return uint64(binary.LittleEndian.Uint32(buf[:])), false, nil
+	case 0xfe:
+		val, err = p.Uint64()
+		return
+	}
+	return uint64(first), false, nil
+}
+
+// LenEncStr length encoded string
+func (p *Parser) LenEncStr() (val string, null bool, err error) {
+	var n uint64
+	if n, null, err = p.LenEncInt(); err != nil || null {
+		return
+	}
+	if n > defaultMaxAllowedPacket {
+		return "", false, ErrMalformPkt
+	}
+	var buf []byte
+	if buf, err = p.Bytes(int(n)); err != nil {
+		return
+	}
+	return string(buf), false, nil
+}
+
 type ServerHandShake struct {
 	Parser       Parser `json:"-"`
 	ProtoVersion int
@@ -126,7 +211,7 @@ func (s *ServerHandShake) parse() (err error) {
 type ClientHandShake struct {
 	Capabilities  uint32
 	MaxPacketSize int
-	Parser        Parser
+	Parser        Parser `json:"-"`
 	User          string
 	Database      string
 }
@@ -0,0 +1,535 @@
+package mysql
+
+import (
+	"bytes"
+	"fmt"
+)
+
+var (
+	_ Result = (*OK)(nil)
+	_ Result = (*Err)(nil)
+	_ Result = (*EOF)(nil)
+	_ Result = (*ResultSet)(nil)
+	_ Result = (*StmtPrepareOK)(nil)
+	_ Result = (*StatisticsResult)(nil)
+	_ Result = (*LocalInfile)(nil)
+	_ Result = (*AuthSwitch)(nil)
+)
+
+// Result 服务端对一个命令的响应
+// 一个命令可能对应多个 Result, 例如 multi statements 或者存储过程
+type Result interface {
+	Type() string
+}
+
+// Response 一个命令对应的完整响应
+type Response struct {
+	Results []Result `json:"results"`
+}
+
+// Last 最后一个结果决定了这次交互的状态
+func (r *Response) Last() Result {
+	if len(r.Results) == 0 {
+		return nil
+	}
+	return r.Results[len(r.Results)-1]
+}
+
+// OK https://dev.mysql.com/doc/dev/mysql-server/latest/page_protocol_basic_ok_packet.html
+type OK struct {
+	AffectedRows uint64 `json:"affected_rows"`
+	LastInsertID uint64 `json:"last_insert_id"`
+	Status       uint16 `json:"status"`
+	Warnings     uint16 `json:"warnings"`
+	Info         string `json:"info,omitempty"`
+}
+
+func (ok *OK) Type() string {
+	return "OK"
+}
+
+// decode 包头 0x00 或者 0xfe 已经被读取
+func (ok *OK) decode(p *Parser, c *ConnTracker) (err error) {
+	if ok.AffectedRows, _, err = p.LenEncInt(); err != nil {
+		return
+	}
+	if ok.LastInsertID, _, err = p.LenEncInt(); err != nil {
+		return
+	}
+	if ok.Status, err = p.Uint16(); err != nil {
+		return
+	}
+	if ok.Warnings, err = p.Uint16(); err != nil {
+		return
+	}
+
+	// info 是可选的
+	if c.clientCaps()&clientSessionTrack != 0 {
+		if ok.Info, _, err = p.LenEncStr(); err != nil {
+			return nil
+		}
+		return
+	}
+	ok.Info, err = p.Rest()
+	return
+}
+
+// Err https://dev.mysql.com/doc/dev/mysql-server/latest/page_protocol_basic_err_packet.html
+type Err struct {
+	Code     uint16 `json:"code"`
+	SQLState string `json:"sql_state"`
+	Message  string `json:"message"`
+}
+
+func (e *Err) Type() string {
+	return "ERR"
+}
+
+func (e *Err) Error() string {
+	return fmt.Sprintf("Error %d (%s): %s", e.Code, e.SQLState, e.Message)
+}
+
+func (e *Err) decode(p *Parser, c *ConnTracker) (err error) {
+	if e.Code, err = p.Uint16(); err != nil {
+		return
+	}
+
+	var msg string
+	if msg, err = p.Rest(); err != nil {
+		return
+	}
+	// protocol 41 之后 message 前面有 '#' 和 5 个字节的 sql state
+	if len(msg) >= 6 && msg[0] == '#' {
+		e.SQLState = msg[1:6]
+		msg = msg[6:]
+	}
+	e.Message = msg
+	return
+}
+
+// EOF https://dev.mysql.com/doc/dev/mysql-server/latest/page_protocol_basic_eof_packet.html
+type EOF struct {
+	Warnings uint16 `json:"warnings"`
+	Status   uint16 `json:"status"`
+}
+
+func (e *EOF) Type() string {
+	return "EOF"
+}
+
+func (e *EOF) decode(p *Parser, c *ConnTracker) (err error) {
+	if e.Warnings, err = p.Uint16(); err != nil {
+		return
+	}
+	e.Status, err = p.Uint16()
+	return
+}
+
+// Column Protocol::ColumnDefinition41
+// https://dev.mysql.com/doc/dev/mysql-server/latest/page_protocol_com_query_response_text_resultset_column_definition.html
+type Column struct {
+	Schema    string    `json:"schema"`
+	Table     string    `json:"table"`
+	OrgTable  string    `json:"org_table"`
+	Name      string    `json:"name"`
+	OrgName   string    `json:"org_name"`
+	Charset   uint16    `json:"charset"`
+	Length    uint32    `json:"length"`
+	FieldType fieldType `json:"field_type"`
+	Flags     fieldFlag `json:"flags"`
+	Decimals  byte      `json:"decimals"`
+}
+
+func (col *Column) decode(p *Parser) (err error) {
+	// catalog 总是 def
+	if _, _, err = p.LenEncStr(); err != nil {
+		return
+	}
+	for _, field := range []*string{&col.Schema, &col.Table, &col.OrgTable, &col.Name, &col.OrgName} {
+		if *field, _, err = p.LenEncStr(); err != nil {
+			return
+		}
+	}
+	// 固定长度字段的长度 总是 0x0c
+	if _, _, err = p.LenEncInt(); err != nil {
+		return
+	}
+	if col.Charset, err = p.Uint16(); err != nil {
+		return
+	}
+	if col.Length, err = p.Uint32(); err != nil {
+		return
+	}
+
+	var b int
+	if b, err = p.Byte(); err != nil {
+		return
+	}
+	col.FieldType = fieldType(b)
+
+	var flags uint16
+	if flags, err = p.Uint16(); err != nil {
+		return
+	}
+	col.Flags = fieldFlag(flags)
+
+	if b, err = p.Byte(); err != nil {
+		return
+	}
+	col.Decimals = byte(b)
+	return
+}
+
+// ResultSet 文本协议或者二进制协议的结果集
+type ResultSet struct {
+	Columns []*Column `json:"columns"`
+	Rows    int       `json:"rows"`
+	// Values 文本协议的行数据 最多保留 Tracker.MaxRows 行
+	Values [][]*string `json:"values,omitempty"`
+	// End 结束结果集的 EOF 或者 OK, 读取行的时候出错则是 ERR
+	End Result `json:"end"`
+}
+
+func (r *ResultSet) Type() string {
+	return "RESULTSET"
+}
+
+// StmtPrepareOK COM_STMT_PREPARE 成功时的响应
+// https://dev.mysql.com/doc/dev/mysql-server/latest/page_protocol_com_stmt_prepare.html
+type StmtPrepareOK struct {
+	StmtID     uint32    `json:"stmt_id"`
+	NumColumns uint16    `json:"num_columns"`
+	NumParams  uint16    `json:"num_params"`
+	Warnings   uint16    `json:"warnings"`
+	Params     []*Column `json:"params,omitempty"`
+	Columns    []*Column `json:"columns,omitempty"`
+}
+
+func (s *StmtPrepareOK) Type() string {
+	return "PREPARE_OK"
+}
+
+func (s *StmtPrepareOK) decode(p *Parser, c *ConnTracker) (err error) {
+	if s.StmtID, err = p.Uint32(); err != nil {
+		return
+	}
+	if s.NumColumns, err = p.Uint16(); err != nil {
+		return
+	}
+	if s.NumParams, err = p.Uint16(); err != nil {
+		return
+	}
+	if err = p.DropN(1); err != nil {
+		return
+	}
+	// warning count 是可选的
+	if s.Warnings, err = p.Uint16(); err != nil {
+		return nil
+	}
+	return
+}
+
+// StatisticsResult COM_STATISTICS 的响应 是一个可读的字符串
+type StatisticsResult struct {
+	Info string `json:"info"`
+}
+
+func (s *StatisticsResult) Type() string {
+	return "STATISTICS"
+}
+
+// LocalInfile LOAD DATA LOCAL INFILE 服务端要求客户端发送文件
+type LocalInfile struct {
+	Filename string `json:"filename"`
+}
+
+func (l *LocalInfile) Type() string {
+	return "LOCAL_INFILE"
+}
+
+// AuthSwitch 服务端要求客户端切换认证方式
+type AuthSwitch struct {
+	Plugin string `json:"plugin"`
+}
+
+func (a *AuthSwitch) Type() string {
+	return "AUTH_SWITCH"
+}
+
+// resultStatus 结果中的状态 用于判断是否还有下一个结果
+func resultStatus(r Result) statusFlag {
+	switch v := r.(type) {
+	case *OK:
+		return statusFlag(v.Status)
+	case *EOF:
+		return statusFlag(v.Status)
+	case *ResultSet:
+		return resultStatus(v.End)
+	}
+	return 0
+}
+
+// nextPacket 丢弃当前包剩下的数据 读取下一个包的第一个字节
+// 同一个响应中的包 sequence id 是连续的
+func (c *ConnTracker) nextPacket() (header byte, parser *Parser, err error) {
+	if c.respPacket.started {
+		c.respPacket.expect = (c.respPacket.seqId + 1) & 0xff
+	}
+	c.respPacket.Close()
+	var buf [1]byte
+	if _, err = c.respPacket.Read(buf[:]); err != nil {
+		return
+	}
+	return buf[0], &Parser{Reader: &c.respPacket}, nil
+}
+
+// unread 把已经读出的第一个字节放回去
+func unread(header byte, p *Parser) *Parser {
+	return &Parser{Reader: &unreadReader{header: bytes.NewReader([]byte{header}), rest: p}}
+}
+
+// unreadReader 先读放回去的字节 再读原来的包 保留包的剩余长度
+type unreadReader struct {
+	header *bytes.Reader
+	rest   *Parser
+}
+
+func (r *unreadReader) Read(p []byte) (int, error) {
+	if r.header.Len() > 0 {
+		return r.header.Read(p)
+	}
+	return r.rest.Read(p)
+}
+
+func (r *unreadReader) remaining() int {
+	return r.header.Len() + r.rest.remaining()
+}
+
+// isEOF 0xfe 开头的短包是 EOF, 开启 CLIENT_DEPRECATE_EOF 之后是 OK
+func (c *ConnTracker) isEOF(header byte) bool {
+	if header != iEOF {
+		return false
+	}
+	if c.clientCaps()&clientDeprecateEOF != 0 {
+		return c.respPacket.length() < maxPacketSize
+	}
+	return c.respPacket.length() < 9
+}
+
+// readEnd 解析结果集结束的包
+func (c *ConnTracker) readEnd(header byte, p *Parser) (Result, error) {
+	if header == iERR {
+		e := &Err{}
+		return e, e.decode(p, c)
+	}
+	if c.clientCaps()&clientDeprecateEOF != 0 {
+		ok := &OK{}
+		return ok, ok.decode(p, c)
+	}
+	eof := &EOF{}
+	return eof, eof.decode(p, c)
+}
+
+// readColumns 读取 n 个列定义 以及后面的 EOF
+func (c *ConnTracker) readColumns(n int) (cols []*Column, err error) {
+	var (
+		header byte
+		p      *Parser
+	)
+	for i := 0; i < n; i++ {
+		if header, p, err = c.nextPacket(); err != nil {
+			return
+		}
+		col := &Column{}
+		if err = col.decode(unread(header, p)); err != nil {
+			return
+		}
+		cols = append(cols, col)
+		p.Drop()
+	}
+	if n == 0 || c.clientCaps()&clientDeprecateEOF != 0 {
+		return
+	}
+	if _, p, err = c.nextPacket(); err != nil {
+		return
+	}
+	err = p.Drop()
+	return
+}
+
+// readRows 读取行数据直到 EOF/OK 或者 ERR
+func (c *ConnTracker) readRows(rs *ResultSet, binary bool) (err error) {
+	for {
+		var (
+			header byte
+			p      *Parser
+		)
+		if header, p, err = c.nextPacket(); err != nil {
+			return
+		}
+		if header == iERR || c.isEOF(header) {
+			rs.End, err = c.readEnd(header, p)
+			return
+		}
+		rs.Rows++
+
+		if binary || rs.Rows > c.tracker.MaxRows {
+			p.Drop()
+			continue
+		}
+
+		// 文本协议的行 第一个字节已经被读取
+		row := make([]*string, 0, len(rs.Columns))
+		p = unread(header, p)
+		for range rs.Columns {
+			var (
+				val  string
+				null bool
+			)
+			if val, null, err = p.LenEncStr(); err != nil {
+				return
+			}
+			if null {
+				row = append(row, nil)
+			} else {
+				row = append(row, &val)
+			}
+		}
+		rs.Values = append(rs.Values, row)
+		p.Drop()
+	}
+}
+
+// readResultSet 第一个包是列的数量
+func (c *ConnTracker) readResultSet(header byte, p *Parser, binary bool) (rs *ResultSet, err error) {
+	rs = &ResultSet{}
+	var n uint64
+	if n, _, err = unread(header, p).LenEncInt(); err != nil {
+		return
+	}
+	p.Drop()
+
+	if rs.Columns, err = c.readColumns(int(n)); err != nil {
+		return
+	}
+	err = c.readRows(rs, binary)
+	return
+}
+
+// readResult 读取一个结果
+// header 是第一个包的第一个字节
+func (c *ConnTracker) readResult(command Command, header byte, p *Parser) (result Result, err error) {
+	if header == iERR {
+		e := &Err{}
+		return e, e.decode(p, c)
+	}
+
+	switch command.(type) {
+	case *StmtPrepare:
+		ok := &StmtPrepareOK{}
+		if err = ok.decode(p, c); err != nil {
+			return ok, err
+		}
+		if ok.Params, err = c.readColumns(int(ok.NumParams)); err != nil {
+			return ok, err
+		}
+		ok.Columns, err = c.readColumns(int(ok.NumColumns))
+		return ok, err
+	case *Statistics:
+		s := &StatisticsResult{}
+		s.Info, err = p.Rest()
+		s.Info = string(header) + s.Info
+		return s, err
+	case *FieldList:
+		rs := &ResultSet{}
+		for !c.isEOF(header) {
+			col := &Column{}
+			if err = col.decode(unread(header, p)); err != nil {
+				return rs, err
+			}
+			rs.Columns = append(rs.Columns, col)
+			if header, p, err = c.nextPacket(); err != nil {
+				return rs, err
+			}
+		}
+		rs.End, err = c.readEnd(header, p)
+		return rs, err
+	case *StmtFetch:
+		rs := &ResultSet{}
+		if c.isEOF(header) {
+			rs.End, err = c.readEnd(header, p)
+			return rs, err
+		}
+		rs.Rows++
+		p.Drop()
+		err = c.readRows(rs, true)
+		return rs, err
+	}
+
+	switch header {
+	case iOK:
+		ok := &OK{}
+		return ok, ok.decode(p, c)
+	case iEOF:
+		if c.isEOF(header) {
+			eof := &EOF{}
+			return eof, eof.decode(p, c)
+		}
+	case iLocalInFile:
+		infile := &LocalInfile{}
+		infile.Filename, err = p.Rest()
+		c.setPhase(phaseInfile)
+		return infile, err
+	}
+
+	_, binary := command.(*StmtExecute)
+	return c.readResultSet(header, p, binary)
+}
+
+// readResponse 读取一个命令的完整响应
+func (c *ConnTracker) readResponse(command Command, header byte, p *Parser) (resp *Response, err error) {
+	resp = &Response{}
+	for {
+		var result Result
+		result, err = c.readResult(command, header, p)
+		if result != nil {
+			resp.Results = append(resp.Results, result)
+		}
+		if err != nil {
+			return
+		}
+
+		// LOAD DATA LOCAL INFILE 需要等客户端发送完文件
+		if _, ok := result.(*LocalInfile); ok {
+			if header, p, err = c.nextPacket(); err != nil {
+				return
+			}
+			continue
+		}
+		if resultStatus(result)&statusMoreResultsExists == 0 {
+			return
+		}
+		if header, p, err = c.nextPacket(); err != nil {
+			return
+		}
+	}
+}
+
+// readAuthResult 握手或者 COM_CHANGE_USER 之后的认证结果
+// 返回 nil 表示认证还没有结束
+func (c *ConnTracker) readAuthResult(header byte, p *Parser) (result Result, err error) {
+	switch header {
+	case iOK:
+		ok := &OK{}
+		return ok, ok.decode(p, c)
+	case iERR:
+		e := &Err{}
+		return e, e.decode(p, c)
+	case iEOF:
+		auth := &AuthSwitch{}
+		auth.Plugin, err = p.ReadNullStr()
+		return auth, err
+	}
+	// iAuthMoreData
+	return nil, p.Drop()
+}
@@ -0,0 +1,392 @@
+package mysql
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Stmt 通过 COM_STMT_PREPARE 创建的预处理语句
+// 保存在连接上 直到 COM_STMT_CLOSE 或者连接断开
+type Stmt struct {
+	ID        uint32
+	Query     string
+	NumParams int
+	Params    []*Column
+	Columns   []*Column
+
+	// paramTypes 上一次 COM_STMT_EXECUTE 绑定的参数类型
+	// new-params-bound-flag 为 0 时沿用上一次的类型
+	paramTypes []paramType
+	// paramNames 开启 CLIENT_QUERY_ATTRIBUTES 时参数的名字 属性在语句的参数之后
+	paramNames []string
+	// longData COM_STMT_SEND_LONG_DATA 发送的参数长度
+	longData map[uint16]int
+}
+
+// paramType 参数类型 最高位表示无符号
+type paramType struct {
+	FieldType fieldType
+	Unsigned  bool
+}
+
+// LongData COM_STMT_SEND_LONG_DATA 发送的参数 不记录内容
+type LongData struct {
+	Size int `json:"size"`
+}
+
+func (c *ConnTracker) addStmt(query string, ok *StmtPrepareOK) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.stmts == nil {
+		c.stmts = make(map[uint32]*Stmt)
+	}
+	c.stmts[ok.StmtID] = &Stmt{
+		ID:        ok.StmtID,
+		Query:     query,
+		NumParams: int(ok.NumParams),
+		Params:    ok.Params,
+		Columns:   ok.Columns,
+	}
+}
+
+func (c *ConnTracker) getStmt(id uint32) *Stmt {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.stmts[id]
+}
+
+func (c *ConnTracker) closeStmt(id uint32) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	delete(c.stmts, id)
+}
+
+// closeStmts 连接断开时清理所有的预处理语句
+func (c *ConnTracker) closeStmts() {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.stmts = nil
+}
+
+// addLongData 记录 COM_STMT_SEND_LONG_DATA 发送的长度 执行之后清空
+func (c *ConnTracker) addLongData(id uint32, param uint16, size int) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	stmt := c.stmts[id]
+	if stmt == nil {
+		return
+	}
+	if stmt.longData == nil {
+		stmt.longData = make(map[uint16]int)
+	}
+	stmt.longData[param] += size
+}
+
+// decodeParams 解析 COM_STMT_EXECUTE 中的参数和属性
+// https://dev.mysql.com/doc/dev/mysql-server/latest/page_protocol_com_stmt_execute.html
+func (c *ConnTracker) decodeParams(stmt *Stmt, flags byte, p *Parser) (params []interface{}, attrs map[string]interface{}, err error) {
+	n := stmt.NumParams
+	named := c.clientCaps()&clientQueryAttributes != 0
+	if named && flags&parameterCountAvailable != 0 {
+		var count uint64
+		if count, _, err = p.LenEncInt(); err != nil {
+			return
+		}
+		// parameter_count 包括语句的参数和属性
+		if count < uint64(n) || count > uint64(p.remaining()) {
+			return nil, nil, ErrMalformPkt
+		}
+		n = int(count)
+	}
+	if n == 0 {
+		return
+	}
+
+	var nullBitmap []byte
+	if nullBitmap, err = p.Bytes((n + 7) / 8); err != nil {
+		return
+	}
+
+	var bound int
+	if bound, err = p.Byte(); err != nil {
+		return
+	}
+
+	c.mtx.Lock()
+	if bound == 1 {
+		if stmt.paramTypes, stmt.paramNames, err = p.paramTypes(n, named); err != nil {
+			c.mtx.Unlock()
+			return
+		}
+	}
+	types, names := stmt.paramTypes, stmt.paramNames
+	longData := stmt.longData
+	stmt.longData = nil
+	c.mtx.Unlock()
+
+	if len(types) != n || (named && len(names) != n) {
+		return nil, nil, fmt.Errorf("unknown parameter types of statement %d", stmt.ID)
+	}
+
+	if stmt.NumParams > 0 {
+		params = make([]interface{}, stmt.NumParams)
+	}
+	for i := 0; i < n; i++ {
+		if size, ok := longData[uint16(i)]; ok && i < stmt.NumParams {
+			params[i] = &LongData{Size: size}
+			continue
+		}
+		var val interface{}
+		if nullBitmap[i/8]&(1<<(i%8)) == 0 {
+			if val, err = p.binaryValue(types[i]); err != nil {
+				return
+			}
+		}
+		if i < stmt.NumParams {
+			params[i] = val
+			continue
+		}
+		// 语句的参数之后是属性
+		if attrs == nil {
+			attrs = make(map[string]interface{}, n-stmt.NumParams)
+		}
+		attrs[names[i]] = val
+	}
+	return
+}
+
+// paramTypes 读取 n 个参数的类型 named 为 true 时每个类型后面跟着参数的名字
+func (p *Parser) paramTypes(n int, named bool) (types []paramType, names []string, err error) {
+	types = make([]paramType, n)
+	if named {
+		names = make([]string, n)
+	}
+	for i := range types {
+		var t uint16
+		if t, err = p.Uint16(); err != nil {
+			return
+		}
+		types[i] = paramType{
+			FieldType: fieldType(t),
+			Unsigned:  t&0x8000 != 0,
+		}
+		if named {
+			if names[i], _, err = p.LenEncStr(); err != nil {
+				return
+			}
+		}
+	}
+	return
+}
+
+// binaryValue 二进制协议中的一个值
+// https://dev.mysql.com/doc/dev/mysql-server/latest/page_protocol_binary_resultset.html#sect_protocol_binary_resultset_row_value
+func (p *Parser) binaryValue(t paramType) (val interface{}, err error) {
+	switch t.FieldType {
+	case fieldTypeNULL:
+		return nil, nil
+	case fieldTypeTiny:
+		var b int
+		if b, err = p.Byte(); err != nil || t.Unsigned {
+			return b, err
+		}
+		return int8(b), nil
+	case fieldTypeShort, fieldTypeYear:
+		var v uint16
+		if v, err = p.Uint16(); err != nil || t.Unsigned {
+			return v, err
+		}
+		return int16(v), nil
+	case fieldTypeLong, fieldTypeInt24:
+		var v uint32
+		if v, err = p.Uint32(); err != nil || t.Unsigned {
+			return v, err
+		}
+		return int32(v), nil
+	case fieldTypeLongLong:
+		var v uint64
+		if v, err = p.Uint64(); err != nil || t.Unsigned {
+			return v, err
+		}
+		return int64(v), nil
+	case fieldTypeFloat:
+		var v uint32
+		v, err = p.Uint32()
+		return math.Float32frombits(v), err
+	case fieldTypeDouble:
+		var v uint64
+		v, err = p.Uint64()
+		return math.Float64frombits(v), err
+	case fieldTypeDate, fieldTypeNewDate, fieldTypeDateTime, fieldTypeTimestamp:
+		return p.binaryDateTime(t.FieldType)
+	case fieldTypeTime:
+		return p.binaryTime()
+	}
+
+	// 其他类型都是 length encoded string
+	var s string
+	s, _, err = p.LenEncStr()
+	return s, err
+}
+
+// binaryDateTime 长度为 0 4 7 11
+func (p *Parser) binaryDateTime(t fieldType) (val string, err error) {
+	var n int
+	if n, err = p.Byte(); err != nil {
+		return
+	}
+	var buf []byte
+	if buf, err = p.Bytes(n); err != nil {
+		return
+	}
+
+	var (
+		year                 int
+		month, day           byte
+		hour, minute, second byte
+		micro                uint32
+	)
+	if n >= 4 {
+		year = int(buf[0]) | int(buf[1])<<8
+		month, day = buf[2], buf[3]
+	}
+	if n >= 7 {
+		hour, minute, second = buf[4], buf[5], buf[6]
+	}
+	if n >= 11 {
+		micro = uint32(buf[7]) | uint32(buf[8])<<8 | uint32(buf[9])<<16 | uint32(buf[10])<<24
+	}
+
+	val = fmt.Sprintf("%04d-%02d-%02d", year, month, day)
+	if t == fieldTypeDate || t == fieldTypeNewDate {
+		return
+	}
+	val += fmt.Sprintf(" %02d:%02d:%02d", hour, minute, second)
+	if micro != 0 {
+		val += fmt.Sprintf(".%06d", micro)
+	}
+	return
+}
+
+// binaryTime 长度为 0 8 12
+func (p *Parser) binaryTime() (val string, err error) {
+	var n int
+	if n, err = p.Byte(); err != nil {
+		return
+	}
+	var buf []byte
+	if buf, err = p.Bytes(n); err != nil {
+		return
+	}
+	if n < 8 {
+		return "00:00:00", nil
+	}
+
+	sign := ""
+	if buf[0] == 1 {
+		sign = "-"
+	}
+	days := int(buf[1]) | int(buf[2])<<8 | int(buf[3])<<16 | int(buf[4])<<24
+	hours := days*24 + int(buf[5])
+	val = fmt.Sprintf("%s%02d:%02d:%02d", sign, hours, buf[6], buf[7])
+	if n >= 12 {
+		micro := uint32(buf[8]) | uint32(buf[9])<<8 | uint32(buf[10])<<16 | uint32(buf[11])<<24
+		if micro != 0 {
+			val += fmt.Sprintf(".%06d", micro)
+		}
+	}
+	return
+}
+
+// interpolate 把参数填入语句中的 ? 占位符
+// 跳过字符串 反引号标识符和注释中的 ?
+func interpolate(query string, params []interface{}) string {
+	var (
+		sb    strings.Builder
+		index int
+	)
+	for i := 0; i < len(query); i++ {
+		ch := query[i]
+		switch {
+		case ch == '\'' || ch == '"' || ch == '`':
+			end := i + 1
+			for end < len(query) && query[end] != ch {
+				if query[end] == '\\' && ch != '`' {
+					end++
+				}
+				end++
+			}
+			if end >= len(query) {
+				end = len(query) - 1
+			}
+			sb.WriteString(query[i : end+1])
+			i = end
+		case ch == '#' || (ch == '-' && strings.HasPrefix(query[i:], "-- ")):
+			end := strings.IndexByte(query[i:], '\n')
+			if end < 0 {
+				end = len(query) - i - 1
+			}
+			sb.WriteString(query[i : i+end+1])
+			i += end
+		case ch == '/' && strings.HasPrefix(query[i:], "/*"):
+			end := strings.Index(query[i+2:], "*/")
+			if end < 0 {
+				end = len(query) - i - 4
+			}
+			sb.WriteString(query[i : i+end+4])
+			i += end + 3
+		case ch == '?' && index < len(params):
+			sb.WriteString(renderParam(params[index]))
+			index++
+		default:
+			sb.WriteByte(ch)
+		}
+	}
+	return sb.String()
+}
+
+// renderParam 把参数渲染成 sql 字面量
+func renderParam(param interface{}) string {
+	switch v := param.(type) {
+	case nil:
+		return "NULL"
+	case string:
+		if !utf8.ValidString(v) {
+			return fmt.Sprintf("X'%x'", v)
+		}
+		return quote(v)
+	case float32:
+		return strconv.FormatFloat(float64(v), 'g', -1, 32)
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	case *LongData:
+		return fmt.Sprintf("'<long data %d bytes>'", v.Size)
+	}
+	return fmt.Sprint(param)
+}
+
+func quote(s string) string {
+	var sb strings.Builder
+	sb.WriteByte('\'')
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\'':
+			sb.WriteString(`\'`)
+		case '\\':
+			sb.WriteString(`\\`)
+		case 0:
+			sb.WriteString(`\0`)
+		case '\n':
+			sb.WriteString(`\n`)
+		case '\r':
+			sb.WriteString(`\r`)
+		default:
+			sb.WriteByte(s[i])
+		}
+	}
+	sb.WriteByte('\'')
+	return sb.String()
+}
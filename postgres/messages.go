@@ -0,0 +1,444 @@
+package postgres
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+)
+
+// 客户端发送的消息类型
+// https://www.postgresql.org/docs/current/protocol-message-formats.html
+const (
+	msgQuery        = 'Q'
+	msgParse        = 'P'
+	msgBind         = 'B'
+	msgDescribe     = 'D'
+	msgExecute      = 'E'
+	msgSync         = 'S'
+	msgFlush        = 'H'
+	msgClose        = 'C'
+	msgTerminate    = 'X'
+	msgPassword     = 'p'
+	msgFunctionCall = 'F'
+	msgCopyData     = 'd'
+	msgCopyDone     = 'c'
+	msgCopyFail     = 'f'
+)
+
+// 服务端发送的消息类型
+const (
+	msgAuthentication       = 'R'
+	msgParameterStatus      = 'S'
+	msgBackendKeyData       = 'K'
+	msgReadyForQuery        = 'Z'
+	msgRowDescription       = 'T'
+	msgDataRow              = 'D'
+	msgCommandComplete      = 'C'
+	msgErrorResponse        = 'E'
+	msgNoticeResponse       = 'N'
+	msgEmptyQueryResponse   = 'I'
+	msgPortalSuspended      = 's'
+	msgNotificationResponse = 'A'
+)
+
+// 没有类型的消息 用版本号区分
+const (
+	protocolVersion3 = 196608
+	sslRequestCode   = 80877103
+	gssEncRequest    = 80877104
+	cancelRequest    = 80877102
+)
+
+const (
+	// maxMessage 超过这个长度的消息不解析
+	maxMessage = 16 << 20
+	// maxStartup startup 消息不会很长
+	maxStartup = 10000
+)
+
+var ErrMalformMsg = errors.New("malformed postgres message")
+
+var messageNames = map[byte]string{
+	msgQuery:        "Query",
+	msgParse:        "Parse",
+	msgBind:         "Bind",
+	msgDescribe:     "Describe",
+	msgExecute:      "Execute",
+	msgSync:         "Sync",
+	msgFlush:        "Flush",
+	msgClose:        "Close",
+	msgTerminate:    "Terminate",
+	msgFunctionCall: "FunctionCall",
+}
+
+// message 一个带类型的消息
+// body 为空表示没有解析 只记录了长度
+type message struct {
+	typ  byte
+	body []byte
+	// size 消息的总长度 包括类型和长度
+	size int
+}
+
+// readMessage 读取 类型 + 长度 + 内容 的消息
+// skip 中的类型只计算长度 例如 DataRow
+func readMessage(r *bufio.Reader, skip func(byte) bool) (msg message, err error) {
+	var hdr [5]byte
+	if _, err = io.ReadFull(r, hdr[:]); err != nil {
+		return
+	}
+	msg.typ = hdr[0]
+	n := int(binary.BigEndian.Uint32(hdr[1:])) - 4
+	if n < 0 {
+		return msg, ErrMalformMsg
+	}
+	msg.size = n + 5
+
+	if n > maxMessage || skip(msg.typ) {
+		_, err = r.Discard(n)
+		return
+	}
+	msg.body = make([]byte, n)
+	_, err = io.ReadFull(r, msg.body)
+	return
+}
+
+// readStartup 读取没有类型的消息 返回版本号或者请求码
+func readStartup(r *bufio.Reader) (code int, body []byte, err error) {
+	var hdr [8]byte
+	if _, err = io.ReadFull(r, hdr[:]); err != nil {
+		return
+	}
+	n := int(binary.BigEndian.Uint32(hdr[:4])) - 8
+	if n < 0 || n > maxStartup {
+		return 0, nil, ErrMalformMsg
+	}
+	code = int(binary.BigEndian.Uint32(hdr[4:]))
+	body = make([]byte, n)
+	_, err = io.ReadFull(r, body)
+	return
+}
+
+// buffer 解析消息的内容 数据不足时返回零值并记录错误
+type buffer struct {
+	b   []byte
+	err error
+}
+
+func (b *buffer) next(n int) []byte {
+	if b.err != nil || n < 0 || len(b.b) < n {
+		b.err = ErrMalformMsg
+		return nil
+	}
+	data := b.b[:n]
+	b.b = b.b[n:]
+	return data
+}
+
+func (b *buffer) byte() byte {
+	if data := b.next(1); data != nil {
+		return data[0]
+	}
+	return 0
+}
+
+func (b *buffer) int16() int16 {
+	if data := b.next(2); data != nil {
+		return int16(binary.BigEndian.Uint16(data))
+	}
+	return 0
+}
+
+func (b *buffer) int32() int32 {
+	if data := b.next(4); data != nil {
+		return int32(binary.BigEndian.Uint32(data))
+	}
+	return 0
+}
+
+// cstring 以 0 结尾的字符串
+func (b *buffer) cstring() string {
+	if b.err != nil {
+		return ""
+	}
+	for i, c := range b.b {
+		if c == 0 {
+			s := string(b.b[:i])
+			b.b = b.b[i+1:]
+			return s
+		}
+	}
+	b.err = ErrMalformMsg
+	return ""
+}
+
+// Startup StartupMessage 中的参数
+type Startup struct {
+	Version         string            `json:"version"`
+	User            string            `json:"user"`
+	Database        string            `json:"database,omitempty"`
+	ApplicationName string            `json:"application_name,omitempty"`
+	Params          map[string]string `json:"params,omitempty"`
+}
+
+func parseStartup(code int, body []byte) (*Startup, error) {
+	s := &Startup{Version: fmt.Sprintf("%d.%d", code>>16, code&0xffff)}
+	b := &buffer{b: body}
+	for b.err == nil && len(b.b) > 1 {
+		key, val := b.cstring(), b.cstring()
+		switch key {
+		case "user":
+			s.User = val
+		case "database":
+			s.Database = val
+		case "application_name":
+			s.ApplicationName = val
+		default:
+			if s.Params == nil {
+				s.Params = make(map[string]string)
+			}
+			s.Params[key] = val
+		}
+	}
+	return s, b.err
+}
+
+// Statement 扩展协议中执行的一个语句
+type Statement struct {
+	// Name 预处理语句的名字 为空表示匿名语句
+	Name   string        `json:"name,omitempty"`
+	Portal string        `json:"portal,omitempty"`
+	Query  string        `json:"query"`
+	Params []interface{} `json:"params,omitempty"`
+	// MaxRows Execute 返回的最大行数 0 表示不限制
+	MaxRows int32 `json:"max_rows,omitempty"`
+}
+
+// stmt Parse 创建的语句
+type stmt struct {
+	query      string
+	paramTypes []uint32
+}
+
+// portal Bind 创建的 portal
+type portal struct {
+	name   string
+	stmt   *stmt
+	params []interface{}
+}
+
+func parseParse(body []byte) (name string, s *stmt, err error) {
+	b := &buffer{b: body}
+	name = b.cstring()
+	s = &stmt{query: b.cstring()}
+	n := int(b.int16())
+	for i := 0; i < n && b.err == nil; i++ {
+		s.paramTypes = append(s.paramTypes, uint32(b.int32()))
+	}
+	return name, s, b.err
+}
+
+// parseBind 参数的格式 0 个表示都是文本 1 个表示所有参数使用同一个格式
+func parseBind(body []byte, stmts map[string]*stmt) (name string, p *portal, err error) {
+	b := &buffer{b: body}
+	name = b.cstring()
+	stmtName := b.cstring()
+	p = &portal{name: stmtName, stmt: stmts[stmtName]}
+
+	formats := make([]int16, b.int16())
+	for i := range formats {
+		formats[i] = b.int16()
+	}
+	n := int(b.int16())
+	for i := 0; i < n && b.err == nil; i++ {
+		size := int(b.int32())
+		if size < 0 {
+			p.params = append(p.params, nil)
+			continue
+		}
+		data := b.next(size)
+		var format int16
+		switch {
+		case len(formats) == 1:
+			format = formats[0]
+		case i < len(formats):
+			format = formats[i]
+		}
+		if format == 0 {
+			p.params = append(p.params, string(data))
+			continue
+		}
+		var oid uint32
+		if p.stmt != nil && i < len(p.stmt.paramTypes) {
+			oid = p.stmt.paramTypes[i]
+		}
+		p.params = append(p.params, binaryValue(oid, data))
+	}
+	return name, p, b.err
+}
+
+// 常用类型的 oid
+const (
+	oidBool   = 16
+	oidInt8   = 20
+	oidInt2   = 21
+	oidInt4   = 23
+	oidFloat4 = 700
+	oidFloat8 = 701
+)
+
+// binaryValue 二进制格式的参数 不认识的类型输出十六进制
+func binaryValue(oid uint32, data []byte) interface{} {
+	switch {
+	case oid == oidBool && len(data) == 1:
+		return data[0] != 0
+	case oid == oidInt2 && len(data) == 2:
+		return int16(binary.BigEndian.Uint16(data))
+	case oid == oidInt4 && len(data) == 4:
+		return int32(binary.BigEndian.Uint32(data))
+	case oid == oidInt8 && len(data) == 8:
+		return int64(binary.BigEndian.Uint64(data))
+	case oid == oidFloat4 && len(data) == 4:
+		f := math.Float32frombits(binary.BigEndian.Uint32(data))
+		if special, ok := specialFloat(float64(f)); ok {
+			return special
+		}
+		return f
+	case oid == oidFloat8 && len(data) == 8:
+		f := math.Float64frombits(binary.BigEndian.Uint64(data))
+		if special, ok := specialFloat(f); ok {
+			return special
+		}
+		return f
+	}
+	return `\x` + hex.EncodeToString(data)
+}
+
+// specialFloat json 不能表示 NaN 和 Infinity, 使用 postgres 的文本格式
+func specialFloat(f float64) (string, bool) {
+	switch {
+	case math.IsNaN(f):
+		return "NaN", true
+	case math.IsInf(f, 1):
+		return "Infinity", true
+	case math.IsInf(f, -1):
+		return "-Infinity", true
+	}
+	return "", false
+}
+
+// Column RowDescription 中的一列
+type Column struct {
+	Name     string `json:"name"`
+	TableOID uint32 `json:"table_oid,omitempty"`
+	TypeOID  uint32 `json:"type_oid"`
+	Format   int16  `json:"format,omitempty"`
+}
+
+func parseRowDescription(body []byte) (columns []*Column, err error) {
+	b := &buffer{b: body}
+	n := int(b.int16())
+	for i := 0; i < n && b.err == nil; i++ {
+		col := &Column{Name: b.cstring(), TableOID: uint32(b.int32())}
+		b.int16()
+		col.TypeOID = uint32(b.int32())
+		b.int16()
+		b.int32()
+		col.Format = b.int16()
+		columns = append(columns, col)
+	}
+	return columns, b.err
+}
+
+// Error ErrorResponse 或者 NoticeResponse
+// https://www.postgresql.org/docs/current/protocol-error-fields.html
+type Error struct {
+	Severity   string `json:"severity"`
+	Code       string `json:"code"`
+	Message    string `json:"message"`
+	Detail     string `json:"detail,omitempty"`
+	Hint       string `json:"hint,omitempty"`
+	Position   string `json:"position,omitempty"`
+	Where      string `json:"where,omitempty"`
+	Schema     string `json:"schema,omitempty"`
+	Table      string `json:"table,omitempty"`
+	Column     string `json:"column,omitempty"`
+	Constraint string `json:"constraint,omitempty"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s %s: %s", e.Severity, e.Code, e.Message)
+}
+
+func parseError(body []byte) (*Error, error) {
+	e := &Error{}
+	b := &buffer{b: body}
+	for b.err == nil {
+		field := b.byte()
+		if field == 0 {
+			break
+		}
+		val := b.cstring()
+		switch field {
+		case 'S':
+			// V 是不会被翻译的 severity
+			if e.Severity == "" {
+				e.Severity = val
+			}
+		case 'V':
+			e.Severity = val
+		case 'C':
+			e.Code = val
+		case 'M':
+			e.Message = val
+		case 'D':
+			e.Detail = val
+		case 'H':
+			e.Hint = val
+		case 'P':
+			e.Position = val
+		case 'W':
+			e.Where = val
+		case 's':
+			e.Schema = val
+		case 't':
+			e.Table = val
+		case 'c':
+			e.Column = val
+		case 'n':
+			e.Constraint = val
+		}
+	}
+	return e, b.err
+}
+
+// authName Authentication 消息的类型
+func authName(body []byte) string {
+	b := &buffer{b: body}
+	switch code := b.int32(); code {
+	case 0:
+		return "ok"
+	case 2:
+		return "kerberos"
+	case 3:
+		return "cleartext"
+	case 5:
+		return "md5"
+	case 7, 8:
+		return "gss"
+	case 9:
+		return "sspi"
+	case 10:
+		// 后面是服务端支持的机制
+		return "sasl " + b.cstring()
+	case 11, 12:
+		return ""
+	default:
+		return strconv.Itoa(int(code))
+	}
+}
@@ -0,0 +1,648 @@
+package postgres
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/Salpadding/l7dump/core"
+)
+
+var (
+	_ core.ProtocolTracker     = (*Tracker)(nil)
+	_ core.ProtocolConnTracker = (*ConnTracker)(nil)
+)
+
+// Request 一轮交互中客户端发送的内容
+// 一轮交互以服务端的 ReadyForQuery 结束
+type Request struct {
+	Startup *Startup `json:"startup,omitempty"`
+	// Query 简单查询的语句
+	Query string `json:"query,omitempty"`
+	// Statements 扩展协议中 Execute 执行的语句
+	Statements []*Statement `json:"statements,omitempty"`
+	// Messages 扩展协议中到 Sync 为止的消息
+	Messages []string `json:"messages,omitempty"`
+	// ProcessID CancelRequest 要取消的连接
+	ProcessID int32 `json:"process_id,omitempty"`
+}
+
+// Result 一个语句的结果
+type Result struct {
+	// Tag CommandComplete 中的 tag 例如 "SELECT 3" "INSERT 0 1"
+	Tag     string    `json:"tag"`
+	Columns []*Column `json:"columns,omitempty"`
+	Rows    int       `json:"rows"`
+	// Suspended 达到 Execute 的最大行数 还有剩余的数据
+	Suspended bool `json:"suspended,omitempty"`
+}
+
+// Response 一轮交互中服务端返回的内容
+type Response struct {
+	Results []*Result `json:"results,omitempty"`
+	Error   *Error    `json:"error,omitempty"`
+	Notices int       `json:"notices,omitempty"`
+	// TxStatus ReadyForQuery 中的事务状态 idle, transaction, failed
+	TxStatus string `json:"tx_status,omitempty"`
+
+	// 以下字段只在 startup 时出现
+	Auth      []string          `json:"auth,omitempty"`
+	Params    map[string]string `json:"params,omitempty"`
+	ProcessID int32             `json:"process_id,omitempty"`
+
+	current *Result
+}
+
+// Notification LISTEN 的频道收到的通知
+type Notification struct {
+	ProcessID int32  `json:"process_id"`
+	Channel   string `json:"channel"`
+	Size      int    `json:"size"`
+}
+
+var txStatus = map[byte]string{
+	'I': "idle",
+	'T': "transaction",
+	'E': "failed",
+}
+
+// 一轮交互的类型
+const (
+	cycleQuery = iota
+	cycleStartup
+	// cycleEncrypt SSLRequest 或 GSSENCRequest, 服务端只返回一个字节
+	cycleEncrypt
+)
+
+// cycle 一轮交互
+type cycle struct {
+	kind int
+	ev   *core.Event
+	req  *Request
+	resp *Response
+	// lost 响应有数据丢失
+	lost bool
+}
+
+type ConnTracker struct {
+	meta       *core.ConnMeta
+	tracker    *Tracker
+	reqStream  *core.Stream
+	respStream *core.Stream
+	reqBuf     *bufio.Reader
+	respBuf    *bufio.Reader
+
+	// pending 还没有收到 ReadyForQuery 的交互 按发送的顺序排列
+	mtx     sync.Mutex
+	pending []*cycle
+	// opaque 服务端接受了 ssl 或者 gss 加密 之后的数据无法解码
+	opaque bool
+
+	// 以下字段只在请求的协程里使用
+	stmts   map[string]*stmt
+	portals map[string]*portal
+	// batch 扩展协议中还没有 Sync 的消息
+	batch *cycle
+
+	// orphan 响应的协程使用 没有看到请求的响应
+	orphan *cycle
+
+	// reqGap respGap 丢包之后需要重新同步 分别只在请求和响应的协程中使用
+	reqGap  bool
+	respGap bool
+	// resynced 重新同步之后的第一个消息 丢失的可能是同一批扩展协议的消息
+	resynced bool
+}
+
+func (c *ConnTracker) push(cyc *cycle) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.pending = append(c.pending, cyc)
+}
+
+func (c *ConnTracker) front() *cycle {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if len(c.pending) == 0 {
+		return nil
+	}
+	return c.pending[0]
+}
+
+func (c *ConnTracker) pop() {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if len(c.pending) > 0 {
+		c.pending[0] = nil
+		c.pending = c.pending[1:]
+	}
+}
+
+func (c *ConnTracker) setOpaque() {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.opaque = true
+}
+
+func (c *ConnTracker) isOpaque() bool {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.opaque
+}
+
+func (c *ConnTracker) newCycle(kind int, op string, reqTime time.Time) *cycle {
+	ev := core.NewEvent(c.meta, "postgres")
+	ev.Op = op
+	ev.ReqTime = reqTime
+	cyc := &cycle{kind: kind, ev: ev, req: &Request{}, resp: &Response{}}
+	ev.Request = cyc.req
+	return cyc
+}
+
+// drain 加密之后的数据全部丢弃
+func drain(r io.Reader) (interface{}, error) {
+	_, err := io.Copy(io.Discard, r)
+	if err == nil {
+		err = io.EOF
+	}
+	return nil, err
+}
+
+func (c *ConnTracker) decodeReq() (interface{}, error) {
+	if c.reqGap {
+		skipped, err := core.Resync(c.reqBuf, matchRequest)
+		if err != nil {
+			return nil, err
+		}
+		c.reqGap = false
+		c.resynced = true
+		log.Printf("postgres %s: request resynced, skipped %d bytes", c.meta, skipped)
+	}
+	first, err := c.reqBuf.Peek(1)
+	if err != nil {
+		if err == core.ErrDataLost {
+			c.lostReq()
+			return nil, nil
+		}
+		return nil, err
+	}
+	// 服务端接受 ssl 之后客户端开始 tls 握手
+	if c.isOpaque() || first[0] == 0x16 {
+		return drain(c.reqBuf)
+	}
+
+	reqTime := c.reqStream.Seen()
+	start := c.reqStream.Count() - c.reqBuf.Buffered()
+	size := func() int {
+		return c.reqStream.Count() - c.reqBuf.Buffered() - start
+	}
+
+	// 没有类型的消息以长度开头 长度不会超过 16MB
+	if first[0] == 0 {
+		return c.decodeStartup(reqTime, size)
+	}
+
+	gaps := c.reqStream.Gaps()
+	msg, err := readMessage(c.reqBuf, func(typ byte) bool {
+		return typ == msgCopyData
+	})
+	if err != nil {
+		if c.reqStream.Gaps() == gaps {
+			return nil, err
+		}
+		c.lostReq()
+		return nil, nil
+	}
+	resynced := c.resynced
+	c.resynced = false
+
+	switch msg.typ {
+	case msgQuery:
+		cyc := c.newCycle(cycleQuery, messageNames[msg.typ], reqTime)
+		b := &buffer{b: msg.body}
+		cyc.req.Query = b.cstring()
+		cyc.ev.ReqSize = msg.size
+		c.push(cyc)
+		return cyc.req, b.err
+	case msgFunctionCall:
+		cyc := c.newCycle(cycleQuery, messageNames[msg.typ], reqTime)
+		cyc.ev.ReqSize = msg.size
+		c.push(cyc)
+		return cyc.req, nil
+	case msgTerminate:
+		ev := core.NewEvent(c.meta, "postgres")
+		ev.Op = messageNames[msg.typ]
+		ev.ReqTime = reqTime
+		ev.Done(reqTime)
+		ev.ReqSize = msg.size
+		core.Emit(c.tracker.Sink, ev)
+		return nil, nil
+	case msgParse, msgBind, msgDescribe, msgExecute, msgClose, msgFlush, msgSync:
+		return c.decodeExtended(msg, reqTime, resynced)
+	}
+	// 认证数据和 COPY 的数据不需要解析
+	return nil, nil
+}
+
+// lostReq 请求有数据丢失 丢失的可能是 Query, 这时响应没有对应的请求
+func (c *ConnTracker) lostReq() {
+	c.reqGap = true
+	if c.batch != nil {
+		c.batch.ev.Incomplete = true
+	}
+}
+
+// decodeStartup StartupMessage SSLRequest GSSENCRequest CancelRequest
+func (c *ConnTracker) decodeStartup(reqTime time.Time, size func() int) (interface{}, error) {
+	code, body, err := readStartup(c.reqBuf)
+	if err != nil {
+		return nil, err
+	}
+
+	switch code {
+	case sslRequestCode, gssEncRequest:
+		op := "SSLRequest"
+		if code == gssEncRequest {
+			op = "GSSENCRequest"
+		}
+		cyc := c.newCycle(cycleEncrypt, op, reqTime)
+		cyc.ev.ReqSize = size()
+		c.push(cyc)
+		return cyc.req, nil
+	case cancelRequest:
+		// 取消请求使用新的连接 服务端不会响应 不记录 secret key
+		b := &buffer{b: body}
+		ev := core.NewEvent(c.meta, "postgres")
+		ev.Op = "CancelRequest"
+		ev.ReqTime = reqTime
+		ev.Done(reqTime)
+		ev.ReqSize = size()
+		ev.Request = &Request{ProcessID: b.int32()}
+		core.Emit(c.tracker.Sink, ev)
+		return ev.Request, b.err
+	}
+
+	cyc := c.newCycle(cycleStartup, "StartupMessage", reqTime)
+	cyc.req.Startup, err = parseStartup(code, body)
+	cyc.ev.ReqSize = size()
+	c.push(cyc)
+	return cyc.req, err
+}
+
+// decodeExtended 扩展协议的消息 到 Sync 为止作为一轮交互
+// 客户端可能在 Sync 之前用 Flush 获取响应 所以第一个消息就加入 pending
+func (c *ConnTracker) decodeExtended(msg message, reqTime time.Time, resynced bool) (interface{}, error) {
+	if c.batch == nil {
+		c.batch = c.newCycle(cycleQuery, "", reqTime)
+		c.batch.ev.Incomplete = resynced
+		c.push(c.batch)
+	}
+	cyc := c.batch
+	cyc.req.Messages = append(cyc.req.Messages, messageNames[msg.typ])
+	cyc.ev.ReqSize += msg.size
+
+	var err error
+	switch msg.typ {
+	case msgParse:
+		var (
+			name string
+			s    *stmt
+		)
+		if name, s, err = parseParse(msg.body); err == nil {
+			if c.stmts == nil {
+				c.stmts = make(map[string]*stmt)
+			}
+			c.stmts[name] = s
+		}
+	case msgBind:
+		var (
+			name string
+			p    *portal
+		)
+		if name, p, err = parseBind(msg.body, c.stmts); err == nil {
+			if c.portals == nil {
+				c.portals = make(map[string]*portal)
+			}
+			c.portals[name] = p
+		}
+	case msgExecute:
+		b := &buffer{b: msg.body}
+		name := b.cstring()
+		st := &Statement{Portal: name, MaxRows: b.int32()}
+		if p := c.portals[name]; p != nil {
+			st.Name = p.name
+			st.Params = p.params
+			if p.stmt != nil {
+				st.Query = p.stmt.query
+			}
+		}
+		cyc.req.Statements = append(cyc.req.Statements, st)
+		err = b.err
+	case msgClose:
+		b := &buffer{b: msg.body}
+		kind, name := b.byte(), b.cstring()
+		if kind == 'S' {
+			delete(c.stmts, name)
+		} else {
+			delete(c.portals, name)
+		}
+		err = b.err
+	case msgSync:
+		cyc.ev.Op = "Execute"
+		if len(cyc.req.Statements) == 0 {
+			cyc.ev.Op = cyc.req.Messages[0]
+		}
+		c.batch = nil
+	}
+	return cyc.req, err
+}
+
+func (c *ConnTracker) decodeResp() (interface{}, error) {
+	// 丢包之后丢弃这一轮剩下的响应 直到 ReadyForQuery
+	if c.respGap {
+		skipped, err := core.Resync(c.respBuf, matchReady)
+		if err != nil {
+			return nil, err
+		}
+		c.respGap = false
+		log.Printf("postgres %s: response resynced, skipped %d bytes", c.meta, skipped)
+	}
+	if _, err := c.respBuf.Peek(1); err != nil {
+		if err == core.ErrDataLost {
+			c.lostResp(c.front())
+			return nil, nil
+		}
+		return nil, err
+	}
+	if c.isOpaque() {
+		return drain(c.respBuf)
+	}
+
+	cyc := c.front()
+	if cyc != nil && cyc.kind == cycleEncrypt {
+		return c.decodeEncrypt(cyc)
+	}
+
+	gaps := c.respStream.Gaps()
+	msg, err := readMessage(c.respBuf, func(typ byte) bool {
+		return typ == msgDataRow || typ == msgCopyData
+	})
+	if err != nil {
+		if c.respStream.Gaps() == gaps {
+			return nil, err
+		}
+		c.lostResp(cyc)
+		return nil, nil
+	}
+
+	// 异步的通知不属于任何一轮交互
+	if msg.typ == msgNotificationResponse {
+		return c.emitNotification(msg)
+	}
+
+	if cyc == nil {
+		if c.orphan == nil {
+			c.orphan = c.newCycle(cycleQuery, "", time.Time{})
+			c.orphan.ev.Request = nil
+		}
+		cyc = c.orphan
+	}
+	cyc.ev.RespSize += msg.size
+
+	resp := cyc.resp
+	b := &buffer{b: msg.body}
+	switch msg.typ {
+	case msgAuthentication:
+		if auth := authName(msg.body); auth != "" {
+			resp.Auth = append(resp.Auth, auth)
+		}
+	case msgParameterStatus:
+		if resp.Params == nil {
+			resp.Params = make(map[string]string)
+		}
+		key := b.cstring()
+		resp.Params[key] = b.cstring()
+	case msgBackendKeyData:
+		resp.ProcessID = b.int32()
+	case msgRowDescription:
+		resp.current = &Result{}
+		resp.current.Columns, err = parseRowDescription(msg.body)
+		resp.Results = append(resp.Results, resp.current)
+	case msgDataRow:
+		resp.result().Rows++
+	case msgCommandComplete:
+		resp.result().Tag = b.cstring()
+		resp.current = nil
+	case msgPortalSuspended:
+		resp.result().Suspended = true
+		resp.current = nil
+	case msgNoticeResponse:
+		resp.Notices++
+	case msgErrorResponse:
+		resp.Error, err = parseError(msg.body)
+		// startup 失败之后服务端直接断开连接
+		if cyc.kind == cycleStartup {
+			c.finish(cyc)
+		}
+	case msgReadyForQuery:
+		resp.TxStatus = txStatus[b.byte()]
+		c.finish(cyc)
+	}
+	return resp, err
+}
+
+// lostResp 响应有数据丢失 标记这一轮交互不完整 之后从 ReadyForQuery 重新开始
+func (c *ConnTracker) lostResp(cyc *cycle) {
+	c.respGap = true
+	if cyc == nil {
+		cyc = c.orphan
+	}
+	if cyc != nil {
+		cyc.lost = true
+		cyc.ev.Incomplete = true
+	}
+}
+
+// result 当前正在返回的结果 没有 RowDescription 时新建一个
+func (r *Response) result() *Result {
+	if r.current == nil {
+		r.current = &Result{}
+		r.Results = append(r.Results, r.current)
+	}
+	return r.current
+}
+
+// decodeEncrypt SSLRequest 和 GSSENCRequest 的响应只有一个字节
+func (c *ConnTracker) decodeEncrypt(cyc *cycle) (interface{}, error) {
+	b, err := c.respBuf.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	c.pop()
+	cyc.ev.RespSize = 1
+	cyc.ev.Response = nil
+	switch b {
+	case 'S', 'G':
+		cyc.ev.Status = "accepted"
+		c.setOpaque()
+	case 'N':
+		cyc.ev.Status = "rejected"
+	default:
+		// 不支持的服务端可能返回 ErrorResponse
+		c.respBuf.UnreadByte()
+		cyc.ev.Status = "unknown"
+	}
+	cyc.ev.Done(c.respStream.Seen())
+	core.Emit(c.tracker.Sink, cyc.ev)
+	return nil, nil
+}
+
+func (c *ConnTracker) emitNotification(msg message) (interface{}, error) {
+	b := &buffer{b: msg.body}
+	n := &Notification{ProcessID: b.int32(), Channel: b.cstring()}
+	n.Size = len(b.cstring())
+
+	ev := core.NewEvent(c.meta, "postgres")
+	ev.Op = "Notification"
+	ev.Done(c.respStream.Seen())
+	ev.RespSize = msg.size
+	ev.Response = n
+	core.Emit(c.tracker.Sink, ev)
+	return n, b.err
+}
+
+// finish 一轮交互结束 根据结果填写状态
+func (c *ConnTracker) finish(cyc *cycle) {
+	if cyc == c.orphan {
+		c.orphan = nil
+	} else {
+		c.pop()
+	}
+
+	ev, resp := cyc.ev, cyc.resp
+	ev.Done(c.respStream.Seen())
+	ev.Response = resp
+	switch {
+	case resp.Error != nil:
+		ev.Status = "ERROR"
+		ev.Error = resp.Error.Error()
+	case cyc.lost:
+		ev.Error = core.ErrDataLost.Error()
+	case len(resp.Results) > 0 && resp.Results[len(resp.Results)-1].Tag != "":
+		ev.Status = resp.Results[len(resp.Results)-1].Tag
+	default:
+		ev.Status = "OK"
+	}
+	core.Emit(c.tracker.Sink, ev)
+}
+
+func (c *ConnTracker) OnRequest(req interface{}) error {
+	return nil
+}
+
+func (c *ConnTracker) OnResponse(resp interface{}) error {
+	return nil
+}
+
+func (c *ConnTracker) OnError(err error) {
+	log.Printf("postgres %s: %v", c.meta, err)
+}
+
+// Tracker postgres 协议 3.0
+// 客户端使用 ssl 或者 gss 加密时无法解码
+type Tracker struct {
+	// Sink 接收每一轮交互产生的 Event, 为空时输出到标准输出
+	Sink core.Sink
+}
+
+func (t *Tracker) RequestDecoder(stream *core.Stream, conn core.ProtocolConnTracker) func() (interface{}, error) {
+	c := conn.(*ConnTracker)
+	c.reqStream = stream
+	c.reqBuf = bufio.NewReader(stream)
+	return c.decodeReq
+}
+
+func (t *Tracker) ResponseDecoder(stream *core.Stream, conn core.ProtocolConnTracker) func() (interface{}, error) {
+	c := conn.(*ConnTracker)
+	c.respStream = stream
+	c.respBuf = bufio.NewReader(stream)
+	return c.decodeResp
+}
+
+func (t *Tracker) NewConnect(meta *core.ConnMeta) core.ProtocolConnTracker {
+	log.Printf("new postgres connect to %s", meta.String())
+	return &ConnTracker{
+		meta:    meta,
+		tracker: t,
+	}
+}
+
+func (t *Tracker) OnClose(conn core.ProtocolConnTracker, reason core.CloseReason) {
+}
+
+// Probe 客户端先发送 StartupMessage 或者 SSLRequest 等没有类型的消息
+func (t *Tracker) Probe(req, resp []byte) core.ProbeResult {
+	if len(req) == 0 && len(resp) > 0 {
+		return core.ProbeMismatch
+	}
+	return matchStartup(req)
+}
+
+func matchStartup(data []byte) core.ProbeResult {
+	if len(data) < 8 {
+		return core.ProbeMore
+	}
+	n := int(binary.BigEndian.Uint32(data))
+	code := int(binary.BigEndian.Uint32(data[4:]))
+	if n < 8 || n > maxStartup {
+		return core.ProbeMismatch
+	}
+	switch {
+	case code == sslRequestCode, code == gssEncRequest, code == cancelRequest, code>>16 == 3:
+		return core.ProbeMatch
+	}
+	return core.ProbeMismatch
+}
+
+// matchRequest 丢包之后找下一个客户端消息的开头
+func matchRequest(data []byte) core.ProbeResult {
+	if data[0] == 0 {
+		return matchStartup(data)
+	}
+	if _, ok := messageNames[data[0]]; !ok {
+		return core.ProbeMismatch
+	}
+	if len(data) < 5 {
+		return core.ProbeMore
+	}
+	n := int(binary.BigEndian.Uint32(data[1:]))
+	switch data[0] {
+	case msgSync, msgFlush, msgTerminate:
+		if n == 4 {
+			return core.ProbeMatch
+		}
+	default:
+		if n > 4 && n <= maxMessage {
+			return core.ProbeMatch
+		}
+	}
+	return core.ProbeMismatch
+}
+
+// matchReady ReadyForQuery 的长度固定 最后一个字节是事务状态
+func matchReady(data []byte) core.ProbeResult {
+	const ready = "Z\x00\x00\x00\x05"
+	if len(data) <= len(ready) {
+		if string(data) == ready[:len(data)] {
+			return core.ProbeMore
+		}
+		return core.ProbeMismatch
+	}
+	if string(data[:len(ready)]) == ready && txStatus[data[len(ready)]] != "" {
+		return core.ProbeMatch
+	}
+	return core.ProbeMismatch
+}
@@ -0,0 +1,174 @@
+package postgres
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"math"
+	"testing"
+
+	"github.com/Salpadding/l7dump/core"
+	"github.com/Salpadding/l7dump/core/coretest"
+)
+
+// chunk 一个方向上的一段数据
+// chunk data 为 nil 表示这个方向丢了数据
+type chunk struct {
+	fromClient bool
+	data       []byte
+}
+
+func replay(t *testing.T, chunks []chunk) []*core.Event {
+	sink := &coretest.Sink{}
+	conn := coretest.Start(&Tracker{Sink: sink}, coretest.Meta(5432))
+	for _, c := range chunks {
+		conn.Send(c.fromClient, c.data)
+	}
+	for _, err := range conn.Close() {
+		t.Error(err)
+	}
+	return sink.Events()
+}
+
+func be16(v int) []byte {
+	return binary.BigEndian.AppendUint16(nil, uint16(v))
+}
+
+func be32(v int) []byte {
+	return binary.BigEndian.AppendUint32(nil, uint32(v))
+}
+
+func cstr(s string) []byte {
+	return append([]byte(s), 0)
+}
+
+// msg 类型 + 长度 + 内容
+func msg(typ byte, parts ...[]byte) []byte {
+	var body []byte
+	for _, p := range parts {
+		body = append(body, p...)
+	}
+	return append(append([]byte{typ}, be32(len(body)+4)...), body...)
+}
+
+// untyped 没有类型的消息
+func untyped(code int, parts ...[]byte) []byte {
+	body := be32(code)
+	for _, p := range parts {
+		body = append(body, p...)
+	}
+	return append(be32(len(body)+4), body...)
+}
+
+func join(msgs ...[]byte) []byte {
+	var data []byte
+	for _, m := range msgs {
+		data = append(data, m...)
+	}
+	return data
+}
+
+func rowDescription(name string, oid int) []byte {
+	return msg('T', be16(1), cstr(name), be32(0), be16(0), be32(oid), be16(4), be32(-1), be16(0))
+}
+
+func TestPostgres(t *testing.T) {
+	ready := msg('Z', []byte{'I'})
+	events := replay(t, []chunk{
+		{true, untyped(sslRequestCode)},
+		{false, []byte{'N'}},
+		{true, untyped(protocolVersion3, cstr("user"), cstr("app"), cstr("database"), cstr("db"),
+			cstr("application_name"), cstr("psql"), []byte{0})},
+		{false, join(msg('R', be32(0)), msg('S', cstr("server_version"), cstr("16.1")), msg('K', be32(42), be32(7)), ready)},
+		{true, msg('Q', cstr("select 1"))},
+		{false, join(rowDescription("?column?", oidInt4), msg('D', be16(1), be32(1), []byte("1")), msg('C', cstr("SELECT 1")), ready)},
+		{true, join(
+			msg('P', cstr("s1"), cstr("select * from t where id = $1 and score < $2"), be16(2), be32(oidInt4), be32(oidFloat8)),
+			msg('B', cstr(""), cstr("s1"), be16(1), be16(1), be16(2), be32(4), be32(7),
+				be32(8), binary.BigEndian.AppendUint64(nil, math.Float64bits(math.Inf(1))), be16(0)),
+			msg('D', []byte{'P'}, cstr("")),
+			msg('E', cstr(""), be32(0)),
+			msg('S'),
+		)},
+		{false, join(msg('1'), msg('2'), rowDescription("id", oidInt4),
+			msg('D', be16(1), be32(1), []byte("7")), msg('D', be16(1), be32(1), []byte("7")),
+			msg('C', cstr("SELECT 2")), ready)},
+		{true, msg('Q', cstr("select * from missing"))},
+		{false, join(msg('E', []byte{'S'}, cstr("ERROR"), []byte{'C'}, cstr("42P01"),
+			[]byte{'M'}, cstr(`relation "missing" does not exist`), []byte{0}), ready)},
+		{true, msg('X')},
+	})
+
+	ops := []string{"SSLRequest", "StartupMessage", "Query", "Execute", "Query", "Terminate"}
+	if len(events) != len(ops) {
+		t.Fatalf("expect %d events, got %d", len(ops), len(events))
+	}
+	for i, op := range ops {
+		if events[i].Op != op {
+			t.Fatalf("unexpected event %d %s", i, events[i])
+		}
+	}
+
+	if events[0].Status != "rejected" {
+		t.Fatalf("unexpected ssl event %s", events[0])
+	}
+	startup := events[1]
+	if s := startup.Request.(*Request).Startup; s.User != "app" || s.Database != "db" || s.ApplicationName != "psql" {
+		t.Fatalf("unexpected startup %+v", s)
+	}
+	if r := startup.Response.(*Response); r.Params["server_version"] != "16.1" || r.ProcessID != 42 || r.Auth[0] != "ok" {
+		t.Fatalf("unexpected startup response %+v", r)
+	}
+
+	if r := events[2].Response.(*Response); events[2].Status != "SELECT 1" || r.Results[0].Rows != 1 || r.TxStatus != "idle" {
+		t.Fatalf("unexpected query event %s", events[2])
+	}
+
+	exec := events[3]
+	st := exec.Request.(*Request).Statements[0]
+	if st.Name != "s1" || st.Params[0] != int32(7) || st.Params[1] != "Infinity" {
+		t.Fatalf("unexpected statement %+v", st)
+	}
+	if _, err := json.Marshal(exec); err != nil {
+		t.Fatalf("marshal execute event: %v", err)
+	}
+	if r := exec.Response.(*Response); r.Results[0].Rows != 2 || r.Results[0].Columns[0].Name != "id" {
+		t.Fatalf("unexpected execute response %+v", r)
+	}
+
+	if events[4].Status != "ERROR" || events[4].Error != `ERROR 42P01: relation "missing" does not exist` {
+		t.Fatalf("unexpected error event %s", events[4])
+	}
+}
+
+func TestDataLost(t *testing.T) {
+	ready := msg('Z', []byte{'I'})
+	row := msg('D', be16(1), be32(1), []byte("1"))
+	parse := msg('P', cstr("s1"), cstr("select 1"), be16(0))
+	events := replay(t, []chunk{
+		// 结果的中间丢了数据
+		{true, msg('Q', cstr("select 1"))},
+		{false, join(rowDescription("id", oidInt4), row[:4])},
+		{false, nil},
+		{false, join(row[6:], row, msg('C', cstr("SELECT 2")), ready)},
+		// Parse 的后半部分丢了
+		{true, parse[:8]},
+		{true, nil},
+		{true, join(parse[12:], msg('B', cstr(""), cstr("s1"), be16(0), be16(0), be16(0)), msg('E', cstr(""), be32(0)), msg('S'))},
+		{false, join(msg('1'), msg('2'), row, msg('C', cstr("SELECT 1")), ready)},
+		{true, msg('Q', cstr("select 2"))},
+		{false, join(row, msg('C', cstr("SELECT 1")), ready)},
+	})
+
+	if len(events) != 3 {
+		t.Fatalf("expect 3 events, got %v", events)
+	}
+	if ev := events[0]; ev.Op != "Query" || !ev.Incomplete || ev.Error != core.ErrDataLost.Error() {
+		t.Fatalf("unexpected event %s", ev)
+	}
+	if ev := events[1]; ev.Op != "Execute" || !ev.Incomplete || ev.Status != "SELECT 1" {
+		t.Fatalf("unexpected event %s", ev)
+	}
+	if ev := events[2]; ev.Op != "Query" || ev.Incomplete || ev.Status != "SELECT 1" {
+		t.Fatalf("unexpected event %s", ev)
+	}
+}
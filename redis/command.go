@@ -0,0 +1,126 @@
+package redis
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Command 客户端发送的命令 只记录 key 和参数的长度
+type Command struct {
+	// Name 命令名 CLIENT CONFIG 等容器命令包括子命令 例如 "CONFIG GET"
+	Name     string   `json:"name"`
+	Keys     []string `json:"keys,omitempty"`
+	ArgSizes []int    `json:"arg_sizes,omitempty"`
+	// Multi 在 MULTI 和 EXEC 之间 服务端只返回 QUEUED
+	Multi bool `json:"multi,omitempty"`
+}
+
+// keySpec 参数中 key 的位置 和 COMMAND INFO 的含义一样
+// 参数从 1 开始 last 为负数时从后往前数
+type keySpec struct {
+	first, last, step int
+	// numKeys key 的个数所在的位置 例如 EVAL script numkeys key...
+	numKeys int
+}
+
+var noKeys = keySpec{}
+
+var keySpecs = map[string]keySpec{
+	"PING": noKeys, "ECHO": noKeys, "AUTH": noKeys, "HELLO": noKeys, "SELECT": noKeys,
+	"QUIT": noKeys, "RESET": noKeys, "MULTI": noKeys, "EXEC": noKeys, "DISCARD": noKeys,
+	"UNWATCH": noKeys, "INFO": noKeys, "CLIENT": noKeys, "CONFIG": noKeys, "COMMAND": noKeys,
+	"DBSIZE": noKeys, "FLUSHDB": noKeys, "FLUSHALL": noKeys, "SAVE": noKeys, "BGSAVE": noKeys,
+	"BGREWRITEAOF": noKeys, "LASTSAVE": noKeys, "TIME": noKeys, "ROLE": noKeys, "SLOWLOG": noKeys,
+	"SCAN": noKeys, "RANDOMKEY": noKeys, "KEYS": noKeys, "MONITOR": noKeys, "WAIT": noKeys,
+	"SUBSCRIBE": noKeys, "UNSUBSCRIBE": noKeys, "PSUBSCRIBE": noKeys, "PUNSUBSCRIBE": noKeys,
+	"SSUBSCRIBE": noKeys, "SUNSUBSCRIBE": noKeys, "PUBLISH": noKeys, "SPUBLISH": noKeys,
+	"PUBSUB": noKeys, "SCRIPT": noKeys, "FUNCTION": noKeys, "CLUSTER": noKeys, "READONLY": noKeys,
+	"READWRITE": noKeys, "SWAPDB": noKeys, "SHUTDOWN": noKeys, "DEBUG": noKeys, "LATENCY": noKeys,
+	"MODULE": noKeys, "ACL": noKeys, "FAILOVER": noKeys, "REPLICAOF": noKeys, "SLAVEOF": noKeys,
+	"SYNC": noKeys, "PSYNC": noKeys, "XREAD": noKeys, "XREADGROUP": noKeys,
+
+	"DEL": {1, -1, 1, 0}, "UNLINK": {1, -1, 1, 0}, "EXISTS": {1, -1, 1, 0}, "MGET": {1, -1, 1, 0},
+	"TOUCH": {1, -1, 1, 0}, "WATCH": {1, -1, 1, 0}, "SINTER": {1, -1, 1, 0}, "SUNION": {1, -1, 1, 0},
+	"SDIFF": {1, -1, 1, 0}, "SINTERSTORE": {1, -1, 1, 0}, "SUNIONSTORE": {1, -1, 1, 0},
+	"SDIFFSTORE": {1, -1, 1, 0}, "PFCOUNT": {1, -1, 1, 0}, "PFMERGE": {1, -1, 1, 0},
+
+	"BLPOP": {1, -2, 1, 0}, "BRPOP": {1, -2, 1, 0}, "BZPOPMIN": {1, -2, 1, 0}, "BZPOPMAX": {1, -2, 1, 0},
+
+	"MSET": {1, -1, 2, 0}, "MSETNX": {1, -1, 2, 0},
+
+	"RENAME": {1, 2, 1, 0}, "RENAMENX": {1, 2, 1, 0}, "RPOPLPUSH": {1, 2, 1, 0}, "SMOVE": {1, 2, 1, 0},
+	"LMOVE": {1, 2, 1, 0}, "BLMOVE": {1, 2, 1, 0}, "BRPOPLPUSH": {1, 2, 1, 0}, "COPY": {1, 2, 1, 0},
+	"LCS": {1, 2, 1, 0},
+
+	"OBJECT": {2, 2, 1, 0}, "MEMORY": {2, 2, 1, 0},
+
+	"EVAL": {numKeys: 2}, "EVALSHA": {numKeys: 2}, "EVAL_RO": {numKeys: 2}, "EVALSHA_RO": {numKeys: 2},
+	"FCALL": {numKeys: 2}, "FCALL_RO": {numKeys: 2},
+	"ZUNION": {numKeys: 1}, "ZINTER": {numKeys: 1}, "ZDIFF": {numKeys: 1}, "ZINTERCARD": {numKeys: 1},
+	"SINTERCARD": {numKeys: 1}, "LMPOP": {numKeys: 1}, "ZMPOP": {numKeys: 1},
+	"BLMPOP": {numKeys: 2}, "BZMPOP": {numKeys: 2},
+	// 第一个参数是目标 key
+	"ZUNIONSTORE": {1, 1, 1, 2}, "ZINTERSTORE": {1, 1, 1, 2}, "ZDIFFSTORE": {1, 1, 1, 2},
+}
+
+// containers 第一个参数是子命令
+var containers = map[string]bool{
+	"CLIENT": true, "CONFIG": true, "CLUSTER": true, "COMMAND": true, "SCRIPT": true,
+	"FUNCTION": true, "OBJECT": true, "MEMORY": true, "ACL": true, "XINFO": true, "XGROUP": true,
+	"PUBSUB": true, "SLOWLOG": true, "LATENCY": true, "MODULE": true, "DEBUG": true,
+}
+
+// subscribes 服务端对每个频道返回一个确认
+var subscribes = map[string]bool{
+	"SUBSCRIBE": true, "PSUBSCRIBE": true, "SSUBSCRIBE": true,
+	"UNSUBSCRIBE": true, "PUNSUBSCRIBE": true, "SUNSUBSCRIBE": true,
+}
+
+// newCommand 根据参数创建命令 第一个参数是命令名
+func newCommand(args []*value) *Command {
+	name := strings.ToUpper(args[0].str)
+	cmd := &Command{Name: name}
+	params := args[1:]
+	if containers[name] && len(params) > 0 {
+		cmd.Name += " " + strings.ToUpper(params[0].str)
+	}
+
+	cmd.ArgSizes = make([]int, len(params))
+	for i, arg := range params {
+		cmd.ArgSizes[i] = arg.size
+	}
+
+	spec, ok := keySpecs[name]
+	if !ok {
+		// 大部分命令的第一个参数是 key
+		spec = keySpec{first: 1, last: 1, step: 1}
+	}
+	for _, i := range spec.keys(params) {
+		cmd.Keys = append(cmd.Keys, params[i].str)
+	}
+	return cmd
+}
+
+// keys 返回 key 在参数中的下标
+func (s keySpec) keys(params []*value) (index []int) {
+	n := len(params)
+	if s.first > 0 {
+		last := s.last
+		if last < 0 {
+			last += n + 1
+		}
+		for i := s.first; i <= last && i <= n; i += s.step {
+			index = append(index, i-1)
+		}
+	}
+	if s.numKeys > 0 && s.numKeys <= n {
+		count, err := strconv.Atoi(params[s.numKeys-1].str)
+		if err != nil {
+			return
+		}
+		for i := s.numKeys; i < s.numKeys+count && i < n; i++ {
+			index = append(index, i)
+		}
+	}
+	return
+}
@@ -0,0 +1,458 @@
+package redis
+
+import (
+	"bufio"
+	"bytes"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/Salpadding/l7dump/core"
+)
+
+var (
+	_ core.ProtocolTracker     = (*Tracker)(nil)
+	_ core.ProtocolConnTracker = (*ConnTracker)(nil)
+)
+
+// Reply 服务端的响应 字符串只记录长度
+type Reply struct {
+	Type string `json:"type"`
+	// Size 字符串的长度 或者聚合类型的元素个数
+	Size int `json:"size"`
+	// Value 简单字符串 整数 浮点数 布尔值
+	Value string `json:"value,omitempty"`
+	Error string `json:"error,omitempty"`
+	// Replies EXEC 中每个命令的响应 或者 SUBSCRIBE 对每个频道的确认
+	Replies []*Reply `json:"replies,omitempty"`
+	// Server HELLO 返回的服务端信息
+	Server map[string]string `json:"server,omitempty"`
+}
+
+// Push 不对应任何命令的消息 例如订阅的频道收到的消息
+type Push struct {
+	Kind    string `json:"kind"`
+	Channel string `json:"channel,omitempty"`
+	Pattern string `json:"pattern,omitempty"`
+	// Size 消息的长度
+	Size int `json:"size"`
+}
+
+func newReply(v *value) *Reply {
+	r := &Reply{
+		Type: v.typeName(),
+		Size: v.size,
+	}
+	switch {
+	case v.null:
+	case v.isError():
+		r.Error = v.str
+	case v.typ != typeBulkString && v.typ != typeVerbatim && len(v.elems) == 0:
+		r.Value = v.str
+	}
+	return r
+}
+
+// serverInfo HELLO 的响应 RESP3 是 map, RESP2 是 key value 交替的数组
+func serverInfo(v *value) map[string]string {
+	if v.typ != typeMap && v.typ != typeArray {
+		return nil
+	}
+	info := make(map[string]string)
+	for i := 0; i+1 < len(v.elems); i += 2 {
+		key, val := v.elems[i], v.elems[i+1]
+		if len(val.elems) == 0 && !val.null {
+			info[key.str] = val.str
+		}
+	}
+	return info
+}
+
+// pending 已经发出还没有收到响应的命令
+type pending struct {
+	ev  *core.Event
+	cmd *Command
+	// confirms SUBSCRIBE 等命令还需要的确认数 -1 表示直到订阅数为 0
+	confirms int
+	replies  []*Reply
+	respSize int
+}
+
+type ConnTracker struct {
+	meta       *core.ConnMeta
+	tracker    *Tracker
+	reqStream  *core.Stream
+	respStream *core.Stream
+
+	// pending 按发送的顺序排列 客户端可以不等响应就发送下一个命令 (pipelining)
+	mtx     sync.Mutex
+	pending []*pending
+
+	// multi 请求的协程使用 在 MULTI 和 EXEC/DISCARD 之间
+	multi bool
+	// subscribed 响应的协程使用 RESP2 订阅模式下的 message 数组不是响应
+	subscribed bool
+
+	// reqGap respGap 丢包之后需要重新同步 分别只在请求和响应的协程中使用
+	reqGap  bool
+	respGap bool
+}
+
+func (c *ConnTracker) push(p *pending) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.pending = append(c.pending, p)
+}
+
+func (c *ConnTracker) front() *pending {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if len(c.pending) == 0 {
+		return nil
+	}
+	return c.pending[0]
+}
+
+func (c *ConnTracker) pop() {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if len(c.pending) > 0 {
+		c.pending[0] = nil
+		c.pending = c.pending[1:]
+	}
+}
+
+// decodeReq 解码一个命令
+func (c *ConnTracker) decodeReq(r *reader) (interface{}, error) {
+	buf := r.buf
+	// 丢包之后从下一个命令数组开始解码 inline 命令无法识别
+	if c.reqGap {
+		skipped, err := core.Resync(buf, matchCommand)
+		if err != nil {
+			return nil, err
+		}
+		c.reqGap = false
+		log.Printf("redis %s: request resynced, skipped %d bytes", c.meta, skipped)
+	}
+	if _, err := buf.Peek(1); err != nil {
+		if err == core.ErrDataLost {
+			c.reqGap = true
+			return nil, nil
+		}
+		return nil, err
+	}
+	reqTime := c.reqStream.Seen()
+	start := c.reqStream.Count() - buf.Buffered()
+	gaps := c.reqStream.Gaps()
+
+	args, err := r.readCommand()
+	if err != nil {
+		if c.reqStream.Gaps() == gaps {
+			return nil, err
+		}
+		// 命令已经发出 响应还会到达 用一个不完整的命令占位
+		c.reqGap = true
+		ev := core.NewEvent(c.meta, "redis")
+		ev.ReqTime = reqTime
+		ev.Incomplete = true
+		c.push(&pending{ev: ev})
+		return nil, nil
+	}
+	cmd := newCommand(args)
+	switch cmd.Name {
+	case "MULTI":
+		c.multi = true
+	case "EXEC", "DISCARD":
+		c.multi = false
+	default:
+		cmd.Multi = c.multi
+	}
+
+	ev := core.NewEvent(c.meta, "redis")
+	ev.Op = cmd.Name
+	ev.ReqTime = reqTime
+	ev.ReqSize = c.reqStream.Count() - buf.Buffered() - start
+	ev.Request = cmd
+	if c.reqStream.Gaps() > gaps {
+		c.reqGap = true
+		ev.Incomplete = true
+	}
+
+	p := &pending{ev: ev, cmd: cmd}
+	if subscribes[cmd.Name] {
+		p.confirms = len(args) - 1
+		if p.confirms == 0 {
+			p.confirms = -1
+		}
+	}
+	c.push(p)
+	return cmd, nil
+}
+
+// decodeResp 解码一个响应 或者服务端主动推送的消息
+func (c *ConnTracker) decodeResp(r *reader) (interface{}, error) {
+	buf := r.buf
+	if c.respGap {
+		skipped, err := core.Resync(buf, matchValue)
+		if err != nil {
+			return nil, err
+		}
+		c.respGap = false
+		log.Printf("redis %s: response resynced, skipped %d bytes", c.meta, skipped)
+	}
+	if _, err := buf.Peek(1); err != nil {
+		if err == core.ErrDataLost {
+			c.respGap = true
+			return nil, nil
+		}
+		return nil, err
+	}
+	start := c.respStream.Count() - buf.Buffered()
+	gaps := c.respStream.Gaps()
+	v, err := r.read()
+	if err == nil && c.respStream.Gaps() > gaps {
+		// 空洞前后的数据拼成了一个值 不能确定是哪个命令的响应
+		err = core.ErrDataLost
+	}
+	if err != nil {
+		if c.respStream.Gaps() == gaps {
+			return nil, err
+		}
+		c.respGap = true
+		if p := c.front(); p != nil {
+			c.pop()
+			c.emitLost(p)
+		}
+		return nil, nil
+	}
+	size := c.respStream.Count() - buf.Buffered() - start
+
+	p := c.front()
+	if p != nil && p.confirms != 0 && isConfirm(v, p.cmd.Name) {
+		c.confirm(p, v, size)
+		return v, nil
+	}
+	if kind := c.pushKind(v); kind != "" {
+		c.emitPush(kind, v, size)
+		return v, nil
+	}
+
+	if p == nil {
+		// 没有看到命令 例如抓包开始时已经发出的命令
+		p = &pending{ev: core.NewEvent(c.meta, "redis")}
+	} else {
+		c.pop()
+	}
+	p.respSize += size
+	reply := newReply(v)
+	if p.cmd != nil {
+		switch p.cmd.Name {
+		case "EXEC":
+			for _, elem := range v.elems {
+				reply.Replies = append(reply.Replies, newReply(elem))
+			}
+		case "HELLO":
+			reply.Server = serverInfo(v)
+		}
+	}
+	c.finish(p, reply)
+	return v, nil
+}
+
+// isConfirm SUBSCRIBE 等命令的确认 第一个元素是命令名
+func isConfirm(v *value, name string) bool {
+	if (v.typ != typeArray && v.typ != typePush) || len(v.elems) < 3 {
+		return false
+	}
+	return strings.EqualFold(v.elems[0].text(), name)
+}
+
+// confirm 收到所有频道的确认之后 命令才完成
+func (c *ConnTracker) confirm(p *pending, v *value, size int) {
+	p.replies = append(p.replies, newReply(v))
+	p.respSize += size
+	count, _ := strconv.Atoi(v.elems[2].str)
+	c.subscribed = count > 0
+
+	if p.confirms > 0 && len(p.replies) < p.confirms {
+		return
+	}
+	if p.confirms < 0 && count > 0 {
+		return
+	}
+	c.pop()
+	c.finish(p, &Reply{
+		Type:    p.replies[0].Type,
+		Size:    len(p.replies),
+		Replies: p.replies,
+	})
+}
+
+// pushKind RESP3 的 push 类型 或者 RESP2 订阅模式下的消息
+func (c *ConnTracker) pushKind(v *value) string {
+	if len(v.elems) == 0 {
+		return ""
+	}
+	kind := strings.ToLower(v.elems[0].text())
+	if v.typ == typePush {
+		return kind
+	}
+	if v.typ == typeArray && c.subscribed {
+		switch kind {
+		case "message", "pmessage", "smessage":
+			return kind
+		}
+	}
+	return ""
+}
+
+// emitPush 消息没有对应的命令 只有响应时间
+func (c *ConnTracker) emitPush(kind string, v *value, size int) {
+	push := &Push{Kind: kind}
+	elems := v.elems[1:]
+	if kind == "pmessage" && len(elems) > 0 {
+		push.Pattern = elems[0].text()
+		elems = elems[1:]
+	}
+	if len(elems) > 0 {
+		push.Channel = elems[0].text()
+	}
+	if len(elems) > 1 {
+		push.Size = elems[len(elems)-1].size
+	}
+
+	ev := core.NewEvent(c.meta, "redis")
+	ev.Op = kind
+	ev.Done(c.respStream.Seen())
+	ev.RespSize = size
+	ev.Status = typeNames[typePush]
+	ev.Response = push
+	core.Emit(c.tracker.Sink, ev)
+}
+
+func (c *ConnTracker) finish(p *pending, reply *Reply) {
+	ev := p.ev
+	ev.Done(c.respStream.Seen())
+	ev.RespSize = p.respSize
+	ev.Status = reply.Type
+	ev.Error = reply.Error
+	ev.Response = reply
+	core.Emit(c.tracker.Sink, ev)
+}
+
+// emitLost 响应有数据丢失 只输出命令
+func (c *ConnTracker) emitLost(p *pending) {
+	ev := p.ev
+	ev.Done(c.respStream.Seen())
+	ev.RespSize = p.respSize
+	ev.Error = core.ErrDataLost.Error()
+	ev.Incomplete = true
+	core.Emit(c.tracker.Sink, ev)
+}
+
+func (c *ConnTracker) OnRequest(req interface{}) error {
+	return nil
+}
+
+func (c *ConnTracker) OnResponse(resp interface{}) error {
+	return nil
+}
+
+func (c *ConnTracker) OnError(err error) {
+	log.Printf("redis %s: %v", c.meta, err)
+}
+
+// Tracker 同时支持 RESP2 和 RESP3
+// 客户端使用 tls 时无法解码
+type Tracker struct {
+	// Sink 接收每个命令和响应组成的 Event, 为空时输出到标准输出
+	Sink core.Sink
+}
+
+func (t *Tracker) RequestDecoder(stream *core.Stream, conn core.ProtocolConnTracker) func() (interface{}, error) {
+	c := conn.(*ConnTracker)
+	c.reqStream = stream
+	r := &reader{buf: bufio.NewReader(stream), limit: maxArgs}
+	return func() (interface{}, error) {
+		return c.decodeReq(r)
+	}
+}
+
+func (t *Tracker) ResponseDecoder(stream *core.Stream, conn core.ProtocolConnTracker) func() (interface{}, error) {
+	c := conn.(*ConnTracker)
+	c.respStream = stream
+	r := &reader{buf: bufio.NewReader(stream), limit: maxElements}
+	return func() (interface{}, error) {
+		return c.decodeResp(r)
+	}
+}
+
+func (t *Tracker) NewConnect(meta *core.ConnMeta) core.ProtocolConnTracker {
+	log.Printf("new redis connect to %s", meta.String())
+	return &ConnTracker{
+		meta:    meta,
+		tracker: t,
+	}
+}
+
+func (t *Tracker) OnClose(conn core.ProtocolConnTracker, reason core.CloseReason) {
+}
+
+// Probe 客户端发送的命令是 RESP 数组 *<n>\r\n$
+func (t *Tracker) Probe(req, resp []byte) core.ProbeResult {
+	if len(req) == 0 {
+		if len(resp) > 0 {
+			return core.ProbeMismatch
+		}
+		return core.ProbeMore
+	}
+	return matchCommand(req)
+}
+
+func matchCommand(data []byte) core.ProbeResult {
+	if data[0] != typeArray {
+		return core.ProbeMismatch
+	}
+	i := 1
+	for i < len(data) && i <= 10 && data[i] >= '0' && data[i] <= '9' {
+		i++
+	}
+	if i == 1 && i < len(data) {
+		return core.ProbeMismatch
+	}
+	return core.ProbePrefix(data[i:], "\r\n$")
+}
+
+// matchValue 响应以类型开头 长度是数字 简单类型的一行以 \r\n 结尾
+func matchValue(data []byte) core.ProbeResult {
+	end := bytes.IndexByte(data, '\n')
+	if end < 0 {
+		if len(data) > maxString {
+			return core.ProbeMismatch
+		}
+		return core.ProbeMore
+	}
+	if end < 2 || data[end-1] != '\r' {
+		return core.ProbeMismatch
+	}
+	line := data[1 : end-1]
+	switch data[0] {
+	case typeSimpleString, typeError, typeInteger, typeDouble, typeBigNumber, typeBoolean:
+		if bytes.IndexByte(line, '\r') < 0 {
+			return core.ProbeMatch
+		}
+	case typeNull:
+		if len(line) == 0 {
+			return core.ProbeMatch
+		}
+	case typeBulkString, typeBlobError, typeVerbatim, typeArray, typeSet, typePush, typeMap, typeAttribute:
+		if string(line) == "?" || string(line) == "-1" {
+			return core.ProbeMatch
+		}
+		if _, err := strconv.ParseUint(string(line), 10, 31); err == nil {
+			return core.ProbeMatch
+		}
+	}
+	return core.ProbeMismatch
+}
@@ -0,0 +1,160 @@
+package redis
+
+import (
+	"bufio"
+	"strings"
+	"testing"
+
+	"github.com/Salpadding/l7dump/core"
+	"github.com/Salpadding/l7dump/core/coretest"
+)
+
+// chunk 一个方向上的一段数据
+// chunk data 为空表示这个方向丢了数据
+type chunk struct {
+	fromClient bool
+	data       string
+}
+
+func replay(t *testing.T, chunks []chunk) []*core.Event {
+	sink := &coretest.Sink{}
+	conn := coretest.Start(&Tracker{Sink: sink}, coretest.Meta(6379))
+	for _, c := range chunks {
+		var data []byte
+		if c.data != "" {
+			data = []byte(c.data)
+		}
+		conn.Send(c.fromClient, data)
+	}
+	for _, err := range conn.Close() {
+		t.Error(err)
+	}
+	return sink.Events()
+}
+
+func TestRedis(t *testing.T) {
+	events := replay(t, []chunk{
+		{true, "*2\r\n$5\r\nHELLO\r\n$1\r\n3\r\n"},
+		{false, "%3\r\n$6\r\nserver\r\n$5\r\nredis\r\n$7\r\nversion\r\n$5\r\n7.2.0\r\n$5\r\nproto\r\n:3\r\n"},
+		// 流水线
+		{true, "*3\r\n$3\r\nSET\r\n$3\r\nfoo\r\n$5\r\nhello\r\n*3\r\n$4\r\nMGET\r\n$3\r\nfoo\r\n$3\r\nbar\r\nPING\r\n"},
+		{false, "+OK\r\n*2\r\n$5\r\nhello\r\n_\r\n+PONG\r\n"},
+		{true, "*2\r\n$4\r\nINCR\r\n$3\r\nfoo\r\n"},
+		{false, "|1\r\n+ttl\r\n:3600\r\n-ERR value is not an integer or out of range\r\n"},
+		{true, "*1\r\n$5\r\nMULTI\r\n*2\r\n$4\r\nINCR\r\n$1\r\nn\r\n*1\r\n$4\r\nEXEC\r\n"},
+		{false, "+OK\r\n+QUEUED\r\n*1\r\n:1\r\n"},
+		{true, "*3\r\n$9\r\nSUBSCRIBE\r\n$1\r\na\r\n$1\r\nb\r\n"},
+		{false, ">3\r\n$9\r\nsubscribe\r\n$1\r\na\r\n:1\r\n"},
+		{false, ">3\r\n$9\r\nsubscribe\r\n$1\r\nb\r\n:2\r\n>3\r\n$7\r\nmessage\r\n$1\r\na\r\n$?\r\n;2\r\nhi\r\n;0\r\n"},
+	})
+
+	ops := []string{"HELLO", "SET", "MGET", "PING", "INCR", "MULTI", "INCR", "EXEC", "SUBSCRIBE", "message"}
+	if len(events) != len(ops) {
+		t.Fatalf("expect %d events, got %d", len(ops), len(events))
+	}
+	for i, op := range ops {
+		if events[i].Op != op {
+			t.Fatalf("unexpected event %d %s", i, events[i])
+		}
+	}
+
+	if hello := events[0].Response.(*Reply); hello.Type != "map" || hello.Server["version"] != "7.2.0" {
+		t.Fatalf("unexpected hello reply %+v", hello)
+	}
+	mget := events[2]
+	if keys := mget.Request.(*Command).Keys; len(keys) != 2 || keys[1] != "bar" || mget.Response.(*Reply).Size != 2 {
+		t.Fatalf("unexpected mget event %s", mget)
+	}
+	if events[3].Request.(*Command).Name != "PING" || events[3].Response.(*Reply).Value != "PONG" {
+		t.Fatalf("unexpected inline ping %s", events[3])
+	}
+	if events[4].Status != "error" || events[4].Error != "ERR value is not an integer or out of range" {
+		t.Fatalf("unexpected error event %s", events[4])
+	}
+	if !events[6].Request.(*Command).Multi || events[6].Status != "simple_string" {
+		t.Fatalf("unexpected queued event %s", events[6])
+	}
+	if exec := events[7].Response.(*Reply); len(exec.Replies) != 1 || exec.Replies[0].Value != "1" {
+		t.Fatalf("unexpected exec reply %+v", exec)
+	}
+	if sub := events[8].Response.(*Reply); len(sub.Replies) != 2 {
+		t.Fatalf("unexpected subscribe reply %+v", sub)
+	}
+	if push := events[9].Response.(*Push); push.Channel != "a" || push.Size != 2 {
+		t.Fatalf("unexpected push %+v", push)
+	}
+}
+
+func TestKeys(t *testing.T) {
+	for _, c := range []struct {
+		args []string
+		keys []string
+	}{
+		{[]string{"mset", "a", "1", "b", "2"}, []string{"a", "b"}},
+		{[]string{"blpop", "a", "b", "0"}, []string{"a", "b"}},
+		{[]string{"eval", "return 1", "2", "a", "b", "x"}, []string{"a", "b"}},
+		{[]string{"zunionstore", "d", "2", "a", "b"}, []string{"d", "a", "b"}},
+		{[]string{"object", "encoding", "a"}, []string{"a"}},
+		{[]string{"hset", "h", "f", "v"}, []string{"h"}},
+		{[]string{"publish", "ch", "msg"}, nil},
+	} {
+		var args []*value
+		for _, arg := range c.args {
+			args = append(args, &value{typ: typeBulkString, str: arg, size: len(arg)})
+		}
+		cmd := newCommand(args)
+		if len(cmd.Keys) != len(c.keys) {
+			t.Fatalf("unexpected keys of %v: %v", c.args, cmd.Keys)
+		}
+		for i := range c.keys {
+			if cmd.Keys[i] != c.keys[i] {
+				t.Fatalf("unexpected keys of %v: %v", c.args, cmd.Keys)
+			}
+		}
+	}
+}
+
+func TestDataLost(t *testing.T) {
+	events := replay(t, []chunk{
+		{true, "*2\r\n$3\r\nGET\r\n$3\r\nfoo\r\n*2\r\n$3\r\nGET\r\n$3\r\nbar\r\n"},
+		// 第一个响应的后半部分丢了
+		{false, "$10\r\nhel"},
+		{false, ""},
+		{false, "lo\r\n$3\r\nbaz\r\n"},
+		// 命令的后半部分丢了
+		{true, "*3\r\n$3\r\nSET\r\n$3\r\nfoo\r\n$100\r\nxx"},
+		{true, ""},
+		{true, "xx\r\n*1\r\n$4\r\nPING\r\n"},
+		{false, "+OK\r\n+PONG\r\n"},
+	})
+
+	if len(events) != 4 {
+		t.Fatalf("expect 4 events, got %v", events)
+	}
+	if ev := events[0]; ev.Op != "GET" || !ev.Incomplete || ev.Error != core.ErrDataLost.Error() {
+		t.Fatalf("unexpected event %s", ev)
+	}
+	if ev := events[1]; ev.Op != "GET" || ev.Incomplete || ev.Response.(*Reply).Size != 3 {
+		t.Fatalf("unexpected event %s", ev)
+	}
+	if ev := events[2]; ev.Op != "" || !ev.Incomplete || ev.Status != "simple_string" {
+		t.Fatalf("unexpected event %s", ev)
+	}
+	if ev := events[3]; ev.Op != "PING" || ev.Incomplete || ev.Status != "simple_string" {
+		t.Fatalf("unexpected event %s", ev)
+	}
+}
+
+func TestAttributeChain(t *testing.T) {
+	// 每个属性都算一层嵌套
+	r := &reader{buf: bufio.NewReader(strings.NewReader(strings.Repeat("|0\r\n", maxDepth+1) + ":1\r\n"))}
+	if _, err := r.readValue(0); err != ErrProtocol {
+		t.Fatalf("expect protocol error, got %v", err)
+	}
+
+	r = &reader{buf: bufio.NewReader(strings.NewReader("|0\r\n|0\r\n:1\r\n"))}
+	v, err := r.readValue(0)
+	if err != nil || v.typ != typeInteger || v.attrs == nil {
+		t.Fatalf("unexpected value %+v %v", v, err)
+	}
+}
@@ -0,0 +1,314 @@
+package redis
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// RESP2 和 RESP3 的类型
+// https://redis.io/docs/latest/develop/reference/protocol-spec/
+const (
+	typeSimpleString = '+'
+	typeError        = '-'
+	typeInteger      = ':'
+	typeBulkString   = '$'
+	typeArray        = '*'
+	typeNull         = '_'
+	typeBoolean      = '#'
+	typeDouble       = ','
+	typeBigNumber    = '('
+	typeBlobError    = '!'
+	typeVerbatim     = '='
+	typeMap          = '%'
+	typeAttribute    = '|'
+	typeSet          = '~'
+	typePush         = '>'
+	// typeStreamChunk 流式字符串的一段 typeStreamEnd 流式聚合类型的结束
+	typeStreamChunk = ';'
+	typeStreamEnd   = '.'
+)
+
+var typeNames = map[byte]string{
+	typeSimpleString: "simple_string",
+	typeError:        "error",
+	typeInteger:      "integer",
+	typeBulkString:   "bulk_string",
+	typeArray:        "array",
+	typeNull:         "null",
+	typeBoolean:      "boolean",
+	typeDouble:       "double",
+	typeBigNumber:    "big_number",
+	typeBlobError:    "blob_error",
+	typeVerbatim:     "verbatim_string",
+	typeMap:          "map",
+	typeSet:          "set",
+	typePush:         "push",
+}
+
+var ErrProtocol = errors.New("redis protocol error")
+
+const (
+	// maxString 字符串只保留前面的部分 命令的 key 一般都很短
+	maxString = 512
+	// maxElements 响应中的聚合类型只保留前面的元素
+	maxElements = 64
+	// maxArgs 命令的参数
+	maxArgs = 1024
+	// maxDepth 嵌套的层数
+	maxDepth = 32
+)
+
+// value RESP 中的一个值
+// 字符串和聚合类型只保留前面的部分 Size 是完整的长度
+type value struct {
+	typ byte
+	// str 简单类型的值 字符串的前缀
+	str  string
+	size int
+	null bool
+	// elems 聚合类型的元素 map 的 key 和 value 交替排列
+	elems []*value
+	// attrs RESP3 的属性 在值之前发送
+	attrs *value
+}
+
+func (v *value) isError() bool {
+	return v.typ == typeError || v.typ == typeBlobError
+}
+
+func (v *value) typeName() string {
+	if v.null {
+		return typeNames[typeNull]
+	}
+	return typeNames[v.typ]
+}
+
+// text 字符串类型的值 其他类型返回空
+func (v *value) text() string {
+	switch v.typ {
+	case typeSimpleString, typeBulkString, typeVerbatim:
+		return v.str
+	}
+	return ""
+}
+
+// reader 从流中读出 RESP 的值
+type reader struct {
+	buf *bufio.Reader
+	// limit 聚合类型保留的元素个数
+	limit int
+}
+
+// readLine 读取 \r\n 结尾的一行 只保留前 maxString 个字节
+func (r *reader) readLine() (line []byte, err error) {
+	for {
+		var part []byte
+		part, err = r.buf.ReadSlice('\n')
+		if len(line) < maxString {
+			line = append(line, part...)
+		}
+		if err != bufio.ErrBufferFull {
+			break
+		}
+	}
+	if err != nil {
+		if err == io.EOF && len(line) > 0 {
+			err = io.ErrUnexpectedEOF
+		}
+		return
+	}
+	line = bytes.TrimSuffix(bytes.TrimSuffix(line, []byte{'\n'}), []byte{'\r'})
+	return
+}
+
+// readString 读取 n 个字节和结尾的 \r\n
+func (r *reader) readString(n int) (s string, err error) {
+	keep := n
+	if keep > maxString {
+		keep = maxString
+	}
+	data := make([]byte, keep)
+	if _, err = io.ReadFull(r.buf, data); err != nil {
+		return
+	}
+	if _, err = r.buf.Discard(n - keep + 2); err != nil {
+		return
+	}
+	return string(data), nil
+}
+
+func (r *reader) read() (*value, error) {
+	return r.readValue(0)
+}
+
+func (r *reader) readValue(depth int) (v *value, err error) {
+	if depth > maxDepth {
+		return nil, ErrProtocol
+	}
+	var line []byte
+	if line, err = r.readLine(); err != nil {
+		return
+	}
+	if len(line) == 0 {
+		return nil, ErrProtocol
+	}
+
+	v = &value{typ: line[0], str: string(line[1:])}
+	switch v.typ {
+	case typeSimpleString, typeError, typeInteger, typeDouble, typeBigNumber, typeBoolean:
+		v.size = len(v.str)
+	case typeNull:
+		v.null = true
+		v.str = ""
+	case typeBulkString, typeBlobError, typeVerbatim:
+		err = r.readBulk(v)
+	case typeArray, typeSet, typePush, typeMap, typeAttribute:
+		err = r.readAggregate(v, depth)
+	case typeStreamEnd:
+	default:
+		err = ErrProtocol
+	}
+	if err != nil || v.typ != typeAttribute {
+		return
+	}
+
+	// 属性后面才是真正的值
+	attrs := v
+	if v, err = r.readValue(depth + 1); err == nil {
+		v.attrs = attrs
+	}
+	return
+}
+
+// readBulk 读取 $<length>\r\n<data>\r\n, 长度为 ? 时是流式字符串
+func (r *reader) readBulk(v *value) (err error) {
+	if v.str == "?" {
+		return r.readChunks(v)
+	}
+	n, err := strconv.Atoi(v.str)
+	if err != nil {
+		return ErrProtocol
+	}
+	// RESP2 的 null
+	if n < 0 {
+		v.null = true
+		v.str = ""
+		return
+	}
+	v.size = n
+	v.str, err = r.readString(n)
+	if v.typ == typeVerbatim && len(v.str) >= 4 {
+		// 前 4 个字节是格式 例如 txt:
+		v.str = v.str[4:]
+	}
+	return
+}
+
+// readChunks 流式字符串由 ;<length> 组成 长度为 0 时结束
+func (r *reader) readChunks(v *value) error {
+	v.str = ""
+	for {
+		line, err := r.readLine()
+		if err != nil {
+			return err
+		}
+		if len(line) == 0 || line[0] != typeStreamChunk {
+			return ErrProtocol
+		}
+		n, err := strconv.Atoi(string(line[1:]))
+		if err != nil || n < 0 {
+			return ErrProtocol
+		}
+		if n == 0 {
+			return nil
+		}
+		chunk, err := r.readString(n)
+		if err != nil {
+			return err
+		}
+		if len(v.str) < maxString {
+			v.str += chunk
+		}
+		v.size += n
+	}
+}
+
+// readAggregate 读取聚合类型的元素 map 和属性每一项有两个值
+// 长度为 ? 时是流式聚合类型 以 . 结束
+func (r *reader) readAggregate(v *value, depth int) (err error) {
+	n := -1
+	if v.str != "?" {
+		if n, err = strconv.Atoi(v.str); err != nil {
+			return ErrProtocol
+		}
+		if n < 0 {
+			v.null = true
+			v.str = ""
+			return
+		}
+	}
+	v.str = ""
+
+	per := 1
+	if v.typ == typeMap || v.typ == typeAttribute {
+		per = 2
+	}
+	for i := 0; n < 0 || i < n*per; i++ {
+		var elem *value
+		if elem, err = r.readValue(depth + 1); err != nil {
+			return
+		}
+		if elem.typ == typeStreamEnd {
+			if n >= 0 {
+				return ErrProtocol
+			}
+			break
+		}
+		if len(v.elems) < r.limit*per {
+			v.elems = append(v.elems, elem)
+		}
+		if i%per == 0 {
+			v.size++
+		}
+	}
+	return
+}
+
+// readCommand 读取客户端的命令
+// 命令是 bulk string 组成的数组 也可以是空格分隔的一行 (inline command)
+func (r *reader) readCommand() (args []*value, err error) {
+	var first []byte
+	for {
+		if first, err = r.buf.Peek(1); err != nil {
+			return
+		}
+		if first[0] == typeArray {
+			break
+		}
+
+		var line []byte
+		if line, err = r.readLine(); err != nil {
+			return
+		}
+		// 空行被忽略
+		for _, field := range bytes.Fields(line) {
+			args = append(args, &value{typ: typeBulkString, str: string(field), size: len(field)})
+		}
+		if len(args) > 0 {
+			return
+		}
+	}
+
+	v, err := r.read()
+	if err != nil {
+		return
+	}
+	if v.null || len(v.elems) == 0 {
+		return nil, fmt.Errorf("%w: empty command", ErrProtocol)
+	}
+	return v.elems, nil
+}
@@ -0,0 +1,123 @@
+package script
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// toLua 把解码结果转换成 lua 的值
+// 先转换成 json 再转换成 table, 字段名和 sink 输出的一致
+func toLua(L *lua.LState, v interface{}) (lua.LValue, error) {
+	switch r := v.(type) {
+	case *http.Request:
+		v = map[string]interface{}{
+			"method": r.Method,
+			"host":   r.Host,
+			"url":    r.URL.String(),
+			"proto":  r.Proto,
+			"header": r.Header,
+		}
+	case *http.Response:
+		v = map[string]interface{}{
+			"status":         r.Status,
+			"status_code":    r.StatusCode,
+			"proto":          r.Proto,
+			"header":         r.Header,
+			"content_length": r.ContentLength,
+		}
+	}
+
+	data, err := json.Marshal(v)
+	if err != nil {
+		return lua.LNil, err
+	}
+	var value interface{}
+	if err = json.Unmarshal(data, &value); err != nil {
+		return lua.LNil, err
+	}
+	return toValue(L, value), nil
+}
+
+func toValue(L *lua.LState, v interface{}) lua.LValue {
+	switch v := v.(type) {
+	case bool:
+		return lua.LBool(v)
+	case float64:
+		return lua.LNumber(v)
+	case string:
+		return lua.LString(v)
+	case []interface{}:
+		tbl := L.NewTable()
+		for _, e := range v {
+			tbl.Append(toValue(L, e))
+		}
+		return tbl
+	case map[string]interface{}:
+		tbl := L.NewTable()
+		for k, e := range v {
+			tbl.RawSetString(k, toValue(L, e))
+		}
+		return tbl
+	}
+	return lua.LNil
+}
+
+// maxTableDepth fromLua 最多转换多少层嵌套的 table
+const maxTableDepth = 32
+
+// errTableCycle table 直接或者间接引用了自己
+var errTableCycle = errors.New("table references itself")
+
+// fromLua 把 lua 的值转换成可以 json 编码的值
+// 只有连续整数下标的 table 被当作数组
+func fromLua(lv lua.LValue) (interface{}, error) {
+	return fromValue(lv, make(map[*lua.LTable]bool), 0)
+}
+
+// fromValue path 是从最外层到当前 table 的路径 用来发现循环引用
+func fromValue(lv lua.LValue, path map[*lua.LTable]bool, depth int) (val interface{}, err error) {
+	switch v := lv.(type) {
+	case lua.LBool:
+		return bool(v), nil
+	case lua.LNumber:
+		return float64(v), nil
+	case lua.LString:
+		return string(v), nil
+	case *lua.LTable:
+		if path[v] {
+			return nil, errTableCycle
+		}
+		if depth >= maxTableDepth {
+			return nil, fmt.Errorf("table nested deeper than %d", maxTableDepth)
+		}
+		path[v] = true
+		defer delete(path, v)
+
+		size := 0
+		v.ForEach(func(lua.LValue, lua.LValue) { size++ })
+		if n := v.MaxN(); n > 0 && n == size {
+			arr := make([]interface{}, n)
+			for i := range arr {
+				if arr[i], err = fromValue(v.RawGetInt(i+1), path, depth+1); err != nil {
+					return nil, err
+				}
+			}
+			return arr, nil
+		}
+		obj := make(map[string]interface{})
+		v.ForEach(func(k, e lua.LValue) {
+			if err == nil {
+				obj[k.String()], err = fromValue(e, path, depth+1)
+			}
+		})
+		if err != nil {
+			return nil, err
+		}
+		return obj, nil
+	}
+	return nil, nil
+}
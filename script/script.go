@@ -0,0 +1,234 @@
+// Package script 在 tracker 上运行 lua 脚本
+//
+// 脚本可以定义以下函数:
+//
+//	on_request(conn, req)  解码出一个请求
+//	on_response(exchange)  一次完整的请求和响应 返回 false 时丢弃
+//	                       修改 exchange.extra 可以附加字段
+//	on_close(conn, reason) 连接断开 reason 见 core.CloseReason
+//
+// 脚本中可以调用 emit(record) 输出自定义的记录, log(...) 输出日志
+package script
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+
+	"github.com/Salpadding/l7dump/core"
+	lua "github.com/yuin/gopher-lua"
+)
+
+var (
+	_ core.Sink                = (*Script)(nil)
+	_ core.ProtocolTracker     = (*tracker)(nil)
+	_ core.ProtocolConnTracker = (*connTracker)(nil)
+)
+
+// Script 一个 tracker 的 lua 脚本
+// lua 虚拟机不是线程安全的 所有的调用都需要加锁
+type Script struct {
+	path string
+	// sink 脚本处理之后的 Event 的输出
+	sink core.Sink
+
+	mtx sync.Mutex
+	L   *lua.LState
+	// meta 当前正在处理的连接 emit 产生的记录属于这个连接
+	meta *core.ConnMeta
+}
+
+// Load 加载脚本 脚本处理之后的 Event 输出到 sink
+func Load(path string, sink core.Sink) (*Script, error) {
+	s := &Script{
+		path: path,
+		sink: sink,
+		L:    lua.NewState(),
+	}
+	s.L.SetGlobal("emit", s.L.NewFunction(s.emit))
+	s.L.SetGlobal("log", s.L.NewFunction(s.log))
+	if err := s.L.DoFile(path); err != nil {
+		s.L.Close()
+		return nil, fmt.Errorf("load script %s: %v", path, err)
+	}
+	return s, nil
+}
+
+// Wrap 在 tracker 上挂载 on_request 和 on_close
+// tracker 产生的 Event 需要输出到 Script 才会调用 on_response
+func (s *Script) Wrap(t core.ProtocolTracker) core.ProtocolTracker {
+	return &tracker{ProtocolTracker: t, script: s}
+}
+
+// Write 实现 core.Sink, 调用 on_response
+func (s *Script) Write(ev *core.Event) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	fn := s.hook("on_response")
+	if fn == nil {
+		return s.write(ev)
+	}
+
+	exchange, err := toLua(s.L, ev)
+	if err != nil {
+		log.Printf("script %s: %v", s.path, err)
+		return s.write(ev)
+	}
+	tbl, _ := exchange.(*lua.LTable)
+
+	s.meta = ev.Meta
+	ret, ok := s.call(fn, 1, exchange)
+	if ok && ret == lua.LFalse {
+		return nil
+	}
+	if tbl != nil {
+		extra, err := fromLua(tbl.RawGetString("extra"))
+		if err != nil {
+			log.Printf("script %s: extra: %v", s.path, err)
+		}
+		if extra, ok := extra.(map[string]interface{}); ok {
+			ev.Extra = extra
+		}
+	}
+	return s.write(ev)
+}
+
+// Close 关闭 lua 虚拟机 sink 可能被多个 tracker 共用 由调用者关闭
+func (s *Script) Close() error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.L.Close()
+	return nil
+}
+
+func (s *Script) write(ev *core.Event) error {
+	core.Emit(s.sink, ev)
+	return nil
+}
+
+// hook 脚本中定义的函数 没有定义时返回 nil
+func (s *Script) hook(name string) *lua.LFunction {
+	fn, _ := s.L.GetGlobal(name).(*lua.LFunction)
+	return fn
+}
+
+// call 调用脚本中的函数 脚本出错时只记录日志
+func (s *Script) call(fn *lua.LFunction, nret int, args ...lua.LValue) (ret lua.LValue, ok bool) {
+	if err := s.L.CallByParam(lua.P{Fn: fn, NRet: nret, Protect: true}, args...); err != nil {
+		log.Printf("script %s: %v", s.path, err)
+		return lua.LNil, false
+	}
+	if nret == 0 {
+		return lua.LNil, true
+	}
+	ret = s.L.Get(-1)
+	s.L.Pop(1)
+	return ret, true
+}
+
+// onConn 调用 on_request 或 on_close
+func (s *Script) onConn(name string, meta *core.ConnMeta, args ...interface{}) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	fn := s.hook(name)
+	if fn == nil {
+		return
+	}
+	values := make([]lua.LValue, 0, len(args)+1)
+	for _, arg := range append([]interface{}{meta}, args...) {
+		v, err := toLua(s.L, arg)
+		if err != nil {
+			log.Printf("script %s: %v", s.path, err)
+			return
+		}
+		values = append(values, v)
+	}
+	s.meta = meta
+	s.call(fn, 0, values...)
+}
+
+// emit(record) 输出自定义的记录
+// record.op 作为 Event 的 Op, 其余字段放在 extra 中
+func (s *Script) emit(L *lua.LState) int {
+	v, err := fromLua(L.CheckTable(1))
+	if err != nil {
+		L.ArgError(1, err.Error())
+		return 0
+	}
+	record, _ := v.(map[string]interface{})
+	ev := core.NewEvent(s.meta, "lua")
+	if op, ok := record["op"].(string); ok {
+		ev.Op = op
+		delete(record, "op")
+	}
+	ev.Extra = record
+	s.write(ev)
+	return 0
+}
+
+// log(...) 输出到日志 而不是标准输出
+func (s *Script) log(L *lua.LState) int {
+	args := make([]string, L.GetTop())
+	for i := range args {
+		args[i] = L.ToStringMeta(L.Get(i + 1)).String()
+	}
+	log.Printf("script %s: %s", s.path, strings.Join(args, " "))
+	return 0
+}
+
+// tracker 把请求和连接断开交给脚本
+type tracker struct {
+	core.ProtocolTracker
+	script *Script
+}
+
+type connTracker struct {
+	core.ProtocolConnTracker
+	meta   *core.ConnMeta
+	script *Script
+	// 两个方向都会调用 OnClose, on_close 只调用一次
+	closed sync.Once
+}
+
+func (t *tracker) NewConnect(meta *core.ConnMeta) core.ProtocolConnTracker {
+	return &connTracker{
+		ProtocolConnTracker: t.ProtocolTracker.NewConnect(meta),
+		meta:                meta,
+		script:              t.script,
+	}
+}
+
+func (t *tracker) RequestDecoder(stream *core.Stream, conn core.ProtocolConnTracker) func() (interface{}, error) {
+	return t.ProtocolTracker.RequestDecoder(stream, conn.(*connTracker).ProtocolConnTracker)
+}
+
+func (t *tracker) ResponseDecoder(stream *core.Stream, conn core.ProtocolConnTracker) func() (interface{}, error) {
+	return t.ProtocolTracker.ResponseDecoder(stream, conn.(*connTracker).ProtocolConnTracker)
+}
+
+// Probe 被包装的 tracker 不能识别协议时总是不匹配
+func (t *tracker) Probe(req, resp []byte) core.ProbeResult {
+	if p, ok := t.ProtocolTracker.(core.Prober); ok {
+		return p.Probe(req, resp)
+	}
+	return core.ProbeMismatch
+}
+
+func (t *tracker) OnClose(conn core.ProtocolConnTracker, reason core.CloseReason) {
+	c := conn.(*connTracker)
+	t.ProtocolTracker.OnClose(c.ProtocolConnTracker, reason)
+	c.closed.Do(func() {
+		t.script.onConn("on_close", c.meta, string(reason))
+	})
+}
+
+func (c *connTracker) OnRequest(req interface{}) error {
+	err := c.ProtocolConnTracker.OnRequest(req)
+	if req != nil {
+		c.script.onConn("on_request", c.meta, req)
+	}
+	return err
+}
@@ -0,0 +1,154 @@
+package script
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Salpadding/l7dump/core"
+	"github.com/Salpadding/l7dump/core/coretest"
+	lua "github.com/yuin/gopher-lua"
+)
+
+// nopTracker 只用来检查 Wrap 传给 tracker 的连接
+type nopTracker struct{}
+
+type nopConn struct{}
+
+func (nopTracker) NewConnect(meta *core.ConnMeta) core.ProtocolConnTracker { return &nopConn{} }
+func (nopTracker) OnClose(conn core.ProtocolConnTracker, reason core.CloseReason) {
+	_ = conn.(*nopConn)
+}
+func (nopTracker) RequestDecoder(stream *core.Stream, conn core.ProtocolConnTracker) func() (interface{}, error) {
+	return nil
+}
+func (nopTracker) ResponseDecoder(stream *core.Stream, conn core.ProtocolConnTracker) func() (interface{}, error) {
+	return nil
+}
+func (c *nopConn) OnRequest(req interface{}) error   { return nil }
+func (c *nopConn) OnResponse(resp interface{}) error { return nil }
+func (c *nopConn) OnError(err error)                 {}
+
+const program = `
+local queries = 0
+
+function on_request(conn, req)
+  if req.sql ~= nil then
+    queries = queries + 1
+  end
+end
+
+function on_response(ev)
+  if ev.op == "COM_PING" then
+    return false
+  end
+  ev.extra = { slow = ev.latency > 1000, tags = { "a", "b" } }
+end
+
+function on_close(conn, reason)
+  emit({ op = "summary", queries = queries, server_port = conn.server_port, reason = reason })
+end
+`
+
+func TestScript(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "program.lua")
+	if err := os.WriteFile(path, []byte(program), 0644); err != nil {
+		t.Fatal(err)
+	}
+	sink := &coretest.Sink{}
+	s, err := Load(path, sink)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	meta := &core.ConnMeta{ClientIP: net.IP{10, 0, 0, 1}, ServerIP: net.IP{10, 0, 0, 2}, ClientPort: 50000, ServerPort: 3306}
+	tracker := s.Wrap(nopTracker{})
+	conn := tracker.NewConnect(meta)
+	conn.OnRequest(&struct {
+		SQL string `json:"sql"`
+	}{"select 1"})
+
+	ping := core.NewEvent(meta, "mysql")
+	ping.Op = "COM_PING"
+	s.Write(ping)
+	query := core.NewEvent(meta, "mysql")
+	query.Op = "COM_QUERY"
+	query.Latency = 2000
+	s.Write(query)
+
+	tracker.OnClose(conn, core.CloseIdle)
+	tracker.OnClose(conn, core.CloseIdle)
+
+	if len(sink.Events()) != 2 {
+		t.Fatalf("expect 2 events, got %d", len(sink.Events()))
+	}
+	extra := sink.Events()[0].Extra
+	if extra["slow"] != true || len(extra["tags"].([]interface{})) != 2 {
+		t.Fatalf("unexpected extra %v", extra)
+	}
+	summary := sink.Events()[1]
+	if summary.Op != "summary" || summary.Extra["queries"] != float64(1) || summary.Extra["server_port"] != float64(3306) ||
+		summary.Extra["reason"] != "idle" {
+		t.Fatalf("unexpected summary %+v", summary)
+	}
+
+	if _, err = Load(filepath.Join(t.TempDir(), "missing.lua"), sink); err == nil {
+		t.Fatal("expect load error")
+	}
+}
+
+const cycles = `
+function on_response(ev)
+  local t = { name = "loop" }
+  t.self = t
+  ev.extra = ev
+  emit({ op = "cycle", t = t })
+end
+`
+
+func TestTableCycle(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cycles.lua")
+	if err := os.WriteFile(path, []byte(cycles), 0644); err != nil {
+		t.Fatal(err)
+	}
+	sink := &coretest.Sink{}
+	s, err := Load(path, sink)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	meta := &core.ConnMeta{ClientIP: net.IP{10, 0, 0, 1}, ServerIP: net.IP{10, 0, 0, 2}, ClientPort: 50000, ServerPort: 3306}
+	ev := core.NewEvent(meta, "mysql")
+	ev.Op = "COM_QUERY"
+	s.Write(ev)
+
+	// emit 的循环引用被当作脚本的错误 ev.extra 的循环引用被忽略
+	if len(sink.Events()) != 1 || sink.Events()[0].Op != "COM_QUERY" || sink.Events()[0].Extra != nil {
+		t.Fatalf("unexpected events %+v", sink.Events())
+	}
+
+	// 同一个 table 出现两次不是循环引用
+	L := lua.NewState()
+	defer L.Close()
+	shared := L.NewTable()
+	shared.RawSetString("name", lua.LString("shared"))
+	tbl := L.NewTable()
+	tbl.RawSetString("a", shared)
+	tbl.RawSetString("b", shared)
+	if _, err = fromLua(tbl); err != nil {
+		t.Fatal(err)
+	}
+
+	deep := L.NewTable()
+	for i := 0; i < maxTableDepth; i++ {
+		outer := L.NewTable()
+		outer.Append(deep)
+		deep = outer
+	}
+	if _, err = fromLua(deep); err == nil {
+		t.Fatal("expect error for deeply nested table")
+	}
+}
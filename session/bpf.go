@@ -0,0 +1,73 @@
+package session
+
+import (
+	"net"
+	"strings"
+)
+
+// or 多个条件中满足一个 只有一个条件时不加括号
+func or(clauses []string) string {
+	if len(clauses) == 1 {
+		return clauses[0]
+	}
+	return "(" + strings.Join(clauses, " or ") + ")"
+}
+
+func netExpr(n *net.IPNet) string {
+	if ones, bits := n.Mask.Size(); ones == bits {
+		return "host " + n.IP.String()
+	}
+	return "net " + n.String()
+}
+
+func (m *Match) expr() string {
+	ports := make([]string, len(m.Ports))
+	for i, r := range m.Ports {
+		if r.From == r.To {
+			ports[i] = "port " + r.String()
+		} else {
+			ports[i] = "portrange " + r.String()
+		}
+	}
+	var parts []string
+	if len(ports) > 0 {
+		parts = append(parts, or(ports))
+	}
+	for _, nets := range [][]*net.IPNet{m.Hosts, m.Clients} {
+		if len(nets) == 0 {
+			continue
+		}
+		clauses := make([]string, len(nets))
+		for i, n := range nets {
+			clauses[i] = netExpr(n)
+		}
+		parts = append(parts, or(clauses))
+	}
+	if m.BPF != "" {
+		parts = append(parts, "("+m.BPF+")")
+	}
+	return strings.Join(parts, " and ")
+}
+
+// Filter 根据注册的 tracker 生成 bpf 表达式 再和 BPF 取交集
+// 有通过数据识别协议的 tracker 时需要所有的 tcp 流量
+// bpf 不区分方向 客户端的网段只要求出现在源地址或者目的地址
+func (s *ProtocolSessionMgr) Filter() string {
+	expr := "tcp"
+	if len(s.probes) == 0 {
+		var clauses []string
+		// routes 中后添加的在前面 没有端口的 Match 匹配不到任何连接
+		for i := len(s.routes) - 1; i >= 0; i-- {
+			if m := s.routes[i].match; len(m.Ports) > 0 {
+				clauses = append(clauses, m.expr())
+			}
+		}
+		if len(clauses) > 0 {
+			expr += " and (" + strings.Join(clauses, " or ") + ")"
+		}
+	}
+	if s.BPF != "" {
+		expr = "(" + expr + ") and (" + s.BPF + ")"
+	}
+	return expr
+}
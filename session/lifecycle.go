@@ -0,0 +1,295 @@
+package session
+
+import (
+	"encoding/binary"
+	"net"
+	"time"
+
+	"github.com/Salpadding/l7dump/core"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+var _ core.ConnLifecycle = (*ConnEvents)(nil)
+
+// connID 两个方向的数据包得到同一个 key
+type connID struct {
+	net, transport gopacket.Flow
+}
+
+func newConnID(netFlow, transportFlow gopacket.Flow) connID {
+	src, dst := netFlow.Endpoints()
+	if dst.LessThan(src) || (src == dst && transportFlow.Dst().LessThan(transportFlow.Src())) {
+		return connID{netFlow.Reverse(), transportFlow.Reverse()}
+	}
+	return connID{netFlow, transportFlow}
+}
+
+// connState 通过 SYN 或者 SYN-ACK 看到的连接
+// 只在 assemble 的协程中使用
+type connState struct {
+	meta       core.ConnMeta
+	clientIP   gopacket.Endpoint
+	clientPort gopacket.Endpoint
+	// syn 客户端第一次发送 SYN 的时间 只看到 SYN-ACK 时为零值
+	syn         time.Time
+	seen        time.Time
+	established bool
+	finClient   bool
+	finServer   bool
+	// closed 收到了 RST 或者两端都发送了 FIN, 之后的 SYN 是新的连接
+	closed    bool
+	rtt       time.Duration
+	observers []core.ConnLifecycle
+}
+
+func (c *connState) isClient(netFlow, transportFlow gopacket.Flow) bool {
+	return netFlow.Src() == c.clientIP && transportFlow.Src() == c.clientPort
+}
+
+func (c *connState) event(ts time.Time, fromClient bool) *core.ConnEvent {
+	return &core.ConnEvent{
+		Meta:        &c.meta,
+		Time:        ts,
+		FromClient:  fromClient,
+		Established: c.established,
+		Syn:         c.syn,
+		RTT:         c.rtt,
+	}
+}
+
+// newMeta isReq 表示 netFlow 的源地址是客户端
+func newMeta(netFlow, transportFlow gopacket.Flow, isReq bool) core.ConnMeta {
+	ip1 := (net.IP)(netFlow.Src().Raw())
+	ip2 := (net.IP)(netFlow.Dst().Raw())
+	port1 := int(binary.BigEndian.Uint16(transportFlow.Src().Raw()))
+	port2 := int(binary.BigEndian.Uint16(transportFlow.Dst().Raw()))
+	if isReq {
+		return core.ConnMeta{
+			ClientIP:   ip1,
+			ClientPort: port1,
+			ServerIP:   ip2,
+			ServerPort: port2,
+		}
+	}
+	return core.ConnMeta{
+		ClientIP:   ip2,
+		ClientPort: port2,
+		ServerIP:   ip1,
+		ServerPort: port1,
+	}
+}
+
+// AddLifecycle 接收所有连接的生命周期事件
+// 按地址和端口配置的 tracker 实现了 core.ConnLifecycle 时只接收自己匹配的连接的事件
+func (s *ProtocolSessionMgr) AddLifecycle(l core.ConnLifecycle) {
+	s.lifecycles = append(s.lifecycles, l)
+}
+
+func (s *ProtocolSessionMgr) observers(meta *core.ConnMeta) []core.ConnLifecycle {
+	r := s.lookup(meta)
+	if r == nil {
+		return s.lifecycles
+	}
+	l, ok := r.tracker.(core.ConnLifecycle)
+	if !ok {
+		return s.lifecycles
+	}
+	return append([]core.ConnLifecycle{l}, s.lifecycles...)
+}
+
+// track 根据 tcp 标志位维护连接的状态 在创建流之前调用
+// SYN 开始 客户端的 ACK 完成握手 RST 或者两端的 FIN 结束
+func (s *ProtocolSessionMgr) track(netFlow gopacket.Flow, tcp *layers.TCP, ts time.Time) {
+	transportFlow := tcp.TransportFlow()
+	id := newConnID(netFlow, transportFlow)
+	c, ok := s.conns[id]
+
+	if tcp.SYN {
+		// 重传的 SYN 或者 SYN-ACK
+		if ok && !c.closed && !c.established && c.isClient(netFlow, transportFlow) == !tcp.ACK {
+			c.seen = ts
+			return
+		}
+		meta := newMeta(netFlow, transportFlow, !tcp.ACK)
+		// 没有 tracker, probe 和生命周期关心的连接不需要记录
+		if s.lookup(&meta) == nil && len(s.probes) == 0 && len(s.lifecycles) == 0 {
+			delete(s.conns, id)
+			return
+		}
+		if !ok {
+			s.limitConns()
+		}
+		c = &connState{
+			meta: meta,
+			seen: ts,
+		}
+		if tcp.ACK {
+			c.clientIP, c.clientPort = netFlow.Dst(), transportFlow.Dst()
+		} else {
+			c.clientIP, c.clientPort = netFlow.Src(), transportFlow.Src()
+			c.syn = ts
+		}
+		c.observers = s.observers(&c.meta)
+		s.conns[id] = c
+		if !tcp.ACK {
+			for _, o := range c.observers {
+				o.OnSyn(c.event(ts, true))
+			}
+		}
+		return
+	}
+	if !ok || c.closed {
+		return
+	}
+
+	c.seen = ts
+	fromClient := c.isClient(netFlow, transportFlow)
+	if tcp.RST {
+		c.closed = true
+		for _, o := range c.observers {
+			o.OnReset(c.event(ts, fromClient))
+		}
+		return
+	}
+	if tcp.ACK && fromClient && !c.established {
+		c.established = true
+		if !c.syn.IsZero() {
+			c.rtt = ts.Sub(c.syn)
+		}
+		for _, o := range c.observers {
+			o.OnEstablished(c.event(ts, true))
+		}
+	}
+	if !tcp.FIN {
+		return
+	}
+
+	first := !c.finClient && !c.finServer
+	if fromClient {
+		if c.finClient {
+			return
+		}
+		c.finClient = true
+	} else {
+		if c.finServer {
+			return
+		}
+		c.finServer = true
+	}
+	c.closed = c.finClient && c.finServer
+	ev := c.event(ts, fromClient)
+	ev.First = first
+	for _, o := range c.observers {
+		o.OnFin(ev)
+	}
+}
+
+// role 判断数据包的方向 没有看到握手时 guessed 为 true
+// 先看哪一端作为服务端时有 tracker 匹配, 都没有时认为端口大的是客户端
+func (s *ProtocolSessionMgr) role(netFlow, transportFlow gopacket.Flow) (isReq, guessed bool) {
+	if c, ok := s.conns[newConnID(netFlow, transportFlow)]; ok {
+		return c.isClient(netFlow, transportFlow), false
+	}
+
+	srcPort := int(binary.BigEndian.Uint16(transportFlow.Src().Raw()))
+	dstPort := int(binary.BigEndian.Uint16(transportFlow.Dst().Raw()))
+	toDst, toSrc := newMeta(netFlow, transportFlow, true), newMeta(netFlow, transportFlow, false)
+	dstTracked, srcTracked := s.lookup(&toDst) != nil, s.lookup(&toSrc) != nil
+	switch {
+	case dstTracked && !srcTracked:
+		return true, true
+	case srcTracked && !dstTracked:
+		return false, true
+	}
+	return srcPort > dstPort, true
+}
+
+// expireConns 清理一段时间没有数据包的连接 没有完成握手的连接通知超时
+func (s *ProtocolSessionMgr) expireConns(before time.Time) {
+	for id, c := range s.conns {
+		if !c.seen.Before(before) {
+			continue
+		}
+		delete(s.conns, id)
+		if c.established || c.closed {
+			continue
+		}
+		for _, o := range c.observers {
+			o.OnTimeout(c.event(c.seen, true))
+		}
+	}
+}
+
+// limitConns 记录的连接达到 Limits.MaxConns 时丢弃最久没有数据包的连接
+func (s *ProtocolSessionMgr) limitConns() {
+	max := s.Limits.MaxConns
+	if max <= 0 || len(s.conns) < max {
+		return
+	}
+	var (
+		oldestID connID
+		oldest   *connState
+	)
+	for id, c := range s.conns {
+		if oldest == nil || c.seen.Before(oldest.seen) {
+			oldestID, oldest = id, c
+		}
+	}
+	delete(s.conns, oldestID)
+}
+
+// ConnEvents 把连接的生命周期输出为 protocol 为 tcp 的 Event
+// 用来统计每个服务的建连失败和连接的频繁创建关闭
+//
+//	connect 握手完成 Latency 是握手的 rtt, 握手时服务端 RST 表示被拒绝 Status 为 refused
+//	        超时之前没有完成握手 Status 为 timeout
+//	close   先发送 FIN 的一方 Status 为 client_close 或者 server_close
+//	reset   其他的 RST, Status 为 client_reset 或者 server_reset
+//
+// 看到了 SYN 时 ReqTime 是 SYN 的时间 close 和 reset 的 Latency 是连接的时长
+type ConnEvents struct {
+	// Sink 为空时输出到标准输出
+	Sink core.Sink
+}
+
+func (e *ConnEvents) emit(c *core.ConnEvent, op, status string) {
+	ev := core.NewEvent(c.Meta, "tcp")
+	ev.Op = op
+	ev.Status = status
+	ev.ReqTime = c.Syn
+	ev.Done(c.Time)
+	core.Emit(e.Sink, ev)
+}
+
+func side(fromClient bool) string {
+	if fromClient {
+		return "client"
+	}
+	return "server"
+}
+
+func (e *ConnEvents) OnSyn(c *core.ConnEvent) {
+}
+
+func (e *ConnEvents) OnEstablished(c *core.ConnEvent) {
+	e.emit(c, "connect", "established")
+}
+
+func (e *ConnEvents) OnFin(c *core.ConnEvent) {
+	if c.First {
+		e.emit(c, "close", side(c.FromClient)+"_close")
+	}
+}
+
+func (e *ConnEvents) OnReset(c *core.ConnEvent) {
+	if !c.Established && !c.FromClient {
+		e.emit(c, "connect", "refused")
+		return
+	}
+	e.emit(c, "reset", side(c.FromClient)+"_reset")
+}
+
+func (e *ConnEvents) OnTimeout(c *core.ConnEvent) {
+	e.emit(c, "connect", "timeout")
+}
@@ -0,0 +1,173 @@
+package session
+
+import (
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/Salpadding/l7dump/core"
+	"github.com/google/gopacket/tcpassembly"
+)
+
+// defaultIdleTimeout 没有配置 IdleTimeout 时使用
+const defaultIdleTimeout = 2 * time.Minute
+
+// Limits 限制内存的使用 为 0 时不限制
+type Limits struct {
+	// MaxConns 同时解码的连接数 达到上限时淘汰最久没有数据的连接
+	// 也限制记录握手的连接数
+	MaxConns int
+	// MaxPagesPerConn 每个连接缓存的乱序数据页数 超过时跳过缺失的数据
+	MaxPagesPerConn int
+	// MaxPages 所有连接缓存的乱序数据页数
+	MaxPages int
+	// IdleTimeout 超过这个时间没有数据的连接会被关闭 为 0 时是两分钟
+	IdleTimeout time.Duration
+}
+
+func (l *Limits) idleTimeout() time.Duration {
+	if l.IdleTimeout <= 0 {
+		return defaultIdleTimeout
+	}
+	return l.IdleTimeout
+}
+
+// Stats 抓包的统计 可以在其他协程中读取
+type Stats struct {
+	// Packets 交给 tcpassembly 的 tcp 数据包
+	Packets int64
+	// Drops 被内核或者网卡丢弃的数据包 在抓包结束时更新
+	Drops int64
+	// Conns 解码过的连接
+	Conns int64
+	// IdleEvicted LimitEvicted 因为超时和连接数上限被关闭的连接
+	IdleEvicted  int64
+	LimitEvicted int64
+	// Gaps LostBytes 解码时遇到的空洞和丢失的字节数
+	Gaps      int64
+	LostBytes int64
+	// Panics 解码器 panic 的次数 连接见 ProtocolSessionMgr.Panics
+	Panics int64
+}
+
+// Stats 返回当前的统计
+func (s *ProtocolSessionMgr) Stats() Stats {
+	return Stats{
+		Packets:      atomic.LoadInt64(&s.stats.Packets),
+		Drops:        atomic.LoadInt64(&s.stats.Drops),
+		Conns:        atomic.LoadInt64(&s.stats.Conns),
+		IdleEvicted:  atomic.LoadInt64(&s.stats.IdleEvicted),
+		LimitEvicted: atomic.LoadInt64(&s.stats.LimitEvicted),
+		Gaps:         atomic.LoadInt64(&s.stats.Gaps),
+		LostBytes:    atomic.LoadInt64(&s.stats.LostBytes),
+		Panics:       atomic.LoadInt64(&s.stats.Panics),
+	}
+}
+
+// liveConn 正在解码的连接 只在 assemble 的协程中使用
+type liveConn struct {
+	id     connID
+	meta   core.ConnMeta
+	seen   time.Time
+	halves [2]*halfStream
+}
+
+// close 关闭两个方向的流
+func (c *liveConn) close(reason core.CloseReason) {
+	for _, h := range c.halves {
+		if h != nil {
+			h.close(reason)
+		}
+	}
+}
+
+// halfStream 交给 tcpassembly 的一个方向的流
+// 被淘汰之后 tcpassembly 还会继续调用 这时丢弃数据
+type halfStream struct {
+	mgr    *ProtocolSessionMgr
+	conn   *liveConn
+	stream *core.Stream
+	closed bool
+}
+
+func (h *halfStream) Reassembled(reassembly []tcpassembly.Reassembly) {
+	if h.closed {
+		return
+	}
+	h.conn.seen = h.mgr.now
+	h.stream.Reassembled(reassembly)
+}
+
+// ReassemblyComplete 收到 FIN 或者 RST, 或者被 assembler flush
+func (h *halfStream) ReassemblyComplete() {
+	h.close(h.mgr.closing)
+}
+
+func (h *halfStream) close(reason core.CloseReason) {
+	if h.closed {
+		return
+	}
+	h.closed = true
+	h.stream.Close(reason)
+
+	c := h.conn
+	for _, other := range c.halves {
+		if other != nil && !other.closed {
+			return
+		}
+	}
+	if h.mgr.live[c.id] == c {
+		delete(h.mgr.live, c.id)
+	}
+	if reason == core.CloseConnLimit {
+		h.mgr.evicted[c.id] = h.mgr.now
+	}
+	switch reason {
+	case core.CloseIdle:
+		atomic.AddInt64(&h.mgr.stats.IdleEvicted, 1)
+	case core.CloseConnLimit:
+		atomic.AddInt64(&h.mgr.stats.LimitEvicted, 1)
+	}
+}
+
+// isEvicted 被淘汰的连接另一个方向的流也不再解码
+func (s *ProtocolSessionMgr) isEvicted(id connID) bool {
+	_, ok := s.evicted[id]
+	return ok
+}
+
+// open 登记一个方向的流 连接数达到上限时先淘汰最久没有数据的连接
+func (s *ProtocolSessionMgr) open(meta *core.ConnMeta, id connID, isReq bool, stream *core.Stream) tcpassembly.Stream {
+	c, ok := s.live[id]
+	if !ok {
+		if max := s.Limits.MaxConns; max > 0 && len(s.live) >= max {
+			var oldest *liveConn
+			for _, conn := range s.live {
+				if oldest == nil || conn.seen.Before(oldest.seen) {
+					oldest = conn
+				}
+			}
+			log.Printf("too many connections, evict %s", oldest.meta.String())
+			oldest.close(core.CloseConnLimit)
+		}
+		c = &liveConn{id: id, meta: *meta, seen: s.now}
+		s.live[id] = c
+		atomic.AddInt64(&s.stats.Conns, 1)
+	}
+	h := &halfStream{mgr: s, conn: c, stream: stream}
+	c.halves[direction(isReq)] = h
+	return h
+}
+
+// flush 关闭 before 之前没有数据的流
+func (s *ProtocolSessionMgr) flush(assembler *tcpassembly.Assembler, before time.Time) {
+	s.closing = core.CloseIdle
+	assembler.FlushOlderThan(before)
+	s.closing = core.CloseFin
+	s.expireConns(before)
+	for id, ts := range s.evicted {
+		if ts.Before(before) {
+			delete(s.evicted, id)
+		}
+	}
+}
@@ -0,0 +1,241 @@
+package session
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/Salpadding/l7dump/core"
+	"github.com/google/gopacket/tcpassembly"
+)
+
+const (
+	// probeLimit 两个方向缓存的数据超过这个长度还不能识别就放弃
+	probeLimit = 16 << 10
+	// probeRead 每次从流里读取的长度
+	probeRead = 4096
+)
+
+// chunk 识别协议之前缓存的一段数据
+type chunk struct {
+	isReq bool
+	data  []byte
+	seen  time.Time
+	// skip 这段数据之前的空洞 见 tcpassembly.Reassembly
+	skip int
+}
+
+// probe 一个还不知道协议的连接
+// 两个方向的数据先缓存起来 识别出协议之后按抓包的顺序交给 tracker 解码
+type probe struct {
+	mgr  *ProtocolSessionMgr
+	meta *core.ConnMeta
+
+	mtx    sync.Mutex
+	cond   *sync.Cond
+	chunks []chunk
+	data   [2][]byte
+	size   int
+	// decided 之后 tracker 为空表示无法识别
+	decided bool
+	tracker core.ProtocolTracker
+	conn    core.ProtocolConnTracker
+	// flushing 正在把缓存的数据交给 tracker, 这时另一个方向需要等待
+	flushing bool
+	// out 两个方向交给 tracker 解码的流
+	out   [2]*core.Stream
+	pumps int
+	// closed 识别出协议之前已经结束的方向 重放缓存的数据之后关闭 out
+	closed [2]core.CloseReason
+}
+
+func direction(isReq bool) int {
+	if isReq {
+		return 0
+	}
+	return 1
+}
+
+// AddProbe 添加一个通过数据识别协议的 tracker, tracker 需要实现 core.Prober
+// 没有按端口配置 tracker 的连接会依次询问这些 tracker
+func (s *ProtocolSessionMgr) AddProbe(tracker core.ProtocolTracker) error {
+	prober, ok := tracker.(core.Prober)
+	if !ok {
+		return fmt.Errorf("tracker %T can't detect protocol", tracker)
+	}
+	log.Printf("add probe tracker %T", tracker)
+	s.probes = append(s.probes, prober)
+	return nil
+}
+
+// getProbe 两个方向的流共用一个 probe
+func (s *ProtocolSessionMgr) getProbe(meta *core.ConnMeta) *probe {
+	s.probeMtx.Lock()
+	defer s.probeMtx.Unlock()
+	key := meta.String()
+	p, ok := s.probing[key]
+	if !ok {
+		p = &probe{mgr: s, meta: meta}
+		p.cond = sync.NewCond(&p.mtx)
+		s.probing[key] = p
+	}
+	p.mtx.Lock()
+	p.pumps++
+	p.mtx.Unlock()
+	return p
+}
+
+// pump 读取一个方向的数据
+// 识别出协议之前不会阻塞 否则另一个方向的数据永远不会到达
+func (p *probe) pump(in *core.Stream, isReq bool, wg *sync.WaitGroup) {
+	defer wg.Done()
+	buf := make([]byte, probeRead)
+	skip, lost := 0, 0
+	for {
+		n, err := in.Read(buf)
+		if n > 0 {
+			p.feed(isReq, buf[:n], in.Seen(), skip)
+			skip = 0
+		}
+		// 空洞交给 tracker 的流 让解码器重新同步
+		if err == core.ErrDataLost {
+			if skip = in.Lost() - lost; skip == 0 {
+				skip = -1
+			}
+			lost = in.Lost()
+			continue
+		}
+		if err != nil {
+			p.finish(isReq, in.Reason())
+			return
+		}
+	}
+}
+
+// stream 需要在持有锁时调用 第一次有数据时才开始解码
+func (p *probe) stream(isReq bool) *core.Stream {
+	d := direction(isReq)
+	if p.out[d] == nil {
+		wrapper := p.mgr.newWrapper(p.meta, isReq, p.tracker, p.conn, p.mgr.probed)
+		p.out[d] = wrapper.stream
+		p.mgr.running.Add(1)
+		go wrapper.run(&p.mgr.running)
+	}
+	return p.out[d]
+}
+
+func (p *probe) feed(isReq bool, data []byte, seen time.Time, skip int) {
+	p.mtx.Lock()
+	for p.flushing {
+		p.cond.Wait()
+	}
+	if p.decided {
+		if p.tracker == nil {
+			p.mtx.Unlock()
+			return
+		}
+		out := p.stream(isReq)
+		p.mtx.Unlock()
+		// 解码完之后才返回 和没有识别阶段时一样
+		out.Reassembled([]tcpassembly.Reassembly{{Bytes: data, Seen: seen, Skip: skip}})
+		return
+	}
+
+	d := direction(isReq)
+	p.chunks = append(p.chunks, chunk{isReq: isReq, data: append([]byte(nil), data...), seen: seen, skip: skip})
+	p.data[d] = append(p.data[d], data...)
+	p.size += len(data)
+	if !p.detect() {
+		p.mtx.Unlock()
+		return
+	}
+	chunks := p.chunks
+	p.chunks, p.data = nil, [2][]byte{}
+	if p.tracker == nil {
+		p.mtx.Unlock()
+		return
+	}
+
+	out := [2]*core.Stream{}
+	for _, c := range chunks {
+		out[direction(c.isReq)] = p.stream(c.isReq)
+	}
+	p.flushing = true
+	p.mtx.Unlock()
+
+	for _, c := range chunks {
+		out[direction(c.isReq)].Reassembled([]tcpassembly.Reassembly{{Bytes: c.data, Seen: c.seen, Skip: c.skip}})
+	}
+
+	p.mtx.Lock()
+	for d, reason := range p.closed {
+		if reason != "" && out[d] != nil {
+			out[d].Close(reason)
+		}
+	}
+	p.flushing = false
+	p.cond.Broadcast()
+	p.mtx.Unlock()
+}
+
+// detect 按添加的顺序询问每个 tracker
+// 返回 true 表示已经有结果 需要在持有锁时调用
+func (p *probe) detect() bool {
+	mismatch := 0
+	for _, prober := range p.mgr.probes {
+		// panic 时当作不匹配
+		result := core.ProbeMismatch
+		p.mgr.protect(p.meta, func() {
+			result = prober.Probe(p.data[0], p.data[1])
+		})
+		switch result {
+		case core.ProbeMatch:
+			p.decided = true
+			p.tracker = prober.(core.ProtocolTracker)
+			if p.meta.RoleGuessed {
+				logGuessed(p.meta)
+			}
+			p.conn = p.mgr.probed.GetOrLoad(p.meta.String(), func() core.ProtocolConnTracker {
+				return p.tracker.NewConnect(p.meta)
+			})
+			return true
+		case core.ProbeMismatch:
+			mismatch++
+		}
+	}
+	if mismatch == len(p.mgr.probes) || p.size > probeLimit {
+		log.Printf("unknown protocol of connection %s", p.meta)
+		p.decided = true
+		return true
+	}
+	return false
+}
+
+// finish 一个方向的流结束 两个方向都结束之后删除 probe
+func (p *probe) finish(isReq bool, reason core.CloseReason) {
+	p.mtx.Lock()
+	for p.flushing {
+		p.cond.Wait()
+	}
+	d := direction(isReq)
+	p.closed[d] = reason
+	if out := p.out[d]; out != nil {
+		out.Close(reason)
+	}
+	p.pumps--
+	last := p.pumps == 0
+	if last && !p.decided {
+		log.Printf("unknown protocol of connection %s", p.meta)
+	}
+	p.mtx.Unlock()
+
+	// getProbe 先锁 probeMtx 再锁 p.mtx, 这里不能同时持有
+	if last {
+		p.mgr.probeMtx.Lock()
+		if p.mgr.probing[p.meta.String()] == p {
+			delete(p.mgr.probing, p.meta.String())
+		}
+		p.mgr.probeMtx.Unlock()
+	}
+}
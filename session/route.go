@@ -0,0 +1,128 @@
+package session
+
+import (
+	"fmt"
+	"log"
+	"net"
+
+	"github.com/Salpadding/l7dump/core"
+)
+
+// PortRange 服务端的端口范围 包括 From 和 To
+type PortRange struct {
+	From, To int
+}
+
+func (r PortRange) String() string {
+	if r.From == r.To {
+		return fmt.Sprintf("%d", r.From)
+	}
+	return fmt.Sprintf("%d-%d", r.From, r.To)
+}
+
+// Match tracker 关心的连接 也用来生成抓包的 bpf 表达式
+// 一个连接匹配多个 tracker 时使用最具体的 见 moreSpecific
+type Match struct {
+	Ports []PortRange
+	// Hosts 服务端的地址或者网段 为空时不限制
+	Hosts []*net.IPNet
+	// Clients 客户端的网段 为空时不限制
+	Clients []*net.IPNet
+	// BPF 额外的条件 例如 "not host 10.0.0.1", 只在抓包时生效
+	BPF string
+}
+
+// Port 只匹配一个端口
+func Port(port int) Match {
+	return Match{Ports: []PortRange{{port, port}}}
+}
+
+// matchNets nets 为空时匹配所有地址 返回匹配的网段的掩码长度
+func matchNets(nets []*net.IPNet, ip net.IP) (bits int, ok bool) {
+	if len(nets) == 0 {
+		return -1, true
+	}
+	bits = -1
+	for _, n := range nets {
+		if n.Contains(ip) {
+			if ones, _ := n.Mask.Size(); ones > bits {
+				bits = ones
+			}
+		}
+	}
+	return bits, bits >= 0
+}
+
+// specificity 连接匹配的程度 不匹配时 ok 为 false
+type specificity struct {
+	host   int
+	ports  int
+	client int
+}
+
+func (m *Match) match(meta *core.ConnMeta) (sp specificity, ok bool) {
+	sp.ports = -1
+	for _, r := range m.Ports {
+		if meta.ServerPort >= r.From && meta.ServerPort <= r.To && (sp.ports < 0 || r.To-r.From < sp.ports) {
+			sp.ports = r.To - r.From
+		}
+	}
+	if sp.ports < 0 {
+		return
+	}
+	if sp.host, ok = matchNets(m.Hosts, meta.ServerIP); !ok {
+		return
+	}
+	sp.client, ok = matchNets(m.Clients, meta.ClientIP)
+	return
+}
+
+// moreSpecific 先比较服务端网段的掩码长度 再比较端口范围的大小 最后比较客户端网段
+func (a specificity) moreSpecific(b specificity) bool {
+	if a.host != b.host {
+		return a.host > b.host
+	}
+	if a.ports != b.ports {
+		return a.ports < b.ports
+	}
+	return a.client > b.client
+}
+
+// route 一个 tracker 和它匹配的连接
+type route struct {
+	match   Match
+	tracker core.ProtocolTracker
+	conns   *rwmap
+}
+
+// AddTracker 只按端口匹配
+func (s *ProtocolSessionMgr) AddTracker(port int, tracker core.ProtocolTracker) {
+	s.AddMatch(Port(port), tracker)
+}
+
+// AddMatch 添加一个 tracker, 条件完全相同时后添加的优先
+func (s *ProtocolSessionMgr) AddMatch(m Match, tracker core.ProtocolTracker) {
+	log.Printf("add tracker %T at %s", tracker, m.expr())
+	s.routes = append([]*route{{
+		match:   m,
+		tracker: tracker,
+		conns: &rwmap{
+			data: make(map[string]core.ProtocolConnTracker),
+		},
+	}}, s.routes...)
+}
+
+// lookup 找到最具体的 tracker, 没有时返回 nil
+func (s *ProtocolSessionMgr) lookup(meta *core.ConnMeta) *route {
+	var (
+		best   *route
+		bestSp specificity
+	)
+	for _, r := range s.routes {
+		sp, ok := r.match.match(meta)
+		if ok && (best == nil || sp.moreSpecific(bestSp)) {
+			best, bestSp = r, sp
+		}
+	}
+	return best
+}
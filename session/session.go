@@ -1,13 +1,17 @@
 package session
 
 import (
+	"bufio"
 	"encoding/binary"
 	"fmt"
 	"io"
-	"net"
+	"log"
+	"os"
+	"runtime/debug"
 	"time"
 
 	"sync"
+	"sync/atomic"
 
 	"context"
 
@@ -15,12 +19,8 @@ import (
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
 	"github.com/google/gopacket/pcap"
+	"github.com/google/gopacket/pcapgo"
 	"github.com/google/gopacket/tcpassembly"
-	"github.com/google/gopacket/tcpassembly/tcpreader"
-)
-
-const (
-	MinClientPort = 49152
 )
 
 type rwmap struct {
@@ -48,24 +48,59 @@ func (r *rwmap) Delete(key string) {
 }
 
 type ProtocolSessionMgr struct {
-	Trackers map[int]core.ProtocolTracker
-	connPool map[int]*rwmap
-	ctx      context.Context
-}
+	// Limits 需要在开始抓包之前设置
+	Limits Limits
+	// BPF 额外的过滤条件 和 tracker 生成的表达式取交集 见 Filter
+	BPF string
+	// Snaplen 每个数据包抓取的长度 为 0 时是 1600
+	Snaplen int
+	// Promisc 网卡是否使用混杂模式 NewMgr 默认打开
+	Promisc bool
+	// MaxPackets 处理这么多 tcp 数据包之后停止 为 0 时不限制
+	MaxPackets int64
 
-func NewMgr(ctx context.Context) ProtocolSessionMgr {
-	return ProtocolSessionMgr{
-		Trackers: make(map[int]core.ProtocolTracker),
-		connPool: make(map[int]*rwmap),
-		ctx:      ctx,
-	}
+	routes []*route
+	ctx    context.Context
+	// running 记录还在解码的 wrapper.run 和 probe.pump 协程
+	running sync.WaitGroup
+
+	// probes 没有按端口配置 tracker 时 通过数据识别协议
+	probes   []core.Prober
+	probeMtx sync.Mutex
+	probing  map[string]*probe
+	// probed 识别出协议的连接
+	probed *rwmap
+
+	// conns 看到了握手的连接 只在 assemble 的协程中使用
+	conns      map[connID]*connState
+	lifecycles []core.ConnLifecycle
+
+	// live 正在解码的连接 now 当前数据包的时间 closing 下一次关闭流的原因
+	// 只在 assemble 的协程中使用
+	live    map[connID]*liveConn
+	evicted map[connID]time.Time
+	now     time.Time
+	closing core.CloseReason
+	stats   Stats
+
+	// panics 解码时 panic 的连接 见 protect
+	panicMtx sync.Mutex
+	panics   map[string]int
 }
 
-func (p *ProtocolSessionMgr) AddTracker(port int, tracker core.ProtocolTracker) {
-	fmt.Printf("add tracker at port %d\n", port)
-	p.Trackers[port] = tracker
-	p.connPool[port] = &rwmap{
-		data: make(map[string]core.ProtocolConnTracker),
+func NewMgr(ctx context.Context) *ProtocolSessionMgr {
+	return &ProtocolSessionMgr{
+		ctx:     ctx,
+		probing: make(map[string]*probe),
+		probed: &rwmap{
+			data: make(map[string]core.ProtocolConnTracker),
+		},
+		conns:   make(map[connID]*connState),
+		live:    make(map[connID]*liveConn),
+		evicted: make(map[connID]time.Time),
+		closing: core.CloseFin,
+		panics:  make(map[string]int),
+		Promisc: true,
 	}
 }
 
@@ -75,17 +110,29 @@ type protocolConnTrackerWrapper struct {
 	decoder   func() (interface{}, error)
 	handler   func(interface{}) error
 	errHandle func(error)
-	stream    tcpreader.ReaderStream
+	stream    *core.Stream
 	meta      *core.ConnMeta
 	connPool  *rwmap
+	mgr       *ProtocolSessionMgr
 }
 
-func (s *protocolConnTrackerWrapper) run() {
+func (s *protocolConnTrackerWrapper) run(wg *sync.WaitGroup) {
+	defer wg.Done()
+	// 解码器 panic 之后不再解码这个方向 但是要读完数据 否则会阻塞 tcpassembly
+	if !s.mgr.protect(s.meta, s.decode) {
+		discard(s.stream)
+	}
+	s.countLost()
+	s.mgr.protect(s.meta, func() {
+		s.tracker.OnClose(s.conn, s.stream.Reason())
+	})
+	s.connPool.Delete(s.meta.String())
+}
+
+func (s *protocolConnTrackerWrapper) decode() {
 	for {
 		payload, err := s.decoder()
 		if err == io.EOF {
-			s.tracker.OnClose(s.conn)
-			s.connPool.Delete(s.meta.String())
 			return
 		}
 		if err != nil {
@@ -96,6 +143,55 @@ func (s *protocolConnTrackerWrapper) run() {
 	}
 }
 
+// discard 丢弃流中剩下的数据 丢包的错误之后可以继续读
+func discard(stream *core.Stream) {
+	for {
+		if _, err := io.Copy(io.Discard, stream); err != core.ErrDataLost {
+			return
+		}
+	}
+}
+
+// protect 调用 tracker 的代码 panic 时记录连接 返回 false
+// 一个连接的解码器出错不会影响其他的连接
+func (s *ProtocolSessionMgr) protect(meta *core.ConnMeta, fn func()) (ok bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("%s: recovered from panic %v\n%s", meta, r, debug.Stack())
+			atomic.AddInt64(&s.stats.Panics, 1)
+			s.panicMtx.Lock()
+			s.panics[meta.String()]++
+			s.panicMtx.Unlock()
+		}
+	}()
+	fn()
+	return true
+}
+
+// Panics 返回解码时 panic 的连接和次数
+func (s *ProtocolSessionMgr) Panics() map[string]int {
+	s.panicMtx.Lock()
+	defer s.panicMtx.Unlock()
+	panics := make(map[string]int, len(s.panics))
+	for conn, n := range s.panics {
+		panics[conn] = n
+	}
+	return panics
+}
+
+// countLost 流结束时统计丢失的数据
+func (s *protocolConnTrackerWrapper) countLost() {
+	lost, gaps := s.stream.Lost(), s.stream.Gaps()
+	if gaps == 0 {
+		return
+	}
+	if lost > 0 {
+		log.Printf("%s lost %d bytes in %d gaps", s.meta, lost, gaps)
+	}
+	atomic.AddInt64(&s.mgr.stats.Gaps, int64(gaps))
+	atomic.AddInt64(&s.mgr.stats.LostBytes, int64(lost))
+}
+
 type noop struct {
 }
 
@@ -109,35 +205,30 @@ func (s *noop) Reassembled([]tcpassembly.Reassembly) {
 func (s *noop) ReassemblyComplete() {
 }
 
-func (s *ProtocolSessionMgr) getConnect(meta *core.ConnMeta, tk core.ProtocolTracker) core.ProtocolConnTracker {
-	m, ok := s.connPool[meta.ServerPort]
-	if !ok {
-		panic(fmt.Sprintf("port %d doesn't related to tracker", meta.ServerPort))
-	}
-	return m.GetOrLoad(meta.String(), func() core.ProtocolConnTracker {
-		return tk.NewConnect(meta)
+func (s *ProtocolSessionMgr) getConnect(meta *core.ConnMeta, r *route) core.ProtocolConnTracker {
+	return r.conns.GetOrLoad(meta.String(), func() core.ProtocolConnTracker {
+		return r.tracker.NewConnect(meta)
 	})
 }
 
 // newWrapper
 // connTracker 和 wrapper 是 1:2 的关系
-func (s *ProtocolSessionMgr) newWrapper(meta *core.ConnMeta, isReq bool, net, transport gopacket.Flow) protocolConnTrackerWrapper {
-	tracker := s.Trackers[meta.ServerPort]
-	conn := s.getConnect(meta, tracker)
+func (s *ProtocolSessionMgr) newWrapper(meta *core.ConnMeta, isReq bool, tracker core.ProtocolTracker, conn core.ProtocolConnTracker, connPool *rwmap) protocolConnTrackerWrapper {
 	wrapper := protocolConnTrackerWrapper{
 		tracker:   tracker,
 		conn:      conn,
 		errHandle: conn.OnError,
-		stream:    tcpreader.NewReaderStream(),
+		stream:    core.NewStream(),
 		meta:      meta,
-		connPool:  s.connPool[meta.ServerPort],
+		connPool:  connPool,
+		mgr:       s,
 	}
 
 	if isReq {
-		wrapper.decoder = tracker.RequestDecoder(&wrapper.stream, conn)
+		wrapper.decoder = tracker.RequestDecoder(wrapper.stream, conn)
 		wrapper.handler = conn.OnRequest
 	} else {
-		wrapper.decoder = tracker.ResponseDecoder(&wrapper.stream, conn)
+		wrapper.decoder = tracker.ResponseDecoder(wrapper.stream, conn)
 		wrapper.handler = conn.OnResponse
 	}
 	return wrapper
@@ -146,81 +237,182 @@ func (s *ProtocolSessionMgr) newWrapper(meta *core.ConnMeta, isReq bool, net, tr
 // New 只是实现接口
 func (s *ProtocolSessionMgr) New(net, transport gopacket.Flow) tcpassembly.Stream {
 	meta, isReq := s.connKey(net, transport)
-	if meta.ClientPort < MinClientPort {
-		fmt.Printf("drop connection %s\n", meta.String())
+	r := s.lookup(&meta)
+	// 离线模式下没有 bpf 过滤 需要丢弃没有 tracker 的连接
+	if r == nil && len(s.probes) == 0 {
+		return &nop
+	}
+	id := newConnID(net, transport)
+	if s.isEvicted(id) {
 		return &nop
 	}
-	wrapper := s.newWrapper(&meta, isReq, net, transport)
-	go wrapper.run()
-	return &wrapper.stream
+	if r == nil {
+		// 识别出协议之后再交给 tracker
+		stream := core.NewStream()
+		s.running.Add(1)
+		go s.getProbe(&meta).pump(stream, isReq, &s.running)
+		return s.open(&meta, id, isReq, stream)
+	}
+	// 两个方向的流只记录一次
+	if meta.RoleGuessed && s.live[id] == nil {
+		logGuessed(&meta)
+	}
+	conn := s.getConnect(&meta, r)
+	wrapper := s.newWrapper(&meta, isReq, r.tracker, conn, r.conns)
+	s.running.Add(1)
+	go wrapper.run(&s.running)
+	return s.open(&meta, id, isReq, wrapper.stream)
 }
 
-// connKey 客户端的端口一定大于服务端的端口
+// connKey 通过握手确定客户端和服务端 见 role
 // pcap 里面客户端到服务端 服务端到客户端 会触发两次 ServerSessionMgr.New
 // 我们通过这个 key 判断是否是新的连接
 func (s *ProtocolSessionMgr) connKey(netFlow, transportFlow gopacket.Flow) (core.ConnMeta, bool) {
-	ip1 := (net.IP)(netFlow.Src().Raw())
-	ip2 := (net.IP)(netFlow.Dst().Raw())
-	port1 := int(binary.BigEndian.Uint16(transportFlow.Src().Raw()))
-	port2 := int(binary.BigEndian.Uint16(transportFlow.Dst().Raw()))
-	if port1 > port2 {
-		return core.ConnMeta{
-			ClientIP:   ip1,
-			ClientPort: port1,
-			ServerIP:   ip2,
-			ServerPort: port2,
-		}, true
-	}
-	return core.ConnMeta{
-		ClientIP:   ip2,
-		ClientPort: port2,
-		ServerIP:   ip1,
-		ServerPort: port1,
-	}, false
-
-}
-
-// Listen
-// TODO: 复用 bpf 表达式
-func (s *ProtocolSessionMgr) Listen(bpf, iface string) error {
+	isReq, guessed := s.role(netFlow, transportFlow)
+	meta := newMeta(netFlow, transportFlow, isReq)
+	meta.RoleGuessed = guessed
+	return meta, isReq
+}
+
+// logGuessed 交给 tracker 解码时才调用 没有 tracker 的连接不输出日志
+func logGuessed(meta *core.ConnMeta) {
+	log.Printf("handshake of %s not seen, guess role by port", meta.String())
+}
+
+// Listen 在网卡上抓包 所有的 tracker 共用一个 pcap handle
+// 需要在注册完 tracker 之后调用 ctx 取消之后关闭所有的流 等待解码协程退出再返回
+func (s *ProtocolSessionMgr) Listen(iface string) error {
 	// 以太网 MTU 通常小于 1600
-	handle, err := pcap.OpenLive(iface, 1600, true, pcap.BlockForever)
+	snaplen := s.Snaplen
+	if snaplen <= 0 {
+		snaplen = 1600
+	}
+	handle, err := pcap.OpenLive(iface, int32(snaplen), s.Promisc, pcap.BlockForever)
 
 	if err != nil {
 		return err
 	}
+	defer handle.Close()
 
-	// TODO: 多端口复用同一个 bpffilter
-	// 只保留 ip.protocol = tcp 的 而且 tcp.port = serverPort 的 包
-	fmt.Printf("create listener at interface %s with filter %s\n", iface, bpf)
+	// 只保留 tracker 关心的 tcp 数据包
+	bpf := s.Filter()
+	log.Printf("create listener at interface %s with filter %s", iface, bpf)
 	if err = handle.SetBPFFilter(bpf); err != nil {
-		panic(err)
+		return fmt.Errorf("invalid bpf filter %q: %w", bpf, err)
 	}
 
+	err = s.assemble(gopacket.NewPacketSource(handle, handle.LinkType()), false)
+	if stats, e := handle.Stats(); e == nil {
+		atomic.StoreInt64(&s.stats.Drops, int64(stats.PacketsDropped+stats.PacketsIfDropped))
+	}
+	return err
+}
+
+// ReadFile 离线模式 从 tcpdump 保存的 pcap/pcapng 文件读取数据包
+// 文件读完之后会关闭所有的流 并等待所有的解码协程退出
+func (s *ProtocolSessionMgr) ReadFile(file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	source, err := openOffline(bufio.NewReader(f))
+	if err != nil {
+		return err
+	}
+	log.Printf("read packets from %s", file)
+	return s.assemble(source, true)
+}
+
+// openOffline 根据文件头的 magic number 区分 pcap 和 pcapng
+func openOffline(r *bufio.Reader) (*gopacket.PacketSource, error) {
+	magic, err := r.Peek(4)
+	if err != nil {
+		return nil, err
+	}
+
+	// pcapng 的第一个 block 是 Section Header Block
+	if binary.BigEndian.Uint32(magic) == 0x0a0d0d0a {
+		ng, err := pcapgo.NewNgReader(r, pcapgo.DefaultNgReaderOptions)
+		if err != nil {
+			return nil, err
+		}
+		return gopacket.NewPacketSource(ng, ng.LinkType()), nil
+	}
+
+	reader, err := pcapgo.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	return gopacket.NewPacketSource(reader, reader.LinkType()), nil
+}
+
+// assemble 把数据包交给 tcpassembly 重组
+// 在线模式用系统时间定时清理超时的流 离线模式用数据包的时间戳
+// 数据包读完 达到 MaxPackets 或者 ctx 取消时调用 drain
+func (s *ProtocolSessionMgr) assemble(source *gopacket.PacketSource, offline bool) error {
 	pool := tcpassembly.NewStreamPool(s)
 	assembler := tcpassembly.NewAssembler(pool)
+	assembler.MaxBufferedPagesPerConnection = s.Limits.MaxPagesPerConn
+	assembler.MaxBufferedPagesTotal = s.Limits.MaxPages
 
-	source := gopacket.NewPacketSource(handle, handle.LinkType())
-	ticker := time.Tick(time.Minute)
+	// 每隔半个超时时间清理一次
+	idle := s.Limits.idleTimeout()
+	var (
+		ticker    <-chan time.Time
+		lastFlush time.Time
+	)
+	if !offline {
+		ticker = time.Tick(idle / 2)
+	}
 	packets := source.Packets()
 
 	for {
 		select {
 		case packet := <-packets:
 			if packet == nil {
+				s.drain(assembler)
 				return nil
 			}
 			if packet.NetworkLayer() == nil || packet.TransportLayer() == nil ||
 				packet.TransportLayer().LayerType() != layers.LayerTypeTCP {
 				continue
 			}
+			packetCount := atomic.AddInt64(&s.stats.Packets, 1)
 
 			tcp := packet.TransportLayer().(*layers.TCP)
-			assembler.AssembleWithTimestamp(packet.NetworkLayer().NetworkFlow(), tcp, packet.Metadata().Timestamp)
+			ts := packet.Metadata().Timestamp
+			s.now = ts
+			// 离线模式先清理超时的连接 再处理新的数据包
+			if offline {
+				if lastFlush.IsZero() {
+					lastFlush = ts
+				}
+				if ts.Sub(lastFlush) >= idle/2 {
+					s.flush(assembler, ts.Add(-idle))
+					lastFlush = ts
+				}
+			}
+			// 在创建流之前记录握手 确定客户端
+			s.track(packet.NetworkLayer().NetworkFlow(), tcp, ts)
+			assembler.AssembleWithTimestamp(packet.NetworkLayer().NetworkFlow(), tcp, ts)
+			if s.MaxPackets > 0 && packetCount >= s.MaxPackets {
+				s.drain(assembler)
+				return nil
+			}
 		case <-s.ctx.Done():
+			s.drain(assembler)
 			return nil
 		case <-ticker:
-			assembler.FlushOlderThan(time.Now().Add(time.Minute * -2))
+			s.flush(assembler, time.Now().Add(-idle))
 		}
 	}
 }
+
+// drain 关闭所有还在解码的流 等到所有的 OnClose 都被调用之后返回
+func (s *ProtocolSessionMgr) drain(assembler *tcpassembly.Assembler) {
+	s.closing = core.CloseEnd
+	assembler.FlushAll()
+	s.running.Wait()
+}
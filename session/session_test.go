@@ -0,0 +1,657 @@
+package session
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Salpadding/l7dump/core"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+// lineTracker 按行解码请求和响应 用于测试
+type lineTracker struct {
+	mtx    sync.Mutex
+	lines  []string
+	closed []core.CloseReason
+	metas  []*core.ConnMeta
+}
+
+type lineConn struct {
+	tracker *lineTracker
+}
+
+func (t *lineTracker) decoder(stream *core.Stream) func() (interface{}, error) {
+	buf := bufio.NewReader(stream)
+	return func() (interface{}, error) {
+		line, err := buf.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		return line, nil
+	}
+}
+
+func (t *lineTracker) RequestDecoder(stream *core.Stream, conn core.ProtocolConnTracker) func() (interface{}, error) {
+	return t.decoder(stream)
+}
+
+func (t *lineTracker) ResponseDecoder(stream *core.Stream, conn core.ProtocolConnTracker) func() (interface{}, error) {
+	return t.decoder(stream)
+}
+
+func (t *lineTracker) NewConnect(meta *core.ConnMeta) core.ProtocolConnTracker {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	t.metas = append(t.metas, meta)
+	return &lineConn{tracker: t}
+}
+
+func (t *lineTracker) OnClose(conn core.ProtocolConnTracker, reason core.CloseReason) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	t.closed = append(t.closed, reason)
+}
+
+func (c *lineConn) record(v interface{}) error {
+	c.tracker.mtx.Lock()
+	defer c.tracker.mtx.Unlock()
+	c.tracker.lines = append(c.tracker.lines, v.(string))
+	return nil
+}
+
+func (c *lineConn) OnRequest(req interface{}) error   { return c.record(req) }
+func (c *lineConn) OnResponse(resp interface{}) error { return c.record(resp) }
+func (c *lineConn) OnError(error)                     {}
+
+// pcapWriter 生成一条 tcp 连接的数据包
+type pcapWriter struct {
+	w       *pcapgo.Writer
+	ts      time.Time
+	seq     map[bool]uint32
+	client  net.IP
+	server  net.IP
+	cport   layers.TCPPort
+	sport   layers.TCPPort
+	failure error
+}
+
+func (p *pcapWriter) write(fromClient bool, flags string, payload string) {
+	eth := &layers.Ethernet{
+		SrcMAC:       net.HardwareAddr{0, 0, 0, 0, 0, 1},
+		DstMAC:       net.HardwareAddr{0, 0, 0, 0, 0, 2},
+		EthernetType: layers.EthernetTypeIPv4,
+	}
+	ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolTCP, SrcIP: p.client, DstIP: p.server}
+	tcp := &layers.TCP{SrcPort: p.cport, DstPort: p.sport, Seq: p.seq[fromClient], Window: 65535}
+	if !fromClient {
+		ip.SrcIP, ip.DstIP = p.server, p.client
+		tcp.SrcPort, tcp.DstPort = p.sport, p.cport
+	}
+	for _, f := range flags {
+		switch f {
+		case 'S':
+			tcp.SYN = true
+		case 'A':
+			tcp.ACK = true
+		case 'F':
+			tcp.FIN = true
+		case 'R':
+			tcp.RST = true
+		}
+	}
+	tcp.SetNetworkLayerForChecksum(ip)
+
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, eth, ip, tcp, gopacket.Payload(payload)); err != nil {
+		p.failure = err
+		return
+	}
+
+	p.ts = p.ts.Add(time.Millisecond)
+	data := buf.Bytes()
+	ci := gopacket.CaptureInfo{Timestamp: p.ts, CaptureLength: len(data), Length: len(data)}
+	if err := p.w.WritePacket(ci, data); err != nil {
+		p.failure = err
+	}
+
+	p.seq[fromClient] += uint32(len(payload))
+	if tcp.SYN || tcp.FIN {
+		p.seq[fromClient]++
+	}
+}
+
+// capture 测试用的 pcap 文件 所有连接写到同一个文件
+type capture struct {
+	t     *testing.T
+	path  string
+	f     *os.File
+	w     *pcapgo.Writer
+	conns []*pcapWriter
+}
+
+func newCapture(t *testing.T) *capture {
+	path := filepath.Join(t.TempDir(), "capture.pcap")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := pcapgo.NewWriter(f)
+	if err = w.WriteFileHeader(65535, layers.LinkTypeEthernet); err != nil {
+		t.Fatal(err)
+	}
+	return &capture{t: t, path: path, f: f, w: w}
+}
+
+// conn 10.0.0.1:cport 到 10.0.0.2:sport 的连接 数据包的时间从 1700000000 开始
+func (c *capture) conn(cport, sport layers.TCPPort) *pcapWriter {
+	p := &pcapWriter{
+		w:      c.w,
+		ts:     time.Unix(1700000000, 0),
+		seq:    map[bool]uint32{true: 100, false: 500},
+		client: net.IP{10, 0, 0, 1},
+		server: net.IP{10, 0, 0, 2},
+		cport:  cport,
+		sport:  sport,
+	}
+	c.conns = append(c.conns, p)
+	return p
+}
+
+// close 写完所有的数据包之后调用 返回文件的路径
+func (c *capture) close() string {
+	c.f.Close()
+	for _, p := range c.conns {
+		if p.failure != nil {
+			c.t.Fatal(p.failure)
+		}
+	}
+	return c.path
+}
+
+func TestReadFile(t *testing.T) {
+	c := newCapture(t)
+	p := c.conn(51000, 9000)
+	p.write(true, "S", "")
+	p.write(false, "SA", "")
+	p.write(true, "A", "ping\n")
+	p.write(false, "A", "pong\n")
+	// 跨越清理周期之后继续发送数据
+	p.ts = p.ts.Add(90 * time.Second)
+	p.write(true, "A", "ping again\n")
+	p.write(false, "A", "pong again\n")
+	p.write(true, "FA", "")
+	p.write(false, "FA", "")
+	file := c.close()
+
+	tracker := &lineTracker{}
+	mgr := NewMgr(context.Background())
+	mgr.AddTracker(9000, tracker)
+
+	if err := mgr.ReadFile(file); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(tracker.lines) != 4 {
+		t.Fatalf("expect 4 lines, got %q", tracker.lines)
+	}
+	if len(tracker.closed) != 2 {
+		t.Fatalf("expect 2 closed streams, got %v", tracker.closed)
+	}
+
+	// 第三个数据包之后停止 只有请求被解码
+	tracker = &lineTracker{}
+	mgr = NewMgr(context.Background())
+	mgr.AddTracker(9000, tracker)
+	mgr.MaxPackets = 3
+	if err := mgr.ReadFile(file); err != nil {
+		t.Fatal(err)
+	}
+	if len(tracker.lines) != 1 || mgr.Stats().Packets != 3 {
+		t.Fatalf("expect 1 line in 3 packets, got %q %+v", tracker.lines, mgr.Stats())
+	}
+	if len(tracker.closed) != 2 || tracker.closed[0] != core.CloseEnd || tracker.closed[1] != core.CloseEnd {
+		t.Fatalf("unexpected close reasons %v", tracker.closed)
+	}
+}
+
+func cidr(t *testing.T, s string) *net.IPNet {
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestRoutes(t *testing.T) {
+	mgr := NewMgr(context.Background())
+	if expr := mgr.Filter(); expr != "tcp" {
+		t.Fatalf("unexpected filter %s", expr)
+	}
+	wide, host, client := &lineTracker{}, &lineTracker{}, &lineTracker{}
+	mgr.AddMatch(Match{Ports: []PortRange{{9000, 9010}}, Hosts: []*net.IPNet{cidr(t, "10.0.0.0/24")}}, wide)
+	mgr.AddMatch(Match{Ports: []PortRange{{9000, 9000}}, Hosts: []*net.IPNet{cidr(t, "10.0.0.2/32")}, BPF: "not vlan"}, host)
+	mgr.AddMatch(Match{
+		Ports:   []PortRange{{9000, 9010}, {9100, 9100}},
+		Hosts:   []*net.IPNet{cidr(t, "10.0.0.0/24")},
+		Clients: []*net.IPNet{cidr(t, "10.0.1.0/24"), cidr(t, "10.0.2.0/24")},
+	}, client)
+	// 没有端口的 Match 匹配不到任何连接 不出现在 bpf 里
+	none := Match{Hosts: []*net.IPNet{cidr(t, "10.0.0.3/32")}}
+	if expr := none.expr(); expr != "host 10.0.0.3" {
+		t.Fatalf("unexpected match expr %s", expr)
+	}
+	mgr.AddMatch(none, &lineTracker{})
+	mgr.BPF = "vlan 100"
+	expect := "(tcp and (portrange 9000-9010 and net 10.0.0.0/24 or port 9000 and host 10.0.0.2 and (not vlan) or " +
+		"(portrange 9000-9010 or port 9100) and net 10.0.0.0/24 and (net 10.0.1.0/24 or net 10.0.2.0/24))) and (vlan 100)"
+	if expr := mgr.Filter(); expr != expect {
+		t.Fatalf("unexpected filter %s", expr)
+	}
+
+	lookup := func(client, server net.IP, port int) core.ProtocolTracker {
+		r := mgr.lookup(&core.ConnMeta{ClientIP: client, ServerIP: server, ClientPort: 50000, ServerPort: port})
+		if r == nil {
+			return nil
+		}
+		return r.tracker
+	}
+	cases := []struct {
+		client, server net.IP
+		port           int
+		expect         core.ProtocolTracker
+	}{
+		{net.IP{10, 0, 0, 1}, net.IP{10, 0, 0, 2}, 9000, host},
+		{net.IP{10, 0, 1, 1}, net.IP{10, 0, 0, 2}, 9000, host},
+		{net.IP{10, 0, 0, 1}, net.IP{10, 0, 0, 3}, 9005, wide},
+		{net.IP{10, 0, 1, 1}, net.IP{10, 0, 0, 3}, 9005, client},
+		{net.IP{10, 0, 1, 1}, net.IP{10, 0, 0, 3}, 9100, client},
+		{net.IP{10, 0, 0, 1}, net.IP{10, 0, 0, 3}, 9100, nil},
+		{net.IP{10, 0, 0, 1}, net.IP{10, 0, 1, 3}, 9000, nil},
+	}
+	for _, c := range cases {
+		if tk := lookup(c.client, c.server, c.port); tk != c.expect {
+			t.Errorf("%s -> %s:%d matched %p, expect %p", c.client, c.server, c.port, tk, c.expect)
+		}
+	}
+
+	// 离线模式下只解码匹配的连接
+	c := newCapture(t)
+	for _, server := range []net.IP{{10, 0, 0, 2}, {10, 0, 0, 4}, {10, 0, 1, 4}} {
+		p := c.conn(51000, 9000)
+		p.server = server
+		p.write(true, "S", "")
+		p.write(false, "SA", "")
+		p.write(true, "A", "ping\n")
+		p.write(false, "A", "pong\n")
+		p.write(true, "FA", "")
+		p.write(false, "FA", "")
+	}
+	file := c.close()
+
+	if err := mgr.ReadFile(file); err != nil {
+		t.Fatal(err)
+	}
+	if len(host.metas) != 1 || !host.metas[0].ServerIP.Equal(net.IP{10, 0, 0, 2}) || len(host.lines) != 2 {
+		t.Fatalf("unexpected connections %v lines %q", host.metas, host.lines)
+	}
+	if len(wide.metas) != 1 || !wide.metas[0].ServerIP.Equal(net.IP{10, 0, 0, 4}) || len(client.metas) != 0 {
+		t.Fatalf("unexpected connections %v %v", wide.metas, client.metas)
+	}
+}
+
+// probeTracker 请求以 prefix 开头时匹配 resp 为 true 时还要等到响应
+type probeTracker struct {
+	lineTracker
+	prefix string
+	resp   bool
+}
+
+func (t *probeTracker) Probe(req, resp []byte) core.ProbeResult {
+	result := core.ProbePrefix(req, t.prefix)
+	if result == core.ProbeMatch && t.resp && len(resp) == 0 {
+		return core.ProbeMore
+	}
+	return result
+}
+
+func TestProbe(t *testing.T) {
+	c := newCapture(t)
+	matched, unknown, serverFirst, halfClosed := c.conn(51000, 7000), c.conn(51001, 7001), c.conn(51002, 7002), c.conn(51003, 7003)
+	for _, p := range []*pcapWriter{matched, unknown, serverFirst, halfClosed} {
+		p.write(true, "S", "")
+		p.write(false, "SA", "")
+	}
+	matched.write(true, "A", "ping\n")
+	matched.write(false, "A", "pong\n")
+	unknown.write(true, "A", "hello\n")
+	unknown.write(false, "A", "world\n")
+	// 服务端先发送的数据要等识别出协议之后按顺序交给 tracker
+	serverFirst.write(false, "A", "welcome\n")
+	serverFirst.write(true, "A", "ping\n")
+	serverFirst.write(false, "A", "pong\n")
+	for _, p := range []*pcapWriter{matched, unknown, serverFirst} {
+		p.write(true, "FA", "")
+		p.write(false, "FA", "")
+	}
+	// 客户端的流在识别出协议之前结束 重放缓存的数据之后也要关闭
+	halfClosed.write(true, "A", "hi\n")
+	halfClosed.write(true, "FA", "")
+	halfClosed.write(false, "A", "ok\n")
+	halfClosed.write(false, "FA", "")
+	file := c.close()
+
+	tracker := &probeTracker{prefix: "ping"}
+	waiting := &probeTracker{prefix: "hi", resp: true}
+	mgr := NewMgr(context.Background())
+	if err := mgr.AddProbe(tracker); err != nil {
+		t.Fatal(err)
+	}
+	if err := mgr.AddProbe(waiting); err != nil {
+		t.Fatal(err)
+	}
+	if err := mgr.AddProbe(&lineTracker{}); err == nil {
+		t.Fatal("expect error for tracker without Probe")
+	}
+	if err := mgr.ReadFile(file); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(tracker.lines) != 5 {
+		t.Fatalf("expect 5 lines, got %q", tracker.lines)
+	}
+	if len(tracker.closed) != 4 {
+		t.Fatalf("expect 4 closed streams, got %v", tracker.closed)
+	}
+	if len(waiting.lines) != 2 || len(waiting.closed) != 2 {
+		t.Fatalf("expect 2 lines and 2 closed streams, got %q %v", waiting.lines, waiting.closed)
+	}
+	if len(mgr.probing) != 0 {
+		t.Fatalf("expect no probing connections, got %d", len(mgr.probing))
+	}
+}
+
+func TestRoles(t *testing.T) {
+	c := newCapture(t)
+	// 客户端的端口比服务端小
+	handshake, midStream, tracked := c.conn(3000, 40000), c.conn(3001, 40001), c.conn(3002, 40002)
+	handshake.write(true, "S", "")
+	handshake.write(false, "SA", "")
+	for _, p := range []*pcapWriter{handshake, midStream, tracked} {
+		p.write(true, "A", "ping\n")
+		p.write(false, "A", "pong\n")
+		p.write(true, "FA", "")
+		p.write(false, "FA", "")
+	}
+	file := c.close()
+
+	probed := &probeTracker{}
+	port := &lineTracker{}
+	mgr := NewMgr(context.Background())
+	mgr.AddTracker(40002, port)
+	if err := mgr.AddProbe(probed); err != nil {
+		t.Fatal(err)
+	}
+	if err := mgr.ReadFile(file); err != nil {
+		t.Fatal(err)
+	}
+
+	metas := make(map[int]*core.ConnMeta)
+	for _, meta := range append(probed.metas, port.metas...) {
+		metas[meta.ClientPort] = meta
+	}
+	if meta := metas[3000]; meta == nil || meta.ServerPort != 40000 || meta.RoleGuessed {
+		t.Errorf("unexpected role from handshake %+v", meta)
+	}
+	// 没有握手也没有 tracker 时按端口猜
+	if meta := metas[40001]; meta == nil || meta.ServerPort != 3001 || !meta.RoleGuessed {
+		t.Errorf("unexpected guessed role %+v", meta)
+	}
+	if meta := metas[3002]; meta == nil || meta.ServerPort != 40002 || !meta.RoleGuessed {
+		t.Errorf("unexpected role from tracker port %+v", meta)
+	}
+	for _, c := range mgr.conns {
+		if c.meta.ClientPort != 3000 || !c.closed {
+			t.Errorf("unexpected conn state %+v", c)
+		}
+	}
+}
+
+// eventSink 记录 ConnEvents 输出的 Event
+type eventSink struct {
+	events []*core.Event
+}
+
+func (s *eventSink) Write(ev *core.Event) error {
+	s.events = append(s.events, ev)
+	return nil
+}
+
+func (s *eventSink) Close() error {
+	return nil
+}
+
+func TestLifecycle(t *testing.T) {
+	c := newCapture(t)
+	// 服务端先关闭的连接 没有响应的连接 和被拒绝的连接
+	closed, refused, timedOut := c.conn(50000, 6379), c.conn(50001, 6379), c.conn(50002, 6379)
+	closed.write(true, "S", "")
+	closed.write(false, "SA", "")
+	closed.write(true, "A", "")
+	closed.write(true, "A", "ping\n")
+	closed.write(false, "A", "pong\n")
+	closed.write(false, "FA", "")
+	closed.write(true, "FA", "")
+	closed.write(false, "A", "")
+	timedOut.write(true, "S", "")
+	timedOut.seq[true]--
+	timedOut.write(true, "S", "")
+	// 超时之后才出现的连接触发清理
+	refused.ts = refused.ts.Add(time.Minute)
+	refused.write(true, "S", "")
+	refused.write(false, "RA", "")
+	file := c.close()
+
+	sink := &eventSink{}
+	mgr := NewMgr(context.Background())
+	mgr.AddTracker(6379, &lineTracker{})
+	mgr.AddLifecycle(&ConnEvents{Sink: sink})
+	mgr.Limits.IdleTimeout = 10 * time.Second
+	if err := mgr.ReadFile(file); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(sink.events) != 4 {
+		t.Fatalf("expect 4 events, got %v", sink.events)
+	}
+	connect, closing, timeout, refusal := sink.events[0], sink.events[1], sink.events[2], sink.events[3]
+	if connect.Op != "connect" || connect.Status != "established" || connect.Latency != 2*time.Millisecond {
+		t.Errorf("unexpected connect event %v", connect)
+	}
+	if closing.Op != "close" || closing.Status != "server_close" || closing.Latency != 5*time.Millisecond {
+		t.Errorf("unexpected close event %v", closing)
+	}
+	// 重传的 SYN 算在等待的时间里
+	if timeout.Op != "connect" || timeout.Status != "timeout" || timeout.Meta.ClientPort != 50002 || timeout.Latency != time.Millisecond {
+		t.Errorf("unexpected timeout event %v", timeout)
+	}
+	if refusal.Op != "connect" || refusal.Status != "refused" || refusal.Meta.ClientPort != 50001 {
+		t.Errorf("unexpected refused event %v", refusal)
+	}
+}
+
+func TestLimits(t *testing.T) {
+	c := newCapture(t)
+	// 第二个连接挤掉第一个 第三个连接在超时之后才出现
+	start := time.Unix(1700000000, 0)
+	first, second, third := c.conn(50000, 9000), c.conn(50001, 9000), c.conn(50002, 9000)
+	second.ts = start.Add(time.Second)
+	third.ts = start.Add(time.Minute)
+	first.write(true, "A", "ping\n")
+	second.write(true, "A", "ping\n")
+	first.write(false, "A", "pong\n")
+	third.write(true, "S", "")
+	third.write(true, "A", "ping\n")
+	third.write(true, "FA", "")
+	// 没有 tracker 的 SYN 不记录 记录的握手也受 MaxConns 限制
+	untracked, fourth := c.conn(50003, 9000), c.conn(50004, 9000)
+	untracked.ts = start.Add(time.Minute)
+	fourth.ts = start.Add(time.Minute)
+	untracked.sport = 9999
+	untracked.write(true, "S", "")
+	fourth.write(true, "S", "")
+	file := c.close()
+
+	tracker := &lineTracker{}
+	mgr := NewMgr(context.Background())
+	mgr.AddTracker(9000, tracker)
+	mgr.Limits = Limits{MaxConns: 1, IdleTimeout: 10 * time.Second}
+	if err := mgr.ReadFile(file); err != nil {
+		t.Fatal(err)
+	}
+
+	reasons := make(map[core.CloseReason]int)
+	for _, reason := range tracker.closed {
+		reasons[reason]++
+	}
+	if reasons[core.CloseConnLimit] != 1 || reasons[core.CloseIdle] != 1 || reasons[core.CloseFin] != 1 {
+		t.Errorf("unexpected close reasons %v", tracker.closed)
+	}
+	stats := mgr.Stats()
+	if stats.Conns != 4 || stats.LimitEvicted != 1 || stats.IdleEvicted != 1 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+	if len(mgr.conns) != 1 {
+		t.Fatalf("expect 1 handshake, got %d", len(mgr.conns))
+	}
+	for _, c := range mgr.conns {
+		if c.meta.ClientPort != 50004 {
+			t.Errorf("unexpected handshake %+v", c.meta)
+		}
+	}
+}
+
+// blockingSource 读完 pcap 之后阻塞 模拟网卡
+type blockingSource struct {
+	r     *pcapgo.Reader
+	block chan struct{}
+}
+
+func (s *blockingSource) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	data, ci, err := s.r.ReadPacketData()
+	if err == io.EOF {
+		<-s.block
+	}
+	return data, ci, err
+}
+
+func TestShutdown(t *testing.T) {
+	c := newCapture(t)
+	p := c.conn(51000, 9000)
+	p.write(true, "S", "")
+	p.write(false, "SA", "")
+	p.write(true, "A", "ping\n")
+	p.write(false, "A", "pong\n")
+	f, err := os.Open(c.close())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	r, err := pcapgo.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	source := &blockingSource{r: r, block: make(chan struct{})}
+	defer close(source.block)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	tracker := &lineTracker{}
+	mgr := NewMgr(ctx)
+	mgr.AddTracker(9000, tracker)
+	done := make(chan error)
+	go func() {
+		done <- mgr.assemble(gopacket.NewPacketSource(source, layers.LinkTypeEthernet), false)
+	}()
+	for deadline := time.Now().Add(5 * time.Second); mgr.Stats().Packets < 4; {
+		if time.Now().After(deadline) {
+			t.Fatalf("packets not assembled %+v", mgr.Stats())
+		}
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+
+	select {
+	case err = <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("assemble does not return after cancel")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 连接没有结束 取消之后也要解码完已经收到的数据
+	if len(tracker.lines) != 2 {
+		t.Errorf("expect 2 lines, got %q", tracker.lines)
+	}
+	if len(tracker.closed) != 2 || tracker.closed[0] != core.CloseEnd || tracker.closed[1] != core.CloseEnd {
+		t.Errorf("unexpected close reasons %v", tracker.closed)
+	}
+}
+
+// panicTracker 请求是 boom 时 panic
+type panicTracker struct {
+	*lineTracker
+}
+
+func (t *panicTracker) RequestDecoder(stream *core.Stream, conn core.ProtocolConnTracker) func() (interface{}, error) {
+	decode := t.decoder(stream)
+	return func() (interface{}, error) {
+		line, err := decode()
+		if line == "boom\n" {
+			panic("boom")
+		}
+		return line, err
+	}
+}
+
+func TestPanic(t *testing.T) {
+	c := newCapture(t)
+	// 第一个连接的请求解码器 panic 之后 响应和第二个连接继续解码
+	bad, good := c.conn(50000, 9000), c.conn(50001, 9000)
+	bad.write(true, "S", "")
+	bad.write(false, "SA", "")
+	bad.write(true, "A", "boom\n")
+	bad.write(true, "A", "ping\n")
+	bad.write(false, "A", "pong\n")
+	good.write(true, "A", "ping\n")
+	good.write(false, "A", "pong\n")
+	bad.write(true, "FA", "")
+	bad.write(false, "FA", "")
+	file := c.close()
+
+	tracker := &panicTracker{&lineTracker{}}
+	mgr := NewMgr(context.Background())
+	mgr.AddTracker(9000, tracker)
+	if err := mgr.ReadFile(file); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(tracker.lines) != 3 {
+		t.Errorf("expect 3 lines, got %q", tracker.lines)
+	}
+	if len(tracker.closed) != 4 {
+		t.Errorf("expect 4 closed streams, got %v", tracker.closed)
+	}
+	panics := mgr.Panics()
+	if mgr.Stats().Panics != 1 || len(panics) != 1 || panics[tracker.metas[0].String()] != 1 {
+		t.Errorf("unexpected panics %v", panics)
+	}
+}
@@ -0,0 +1,220 @@
+package tls
+
+import (
+	"bytes"
+	ctls "crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// https://www.rfc-editor.org/rfc/rfc8446#section-5.1
+const (
+	recordChangeCipherSpec = 20
+	recordAlert            = 21
+	recordHandshake        = 22
+	recordApplicationData  = 23
+)
+
+const (
+	handshakeClientHello = 1
+	handshakeServerHello = 2
+)
+
+const (
+	extServerName        = 0
+	extALPN              = 16
+	extSupportedVersions = 43
+)
+
+const (
+	recordHeader = 5
+	// maxRecord 加密之后的记录最长 2^14 + 2048
+	maxRecord = 1<<14 + 2048
+	// maxHello 等待 hello 的时候最多缓存的握手数据
+	maxHello = 1 << 16
+)
+
+var ErrMalformRecord = errors.New("malformed tls record")
+
+// helloRetryRandom ServerHello 的 random 是这个值时表示 HelloRetryRequest
+var helloRetryRandom = []byte{
+	0xcf, 0x21, 0xad, 0x74, 0xe5, 0x9a, 0x61, 0x11, 0xbe, 0x1d, 0x8c, 0x02, 0x1e, 0x65, 0xb8, 0x91,
+	0xc2, 0xa2, 0x11, 0x16, 0x7a, 0xbb, 0x8c, 0x5e, 0x07, 0x9e, 0x09, 0xe2, 0xc8, 0xa8, 0x33, 0x9c,
+}
+
+var versionNames = map[uint16]string{
+	0x0300: "SSL 3.0",
+	0x0301: "TLS 1.0",
+	0x0302: "TLS 1.1",
+	0x0303: "TLS 1.2",
+	0x0304: "TLS 1.3",
+}
+
+func versionName(v uint16) string {
+	if name, ok := versionNames[v]; ok {
+		return name
+	}
+	return fmt.Sprintf("0x%04x", v)
+}
+
+// isGrease 客户端随机插入的保留值 https://www.rfc-editor.org/rfc/rfc8701
+func isGrease(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+var alertNames = map[byte]string{
+	0: "close_notify", 10: "unexpected_message", 20: "bad_record_mac", 22: "record_overflow",
+	40: "handshake_failure", 42: "bad_certificate", 43: "unsupported_certificate",
+	44: "certificate_revoked", 45: "certificate_expired", 46: "certificate_unknown",
+	47: "illegal_parameter", 48: "unknown_ca", 49: "access_denied", 50: "decode_error",
+	51: "decrypt_error", 70: "protocol_version", 71: "insufficient_security", 80: "internal_error",
+	86: "inappropriate_fallback", 90: "user_canceled", 109: "missing_extension",
+	110: "unsupported_extension", 112: "unrecognized_name", 116: "certificate_required",
+	120: "no_application_protocol",
+}
+
+func alertName(desc byte) string {
+	if name, ok := alertNames[desc]; ok {
+		return name
+	}
+	return fmt.Sprintf("alert_%d", desc)
+}
+
+// ClientHello 客户端支持的参数
+type ClientHello struct {
+	ServerName string   `json:"server_name,omitempty"`
+	ALPN       []string `json:"alpn,omitempty"`
+	// Versions supported_versions 扩展中的版本 没有这个扩展时是 hello 中的版本
+	Versions     []string `json:"versions"`
+	CipherSuites int      `json:"cipher_suites"`
+}
+
+// ServerHello 服务端选择的参数
+// tls 1.3 的 alpn 在加密的 EncryptedExtensions 中 无法获取
+type ServerHello struct {
+	Version     string `json:"version"`
+	CipherSuite string `json:"cipher_suite"`
+	ALPN        string `json:"alpn,omitempty"`
+	HelloRetry  bool   `json:"hello_retry,omitempty"`
+}
+
+// parser 数据不足时返回零值并记录错误
+type parser struct {
+	b   []byte
+	err error
+}
+
+func (p *parser) next(n int) []byte {
+	if p.err != nil || n < 0 || len(p.b) < n {
+		p.err = ErrMalformRecord
+		return nil
+	}
+	data := p.b[:n]
+	p.b = p.b[n:]
+	return data
+}
+
+func (p *parser) uint8() int {
+	if data := p.next(1); data != nil {
+		return int(data[0])
+	}
+	return 0
+}
+
+func (p *parser) uint16() int {
+	if data := p.next(2); data != nil {
+		return int(binary.BigEndian.Uint16(data))
+	}
+	return 0
+}
+
+// vector 长度前缀的数据 size 是长度的字节数
+func (p *parser) vector(size int) *parser {
+	n := 0
+	switch size {
+	case 1:
+		n = p.uint8()
+	case 2:
+		n = p.uint16()
+	}
+	data := p.next(n)
+	return &parser{b: data, err: p.err}
+}
+
+// extensions 遍历 hello 中的扩展
+func (p *parser) extensions(fn func(typ int, ext *parser)) {
+	if p.err != nil || len(p.b) == 0 {
+		return
+	}
+	exts := p.vector(2)
+	for exts.err == nil && len(exts.b) > 0 {
+		typ := exts.uint16()
+		fn(typ, exts.vector(2))
+	}
+	if exts.err != nil {
+		p.err = exts.err
+	}
+}
+
+func parseClientHello(body []byte) (*ClientHello, error) {
+	hello := &ClientHello{}
+	p := &parser{b: body}
+	version := p.uint16()
+	p.next(32)
+	p.vector(1)
+	suites := p.vector(2)
+	hello.CipherSuites = len(suites.b) / 2
+	p.vector(1)
+
+	p.extensions(func(typ int, ext *parser) {
+		switch typ {
+		case extServerName:
+			names := ext.vector(2)
+			for names.err == nil && len(names.b) > 0 {
+				kind := names.uint8()
+				name := names.vector(2)
+				if kind == 0 {
+					hello.ServerName = string(name.b)
+				}
+			}
+		case extALPN:
+			protos := ext.vector(2)
+			for protos.err == nil && len(protos.b) > 0 {
+				hello.ALPN = append(hello.ALPN, string(protos.vector(1).b))
+			}
+		case extSupportedVersions:
+			versions := ext.vector(1)
+			for versions.err == nil && len(versions.b) > 1 {
+				if v := uint16(versions.uint16()); !isGrease(v) {
+					hello.Versions = append(hello.Versions, versionName(v))
+				}
+			}
+		}
+	})
+	if len(hello.Versions) == 0 {
+		hello.Versions = []string{versionName(uint16(version))}
+	}
+	return hello, p.err
+}
+
+func parseServerHello(body []byte) (*ServerHello, error) {
+	hello := &ServerHello{}
+	p := &parser{b: body}
+	version := uint16(p.uint16())
+	hello.HelloRetry = bytes.Equal(p.next(32), helloRetryRandom)
+	p.vector(1)
+	hello.CipherSuite = ctls.CipherSuiteName(uint16(p.uint16()))
+	p.uint8()
+
+	p.extensions(func(typ int, ext *parser) {
+		switch typ {
+		case extALPN:
+			hello.ALPN = string(ext.vector(2).vector(1).b)
+		case extSupportedVersions:
+			version = uint16(ext.uint16())
+		}
+	})
+	hello.Version = versionName(version)
+	return hello, p.err
+}
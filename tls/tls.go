@@ -0,0 +1,350 @@
+package tls
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/Salpadding/l7dump/core"
+)
+
+var (
+	_ core.ProtocolTracker     = (*Tracker)(nil)
+	_ core.ProtocolConnTracker = (*ConnTracker)(nil)
+	_ core.Prober              = (*Tracker)(nil)
+)
+
+// readRecord 读取一个记录 返回类型 内容和总长度
+func readRecord(r *bufio.Reader) (typ byte, body []byte, size int, err error) {
+	var hdr [recordHeader]byte
+	if _, err = io.ReadFull(r, hdr[:]); err != nil {
+		return
+	}
+	typ = hdr[0]
+	n := int(binary.BigEndian.Uint16(hdr[3:]))
+	if hdr[1] != 3 || n > maxRecord {
+		return typ, nil, 0, ErrMalformRecord
+	}
+	size = n + recordHeader
+	body = make([]byte, n)
+	_, err = io.ReadFull(r, body)
+	return
+}
+
+// handshake 从缓存的握手数据中取出第一个完整的消息
+func handshake(data []byte) (typ byte, body []byte, ok bool) {
+	if len(data) < 4 {
+		return
+	}
+	n := int(data[1])<<16 | int(data[2])<<8 | int(data[3])
+	if len(data) < n+4 {
+		return
+	}
+	return data[0], data[4 : n+4], true
+}
+
+// half 一个方向上等待 hello 的状态 只在解码的协程里使用
+type half struct {
+	hs   []byte
+	size int
+	time time.Time
+	// done 已经解析完 hello 或者放弃解析 之后的记录都是加密的
+	done bool
+	// gap 丢包之后需要重新同步到记录的开头
+	gap bool
+	// lost 解析完 hello 之前丢了数据
+	lost bool
+}
+
+// add 缓存握手记录 返回完整的握手消息
+func (h *half) add(body []byte, size int, seen time.Time) (typ byte, msg []byte, ok bool) {
+	if h.time.IsZero() {
+		h.time = seen
+	}
+	h.size += size
+	h.hs = append(h.hs, body...)
+	typ, msg, ok = handshake(h.hs)
+	if !ok && len(h.hs) > maxHello {
+		h.done = true
+	}
+	return
+}
+
+type ConnTracker struct {
+	meta       *core.ConnMeta
+	tracker    *Tracker
+	reqStream  *core.Stream
+	respStream *core.Stream
+	reqBuf     *bufio.Reader
+	respBuf    *bufio.Reader
+
+	// hello 等待 ServerHello 的 ClientHello
+	mtx   sync.Mutex
+	hello *core.Event
+
+	req  half
+	resp half
+}
+
+func (c *ConnTracker) setHello(ev *core.Event) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.hello = ev
+}
+
+func (c *ConnTracker) hasHello() bool {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.hello != nil
+}
+
+func (c *ConnTracker) takeHello() *core.Event {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	ev := c.hello
+	c.hello = nil
+	return ev
+}
+
+// decodeReq 解析 ClientHello, 之后的记录只读取不解析
+func (c *ConnTracker) decodeReq() (interface{}, error) {
+	if c.req.gap {
+		skipped, err := core.Resync(c.reqBuf, matchRecord)
+		if err != nil {
+			return nil, err
+		}
+		c.req.gap = false
+		log.Printf("tls %s: request resynced, skipped %d bytes", c.meta, skipped)
+	}
+	if _, err := c.reqBuf.Peek(1); err != nil {
+		if err == core.ErrDataLost {
+			c.lostReq()
+			return nil, nil
+		}
+		return nil, err
+	}
+	seen := c.reqStream.Seen()
+	gaps := c.reqStream.Gaps()
+	typ, body, size, err := readRecord(c.reqBuf)
+	if err != nil && c.reqStream.Gaps() > gaps {
+		c.lostReq()
+		return nil, nil
+	}
+	if err != nil || c.req.done {
+		return nil, err
+	}
+	if typ != recordHandshake {
+		c.req.done = true
+		return nil, nil
+	}
+	hsType, msg, ok := c.req.add(body, size, seen)
+	if !ok {
+		return nil, nil
+	}
+	c.req.done = true
+	if hsType != handshakeClientHello {
+		return nil, nil
+	}
+
+	hello, err := parseClientHello(msg)
+	ev := core.NewEvent(c.meta, "tls")
+	ev.Op = "handshake"
+	ev.ReqTime = c.req.time
+	ev.ReqSize = c.req.size
+	ev.Request = hello
+	if err != nil {
+		ev.Error = err.Error()
+	}
+	c.setHello(ev)
+	return hello, nil
+}
+
+// lostReq ClientHello 有数据丢失 用不完整的 Event 等待 ServerHello
+// 抓包开始时连接已经建立的不输出
+func (c *ConnTracker) lostReq() {
+	c.req.gap = true
+	if c.req.done {
+		return
+	}
+	c.req.done = true
+	if c.req.time.IsZero() {
+		return
+	}
+	ev := core.NewEvent(c.meta, "tls")
+	ev.Op = "handshake"
+	ev.ReqTime = c.req.time
+	ev.ReqSize = c.req.size
+	ev.Incomplete = true
+	c.setHello(ev)
+}
+
+// decodeResp 解析 ServerHello 或者握手失败的 alert
+func (c *ConnTracker) decodeResp() (interface{}, error) {
+	if c.resp.gap {
+		skipped, err := core.Resync(c.respBuf, matchRecord)
+		if err != nil {
+			return nil, err
+		}
+		c.resp.gap = false
+		log.Printf("tls %s: response resynced, skipped %d bytes", c.meta, skipped)
+	}
+	if _, err := c.respBuf.Peek(1); err != nil {
+		if err == core.ErrDataLost {
+			c.lostResp()
+			return nil, nil
+		}
+		return nil, err
+	}
+	seen := c.respStream.Seen()
+	gaps := c.respStream.Gaps()
+	typ, body, size, err := readRecord(c.respBuf)
+	if err != nil && c.respStream.Gaps() > gaps {
+		c.lostResp()
+		return nil, nil
+	}
+	if err != nil || c.resp.done {
+		return nil, err
+	}
+
+	switch typ {
+	case recordAlert:
+		c.resp.done = true
+		c.resp.size += size
+		if len(body) < 2 {
+			return nil, ErrMalformRecord
+		}
+		c.finish(nil, "alert", alertName(body[1]))
+		return nil, nil
+	case recordHandshake:
+		hsType, msg, ok := c.resp.add(body, size, seen)
+		if !ok {
+			return nil, nil
+		}
+		c.resp.done = true
+		if hsType != handshakeServerHello {
+			return nil, nil
+		}
+		hello, err := parseServerHello(msg)
+		status := hello.Version
+		if hello.HelloRetry {
+			status = "hello_retry"
+		}
+		var errMsg string
+		if err != nil {
+			errMsg = err.Error()
+		}
+		c.finish(hello, status, errMsg)
+		return hello, nil
+	}
+	c.resp.done = true
+	return nil, nil
+}
+
+// lostResp ServerHello 有数据丢失 没有看到任何握手数据时不输出
+func (c *ConnTracker) lostResp() {
+	c.resp.gap = true
+	if c.resp.done {
+		return
+	}
+	c.resp.done = true
+	if c.resp.time.IsZero() && !c.hasHello() {
+		return
+	}
+	c.resp.lost = true
+	c.finish(nil, "", core.ErrDataLost.Error())
+}
+
+func (c *ConnTracker) finish(hello *ServerHello, status, errMsg string) {
+	ev := c.takeHello()
+	if ev == nil {
+		// 没有看到 ClientHello
+		ev = core.NewEvent(c.meta, "tls")
+		ev.Op = "handshake"
+	}
+	ev.Done(c.respStream.Seen())
+	ev.RespSize = c.resp.size
+	ev.Status = status
+	if ev.Error == "" {
+		ev.Error = errMsg
+	}
+	ev.Incomplete = ev.Incomplete || c.resp.lost
+	if hello != nil {
+		ev.Response = hello
+	}
+	core.Emit(c.tracker.Sink, ev)
+}
+
+func (c *ConnTracker) OnRequest(req interface{}) error {
+	return nil
+}
+
+func (c *ConnTracker) OnResponse(resp interface{}) error {
+	return nil
+}
+
+func (c *ConnTracker) OnError(err error) {
+	log.Printf("tls %s: %v", c.meta, err)
+}
+
+// Tracker 记录 tls 握手 不解密数据
+// 每个连接产生一个 Event, 包括 sni alpn 和协商的版本
+type Tracker struct {
+	// Sink 接收每次握手的 Event, 为空时输出到标准输出
+	Sink core.Sink
+}
+
+func (t *Tracker) RequestDecoder(stream *core.Stream, conn core.ProtocolConnTracker) func() (interface{}, error) {
+	c := conn.(*ConnTracker)
+	c.reqStream = stream
+	c.reqBuf = bufio.NewReader(stream)
+	return c.decodeReq
+}
+
+func (t *Tracker) ResponseDecoder(stream *core.Stream, conn core.ProtocolConnTracker) func() (interface{}, error) {
+	c := conn.(*ConnTracker)
+	c.respStream = stream
+	c.respBuf = bufio.NewReader(stream)
+	return c.decodeResp
+}
+
+func (t *Tracker) NewConnect(meta *core.ConnMeta) core.ProtocolConnTracker {
+	log.Printf("new tls connect to %s", meta.String())
+	return &ConnTracker{
+		meta:    meta,
+		tracker: t,
+	}
+}
+
+func (t *Tracker) OnClose(conn core.ProtocolConnTracker, reason core.CloseReason) {
+}
+
+// Probe 客户端先发送包含 ClientHello 的握手记录
+func (t *Tracker) Probe(req, resp []byte) core.ProbeResult {
+	if len(req) < 6 {
+		if len(req) == 0 && len(resp) > 0 {
+			return core.ProbeMismatch
+		}
+		return core.ProbeMore
+	}
+	if req[0] == recordHandshake && req[1] == 3 && req[5] == handshakeClientHello {
+		return core.ProbeMatch
+	}
+	return core.ProbeMismatch
+}
+
+// matchRecord 记录头的类型 版本和长度都是合理的
+func matchRecord(data []byte) core.ProbeResult {
+	if data[0] < recordChangeCipherSpec || data[0] > recordApplicationData {
+		return core.ProbeMismatch
+	}
+	if len(data) < recordHeader {
+		return core.ProbeMore
+	}
+	if data[1] != 3 || data[2] > 4 || int(binary.BigEndian.Uint16(data[3:])) > maxRecord {
+		return core.ProbeMismatch
+	}
+	return core.ProbeMatch
+}
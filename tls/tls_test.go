@@ -0,0 +1,125 @@
+package tls
+
+import (
+	ctls "crypto/tls"
+	"encoding/binary"
+	"io"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/Salpadding/l7dump/core"
+	"github.com/Salpadding/l7dump/core/coretest"
+)
+
+// chunk 一个方向上的一段数据
+// chunk data 为 nil 表示这个方向丢了数据
+type chunk struct {
+	fromClient bool
+	data       []byte
+}
+
+func replay(t *testing.T, chunks []chunk) []*core.Event {
+	sink := &coretest.Sink{}
+	conn := coretest.Start(&Tracker{Sink: sink}, coretest.Meta(443))
+	for _, c := range chunks {
+		conn.Send(c.fromClient, c.data)
+	}
+	for _, err := range conn.Close() {
+		t.Error(err)
+	}
+	return sink.Events()
+}
+
+// clientHello crypto/tls 客户端发送的第一个记录
+func clientHello(t *testing.T) []byte {
+	c, s := net.Pipe()
+	defer s.Close()
+	go func() {
+		defer c.Close()
+		ctls.Client(c, &ctls.Config{ServerName: "example.com", NextProtos: []string{"h2", "http/1.1"}}).Handshake()
+	}()
+	hdr := make([]byte, recordHeader)
+	if _, err := io.ReadFull(s, hdr); err != nil {
+		t.Fatal(err)
+	}
+	body := make([]byte, binary.BigEndian.Uint16(hdr[3:]))
+	if _, err := io.ReadFull(s, body); err != nil {
+		t.Fatal(err)
+	}
+	return append(hdr, body...)
+}
+
+func record(typ byte, body []byte) []byte {
+	return append([]byte{typ, 3, 3, byte(len(body) >> 8), byte(len(body))}, body...)
+}
+
+func TestHandshake(t *testing.T) {
+	hello := clientHello(t)
+	if (&Tracker{}).Probe(hello, nil) != core.ProbeMatch {
+		t.Fatal("expect client hello to match")
+	}
+
+	// tls 1.3 的 ServerHello 分成两个记录
+	body := []byte{3, 3}
+	body = append(body, make([]byte, 32)...)
+	body = append(body, 0, 0x13, 0x01, 0)
+	body = append(body, 0, 6, 0, extSupportedVersions, 0, 2, 3, 4)
+	hs := append([]byte{handshakeServerHello, 0, 0, byte(len(body))}, body...)
+
+	events := replay(t, []chunk{
+		{true, hello},
+		{false, record(recordHandshake, hs[:10])},
+		{false, record(recordHandshake, hs[10:])},
+		{false, record(recordChangeCipherSpec, []byte{1})},
+		{true, record(recordApplicationData, []byte("encrypted"))},
+	})
+	if len(events) != 1 {
+		t.Fatalf("expect 1 event, got %d", len(events))
+	}
+	ev := events[0]
+	if ev.Status != "TLS 1.3" || ev.Error != "" || ev.Latency != 2*time.Millisecond {
+		t.Errorf("unexpected event %v", ev)
+	}
+	req := ev.Request.(*ClientHello)
+	if req.ServerName != "example.com" || !reflect.DeepEqual(req.ALPN, []string{"h2", "http/1.1"}) {
+		t.Errorf("unexpected client hello %+v", req)
+	}
+	if resp := ev.Response.(*ServerHello); resp.CipherSuite != "TLS_AES_128_GCM_SHA256" {
+		t.Errorf("unexpected server hello %+v", resp)
+	}
+
+	events = replay(t, []chunk{
+		{true, hello},
+		{false, record(recordAlert, []byte{2, 112})},
+	})
+	if len(events) != 1 || events[0].Status != "alert" || events[0].Error != "unrecognized_name" {
+		t.Fatalf("unexpected alert events %v", events)
+	}
+
+	// ServerHello 的第二个记录丢了一部分
+	second := record(recordHandshake, hs[10:])
+	events = replay(t, []chunk{
+		{true, hello},
+		{false, record(recordHandshake, hs[:10])},
+		{false, second[:8]},
+		{false, nil},
+		{false, append(second[12:], record(recordApplicationData, []byte("encrypted"))...)},
+	})
+	if len(events) != 1 || !events[0].Incomplete || events[0].Error != core.ErrDataLost.Error() ||
+		events[0].Request.(*ClientHello).ServerName != "example.com" {
+		t.Fatalf("unexpected lost events %v", events)
+	}
+
+	// 抓包开始时连接已经建立
+	events = replay(t, []chunk{
+		{true, nil},
+		{true, record(recordApplicationData, []byte("encrypted"))},
+		{false, nil},
+		{false, record(recordApplicationData, []byte("encrypted"))},
+	})
+	if len(events) != 0 {
+		t.Fatalf("unexpected events %v", events)
+	}
+}